@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+	"go.uber.org/zap"
+)
+
+// newDiscoveryProvider returns the provider configured by cfg, or nil for a
+// pool with static backends.
+func newDiscoveryProvider(cfg *config.DiscoveryConfig) (discovery.Provider, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Provider {
+	case "dns":
+		return discovery.NewDNSProvider(discovery.DNSOptions(cfg.DNS))
+	case "consul":
+		c := cfg.Consul
+		opts := discovery.ConsulOptions{
+			Address:       c.Address,
+			Service:       c.Service,
+			Tag:           c.Tag,
+			Datacenter:    c.Datacenter,
+			Scheme:        c.Scheme,
+			WaitTime:      c.WaitTime,
+			RetryInterval: c.RetryInterval,
+		}
+		if c.TokenFile != "" {
+			token, err := os.ReadFile(c.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.Token = strings.TrimSpace(string(token))
+		}
+		return discovery.NewConsulProvider(opts)
+	case "kubernetes":
+		return discovery.NewKubernetesProvider(discovery.KubernetesOptions(cfg.Kubernetes))
+	}
+	return discovery.NewFileProvider(discovery.FileOptions(cfg.File))
+}
+
+// startDiscovery keeps the servers of p in sync with the provider of plan
+// until p.stopDiscovery is called. Failed lookups are logged and leave the
+// servers as they are.
+func (pm *poolManager) startDiscovery(p *pool, plan *poolPlan) {
+	ctx, cancel := context.WithCancel(pm.ctx)
+	p.discovery = plan.cfg.Discovery
+	p.stopDiscovery = cancel
+	if plan.provider == nil {
+		return
+	}
+
+	name := plan.cfg.Name
+	updates := make(chan discovery.Update)
+	go plan.provider.Run(ctx, updates)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case u := <-updates:
+				for _, err := range u.Skipped {
+					pm.logger.Warn("Service discovery skipped a backend", zap.String("pool", name), zap.Error(err))
+				}
+				if u.Err != nil {
+					pm.logger.Warn("Service discovery failed, keeping current servers", zap.String("pool", name), zap.Error(u.Err))
+					continue
+				}
+				pm.mu.Lock()
+				// A reload may have stopped discovery while waiting.
+				if ctx.Err() == nil {
+					connect(u.Servers, p.transport)
+					pm.syncServers(p, u.Servers)
+				}
+				pm.mu.Unlock()
+			}
+		}
+	}()
+}
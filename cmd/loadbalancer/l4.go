@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// l4Listeners runs the layer-4 listeners. Like the frontend, a listener keeps
+// its socket across reloads: a change of pool is applied in place, and a
+// change of timeouts starts a new proxy on the same socket while the old one
+// finishes its connections.
+type l4Listeners struct {
+	logger  *zap.Logger
+	metrics *metrics.Metrics
+	pools   *poolManager
+
+	mu      sync.Mutex
+	running map[string]*l4Listener
+}
+
+// l4Listener is a running listener: ln and proxy for TCP, udp for UDP.
+type l4Listener struct {
+	cfg   config.ListenerConfig
+	ln    *sharedListener
+	proxy *interfaces.TCPProxy
+	udp   *interfaces.UDPProxy
+}
+
+func newL4Listeners(logger *zap.Logger, m *metrics.Metrics, pools *poolManager) *l4Listeners {
+	return &l4Listeners{logger: logger, metrics: m, pools: pools, running: make(map[string]*l4Listener)}
+}
+
+// apply reconciles the running listeners with cfg. Listeners that fail to
+// bind are reported and the others are still applied. The pools of cfg must
+// have been applied already.
+func (l *l4Listeners) apply(cfg *config.Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wanted := make(map[string]config.ListenerConfig)
+	for _, lc := range cfg.Listeners {
+		wanted[lc.Name] = lc
+	}
+
+	// Release sockets first, so that addresses can move between listeners.
+	for name, rl := range l.running {
+		if lc, ok := wanted[name]; !ok || socketChanged(rl.cfg, lc) {
+			l.stop(rl)
+			delete(l.running, name)
+			l.logger.Info("Stopped listener", zap.String("listener", name), zap.String("address", rl.cfg.ListenAddr))
+		}
+	}
+
+	var errs []error
+	for _, lc := range cfg.Listeners {
+		pool := l.pools.pool(lc.Pool)
+		rl, ok := l.running[lc.Name]
+		switch {
+		case !ok:
+			rl, err := l.listen(lc)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("listener %q: %w", lc.Name, err))
+				continue
+			}
+			l.running[lc.Name] = rl
+			l.logger.Info("Started listener", zap.String("listener", lc.Name), zap.String("protocol", lc.Protocol), zap.String("address", lc.ListenAddr))
+		case rl.udp != nil:
+			rl.udp.SetPool(pool)
+			rl.udp.SetIdleTimeout(lc.IdleTimeout)
+			rl.cfg = lc
+		case proxySettingsChanged(rl.cfg, lc):
+			old := rl.proxy
+			l.start(rl, lc)
+			go l.drain(old)
+		default:
+			rl.proxy.SetPool(pool)
+			rl.proxy.SetSNIRoutes(l.sniRoutes(lc))
+			rl.cfg = lc
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *l4Listeners) listen(lc config.ListenerConfig) (*l4Listener, error) {
+	if lc.Protocol == "udp" {
+		pc, err := net.ListenPacket("udp", lc.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy := interfaces.NewUDPProxy(lc.Name, l.pools.pool(lc.Pool), l.logger,
+			interfaces.WithFlowIdleTimeout(lc.IdleTimeout),
+			interfaces.WithUDPMetrics(l.metrics),
+		)
+		go func() {
+			if err := proxy.Serve(pc); err != nil {
+				l.logger.Error("Listener failed", zap.String("listener", lc.Name), zap.Error(err))
+			}
+		}()
+		return &l4Listener{cfg: lc, udp: proxy}, nil
+	}
+
+	ln, err := listenTCP(lc.ListenAddr, lc.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	rl := &l4Listener{ln: newSharedListener(ln, l.logger)}
+	l.start(rl, lc)
+	return rl, nil
+}
+
+// stop closes the socket of rl and lets its connections finish in the
+// background.
+func (l *l4Listeners) stop(rl *l4Listener) {
+	if rl.udp != nil {
+		rl.udp.Shutdown(context.Background())
+		return
+	}
+	rl.ln.Close()
+	go l.drain(rl.proxy)
+}
+
+func (l *l4Listeners) start(rl *l4Listener, lc config.ListenerConfig) {
+	opts := []interfaces.TCPProxyOption{
+		interfaces.WithIdleTimeout(lc.IdleTimeout),
+		interfaces.WithTCPMetrics(l.metrics),
+	}
+	if lc.ConnectTimeout > 0 {
+		opts = append(opts, interfaces.WithConnectTimeout(lc.ConnectTimeout))
+	}
+	if lc.HalfClose != nil {
+		opts = append(opts, interfaces.WithHalfClose(*lc.HalfClose))
+	}
+
+	proxy := interfaces.NewTCPProxy(lc.Name, l.pools.pool(lc.Pool), l.logger, opts...)
+	proxy.SetSNIRoutes(l.sniRoutes(lc))
+	ln := rl.ln.attach()
+	go func() {
+		if err := proxy.Serve(ln); err != nil {
+			l.logger.Error("Listener failed", zap.String("listener", lc.Name), zap.Error(err))
+		}
+	}()
+	rl.cfg, rl.proxy = lc, proxy
+}
+
+func (l *l4Listeners) sniRoutes(lc config.ListenerConfig) []interfaces.SNIRoute {
+	routes := make([]interfaces.SNIRoute, 0, len(lc.SNIRoutes))
+	for _, rc := range lc.SNIRoutes {
+		routes = append(routes, interfaces.SNIRoute{
+			ServerNames: rc.ServerNames,
+			ALPN:        rc.ALPN,
+			Pool:        l.pools.pool(rc.Pool),
+		})
+	}
+	return routes
+}
+
+func socketChanged(a, b config.ListenerConfig) bool {
+	return a.ListenAddr != b.ListenAddr || a.Protocol != b.Protocol || !reflect.DeepEqual(a.ProxyProtocol, b.ProxyProtocol)
+}
+
+func proxySettingsChanged(a, b config.ListenerConfig) bool {
+	halfClose := func(c config.ListenerConfig) bool { return c.HalfClose == nil || *c.HalfClose }
+	return a.ConnectTimeout != b.ConnectTimeout || a.IdleTimeout != b.IdleTimeout || halfClose(a) != halfClose(b)
+}
+
+func (l *l4Listeners) drain(proxy *interfaces.TCPProxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	proxy.Shutdown(ctx)
+}
+
+func (l *l4Listeners) shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rl := range l.running {
+		if rl.ln != nil {
+			rl.ln.Close()
+		}
+	}
+	var errs []error
+	for _, rl := range l.running {
+		if rl.udp != nil {
+			errs = append(errs, rl.udp.Shutdown(ctx))
+		} else {
+			errs = append(errs, rl.proxy.Shutdown(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"go.uber.org/zap"
+)
+
+// frontend serves the HTTP handler on a single listening socket. Server
+// settings such as timeouts are changed by starting a new http.Server on the
+// same socket and gracefully shutting down the previous one, so a reload
+// never refuses or drops connections.
+type frontend struct {
+	handler http.Handler
+	logger  *zap.Logger
+	ln      *sharedListener
+	tls     *tlsManager
+
+	mu       sync.Mutex
+	srv      *http.Server
+	settings serverSettings
+}
+
+type serverSettings struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	tlsEnabled   bool
+}
+
+func newFrontend(cfg config.ServerConfig, handler http.Handler, tls *tlsManager, logger *zap.Logger) (*frontend, error) {
+	ln, err := listenTCP(cfg.ListenAddr, cfg.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return &frontend{handler: handler, logger: logger, ln: newSharedListener(ln, logger), tls: tls}, nil
+}
+
+// listenTCP listens on addr, accepting PROXY protocol headers if enabled.
+// The configuration has been validated, so the trusted sources parse.
+func listenTCP(addr string, pp config.ProxyProtocolConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || !pp.Enabled {
+		return ln, err
+	}
+	trusted, err := proxyprotocol.ParseTrusted(pp.TrustedSources)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return proxyprotocol.NewListener(ln, trusted), nil
+}
+
+// serve starts serving with the settings from cfg. If a server with the same
+// settings is already running, it is kept. Certificates and TLS settings are
+// applied without a new server. If the certificates fail to load, the running
+// server is kept.
+func (f *frontend) serve(cfg *config.Config) error {
+	settings := serverSettings{
+		readTimeout:  cfg.Server.ReadTimeout,
+		writeTimeout: cfg.Server.WriteTimeout,
+		idleTimeout:  cfg.Server.IdleTimeout,
+		tlsEnabled:   cfg.TLS.Enabled,
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if settings.tlsEnabled {
+		if err := f.tls.apply(cfg.TLS); err != nil {
+			return err
+		}
+	} else {
+		f.tls.stop()
+	}
+	if f.srv != nil && f.settings == settings {
+		return nil
+	}
+
+	srv := &http.Server{
+		Handler:      f.handler,
+		ReadTimeout:  settings.readTimeout,
+		WriteTimeout: settings.writeTimeout,
+		IdleTimeout:  settings.idleTimeout,
+	}
+	if settings.tlsEnabled {
+		srv.TLSConfig = f.tls.serverConfig()
+	}
+	ln := f.ln.attach()
+	go func() {
+		var err error
+		if settings.tlsEnabled {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			f.logger.Error("Server failed", zap.Error(err))
+		}
+	}()
+
+	if old := f.srv; old != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			old.Shutdown(ctx)
+		}()
+	}
+	f.srv, f.settings = srv, settings
+	return nil
+}
+
+func (f *frontend) shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ln.Close()
+	if f.srv == nil {
+		return nil
+	}
+	return f.srv.Shutdown(ctx)
+}
+
+// sharedListener accepts connections on one socket and hands each of them to
+// one of the attached virtual listeners.
+type sharedListener struct {
+	net.Listener
+	logger *zap.Logger
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSharedListener(ln net.Listener, logger *zap.Logger) *sharedListener {
+	sl := &sharedListener{Listener: ln, logger: logger, conns: make(chan net.Conn), done: make(chan struct{})}
+	go sl.acceptLoop()
+	return sl
+}
+
+// acceptLoop accepts until the socket is closed. Other errors, such as
+// running out of file descriptors, are retried with backoff, as
+// http.Server does, since the socket cannot be opened again.
+func (sl *sharedListener) acceptLoop() {
+	var backoff time.Duration
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				sl.Close()
+				return
+			}
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			sl.logger.Warn("Accept failed, retrying", zap.Stringer("addr", sl.Addr()), zap.Duration("backoff", backoff), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+				continue
+			case <-sl.done:
+				return
+			}
+		}
+		backoff = 0
+		select {
+		case sl.conns <- conn:
+		case <-sl.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (sl *sharedListener) attach() net.Listener {
+	return &virtualListener{parent: sl, closed: make(chan struct{})}
+}
+
+func (sl *sharedListener) Close() error {
+	var err error
+	sl.once.Do(func() {
+		close(sl.done)
+		err = sl.Listener.Close()
+	})
+	return err
+}
+
+type virtualListener struct {
+	parent *sharedListener
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (vl *virtualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-vl.parent.conns:
+		return conn, nil
+	case <-vl.closed:
+		return nil, net.ErrClosed
+	case <-vl.parent.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (vl *virtualListener) Close() error {
+	vl.once.Do(func() { close(vl.closed) })
+	return nil
+}
+
+func (vl *virtualListener) Addr() net.Addr {
+	return vl.parent.Addr()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// exhaustedListener fails its first accepts as if out of file descriptors.
+type exhaustedListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *exhaustedListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestSharedListenerRetriesAcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exhausted := &exhaustedListener{Listener: ln}
+	exhausted.failures.Store(3)
+	sl := newSharedListener(exhausted, zap.NewNop())
+	defer sl.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer client.Close()
+	conn, err := sl.attach().Accept()
+	if err != nil {
+		t.Fatalf("Expected the listener to survive accept errors, got %v", err)
+	}
+	conn.Close()
+}
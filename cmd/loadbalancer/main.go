@@ -4,33 +4,46 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
-	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
-	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/accesslog"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/tracing"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
-	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
 	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
+	}
+
 	configFile := flag.String("config", "config/config.yaml", "Path to configuration file")
+	overrides := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	// Load configuration
-	cfg, err := config.Load(*configFile)
+	cfg, err := config.LoadLayered(*configFile, os.Environ(), overrides)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -43,59 +56,113 @@ func main() {
 	defer logger.Sync()
 
 	// Setup metrics
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m, err := metrics.New(registry)
+	if err != nil {
+		logger.Fatal("Failed to setup metrics", zap.Error(err))
+	}
 	if cfg.Metrics.Enabled {
-		metrics.Setup(cfg.Metrics.Port)
+		metricsSrv := metrics.NewServer(cfg.Metrics.Port, registry)
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics server failed", zap.Error(err))
+			}
+		}()
+		defer metricsSrv.Close()
 	}
 
-	// Initialize servers
-	servers, err := initializeServers(cfg.BackendServers)
-	if err != nil {
-		logger.Fatal("Failed to initialize servers", zap.Error(err))
+	// Initialize pools
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pools := newPoolManager(ctx, logger, m)
+	if err := pools.apply(cfg); err != nil {
+		logger.Fatal("Failed to initialize pools", zap.Error(err))
 	}
+	defer pools.stop()
 
-	// Initialize load balancer
-	lb, err := initializeLoadBalancer(cfg.LoadBalancer.Algorithm, servers)
-	if err != nil {
-		logger.Fatal("Failed to initialize load balancer", zap.Error(err))
+	handlerOpts := []interfaces.HandlerOption{
+		interfaces.WithMetrics(m),
+		interfaces.WithTransport(proxyprotocol.NewTransport()),
+	}
+	var tracer *middleware.Tracer
+	if cfg.Tracing.Enabled {
+		tp, propagator, err := setupTracing(cfg.Tracing)
+		if err != nil {
+			logger.Fatal("Failed to setup tracing", zap.Error(err))
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tp.Shutdown(ctx)
+		}()
+		tracer = middleware.NewTracer(tp, propagator)
+		handlerOpts = append(handlerOpts, interfaces.WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper {
+			return tracing.NewTransport(rt, tp, propagator)
+		}))
 	}
 
-	// Initialize circuit breaker
-	cb := circuitbreaker.NewCircuitBreaker(5, 10*time.Second)
-
-	useCase := usecases.NewLoadBalancerUseCase(lb, cb)
-
-	// Initialize rate limiter
-	rl := middleware.NewRateLimiter(100, 10) // 100 requests per second, burst of 10
+	handler := interfaces.NewHTTPHandler(pools.defaultPool(), logger, handlerOpts...)
+	pools.attach(handler)
 
-	handler := interfaces.NewHTTPHandler(useCase, logger)
+	rlStore, closeRLStore, err := newRateLimitStore(cfg.RateLimiting, m)
+	if err != nil {
+		logger.Fatal("Failed to setup rate limit store", zap.Error(err))
+	}
+	defer closeRLStore()
+	rl := middleware.NewRateLimiter(
+		middleware.WithRateLimitMetrics(m),
+		middleware.WithRouteMatcher(handler.RouteName),
+		middleware.WithRateLimitStore(rlStore),
+	)
+	if err := applyRateLimits(rl, cfg); err != nil {
+		logger.Fatal("Failed to setup rate limiting", zap.Error(err))
+	}
 
-	// Setup server
-	srv := &http.Server{
-		Addr:         cfg.Server.ListenAddr,
-		Handler:      rl.RateLimit(handler),
-		ReadTimeout:  cfg.Server.ReadTimeout,
-		WriteTimeout: cfg.Server.WriteTimeout,
-		IdleTimeout:  cfg.Server.IdleTimeout,
+	tlsManager, err := newTLSManager(ctx, logger, m)
+	if err != nil {
+		logger.Fatal("Failed to setup TLS", zap.Error(err))
 	}
 
-	// Start health check
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go useCase.StartHealthCheck(ctx, cfg.LoadBalancer.HealthCheckInterval)
+	var rootHandler http.Handler = rl.RateLimit(handler)
+	if tracer != nil {
+		rootHandler = tracer.Trace(rootHandler)
+	}
+	if cfg.AccessLog.Enabled {
+		accessLog, err := setupAccessLog(cfg.AccessLog)
+		if err != nil {
+			logger.Fatal("Failed to setup access log", zap.Error(err))
+		}
+		defer accessLog.Close()
+		rootHandler = middleware.NewAccessLogger(accessLog, logger).AccessLog(rootHandler)
+	}
+	rootHandler = tlsManager.acmeChallenges(rootHandler)
 
 	// Start server
-	go func() {
-		logger.Info("Starting load balancer", zap.String("address", cfg.Server.ListenAddr))
-		if cfg.TLS.Enabled {
-			if err := srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil && err != http.ErrServerClosed {
-				logger.Fatal("Failed to start server", zap.Error(err))
-			}
-		} else {
-			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				logger.Fatal("Failed to start server", zap.Error(err))
-			}
+	fe, err := newFrontend(cfg.Server, rootHandler, tlsManager, logger)
+	if err != nil {
+		logger.Fatal("Failed to start server", zap.Error(err))
+	}
+	logger.Info("Starting load balancer", zap.String("address", cfg.Server.ListenAddr))
+	if err := fe.serve(cfg); err != nil {
+		logger.Fatal("Failed to start server", zap.Error(err))
+	}
+	if acme := cfg.TLS.ACME; cfg.TLS.Enabled && acme.Enabled && acme.HTTPListenAddr != "" {
+		challenges, err := tlsManager.serveChallenges(acme.HTTPListenAddr, cfg.Server.ListenAddr)
+		if err != nil {
+			logger.Fatal("Failed to start ACME challenge server", zap.Error(err))
 		}
-	}()
+		defer challenges.Close()
+	}
+
+	l4 := newL4Listeners(logger, m, pools)
+	if err := l4.apply(cfg); err != nil {
+		logger.Fatal("Failed to start listeners", zap.Error(err))
+	}
+
+	// Reload configuration on SIGHUP and file changes
+	rel := &reloader{configFile: *configFile, overrides: overrides, logger: logger, pools: pools, rateLimiter: rl, frontend: fe, l4: l4, current: cfg}
+	go rel.run(ctx)
 
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
@@ -104,11 +171,14 @@ func main() {
 	logger.Info("Shutting down server...")
 
 	// Graceful shutdown
-	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	if err := fe.shutdown(shutdownCtx); err != nil {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
+	if err := l4.shutdown(shutdownCtx); err != nil {
+		logger.Fatal("Listeners forced to shutdown", zap.Error(err))
+	}
 
 	logger.Info("Server exiting")
 }
@@ -125,6 +195,51 @@ func setupLogger(cfg config.LoggingConfig) (*zap.Logger, error) {
 	return zapConfig.Build()
 }
 
+func setupAccessLog(cfg config.AccessLogConfig) (*accesslog.Logger, error) {
+	formatter, err := accesslog.NewFormatter(cfg.Format, cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer
+	switch cfg.Output {
+	case "", "stdout":
+		out = os.Stdout
+	case "file":
+		out, err = accesslog.NewRotatingFile(cfg.File.Path, int64(cfg.File.MaxSizeMB)<<20, cfg.File.MaxBackups)
+	case "syslog":
+		out, err = accesslog.NewSyslogWriter(cfg.Syslog.Network, cfg.Syslog.Address, cfg.Syslog.Tag)
+	default:
+		err = fmt.Errorf("unknown access log output: %s", cfg.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return accesslog.NewLogger(formatter, out, cfg.Sampling), nil
+}
+
+func setupTracing(cfg config.TracingConfig) (*sdktrace.TracerProvider, propagation.TextMapPropagator, error) {
+	propagator, err := tracing.NewPropagator(cfg.Propagators)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tp, err := tracing.NewTracerProvider(context.Background(), tracing.Options{
+		ServiceName:   cfg.ServiceName,
+		Exporter:      cfg.Exporter,
+		Endpoint:      cfg.Endpoint,
+		Insecure:      cfg.Insecure,
+		Headers:       cfg.Headers,
+		SamplingRatio: cfg.SamplingRatio,
+		IgnoreParent:  cfg.IgnoreParent,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tp, propagator, nil
+}
+
 func logLevelFromString(level string) zapcore.Level {
 	switch level {
 	case "debug":
@@ -140,28 +255,22 @@ func logLevelFromString(level string) zapcore.Level {
 	}
 }
 
-func initializeServers(urls []string) ([]*domain.Server, error) {
-	servers := make([]*domain.Server, len(urls))
-	for i, urlStr := range urls {
-		u, err := url.Parse(urlStr)
+func initializeServers(backends []config.BackendConfig) ([]*domain.Server, error) {
+	servers := make([]*domain.Server, len(backends))
+	for i, b := range backends {
+		server, err := domain.NewServer(b.URL)
 		if err != nil {
-			return nil, fmt.Errorf("invalid server URL %s: %w", urlStr, err)
+			return nil, fmt.Errorf("invalid server URL %s: %w", b.URL, err)
 		}
-		servers[i] = &domain.Server{URL: u, Active: atomic.Bool{}}
-		servers[i].Active.Store(true)
+		if b.HealthCheckPath != "" {
+			server.HealthCheckPath = b.HealthCheckPath
+		}
+		server.Weight = b.Weight
+		server.Zone = b.Zone
+		server.Priority = b.Priority
+		server.MaxConnections = b.MaxConnections
+		server.Tags = b.Tags
+		servers[i] = server
 	}
 	return servers, nil
 }
-
-func initializeLoadBalancer(algorithm string, servers []*domain.Server) (domain.LoadBalancer, error) {
-	switch algorithm {
-	case "round-robin":
-		return loadbalancers.NewRoundRobin(servers), nil
-	case "least-connections":
-		return loadbalancers.NewLeastConnections(servers), nil
-	case "weighted-response-time":
-		return loadbalancers.NewWeightedResponseTime(servers), nil
-	default:
-		return nil, fmt.Errorf("unknown algorithm: %s", algorithm)
-	}
-}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/upstream"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// poolManager owns the backend pools built from the configuration. apply
+// reconciles the running pools with a new configuration in place, so servers
+// that stay in a pool keep their state and in-flight connections.
+type poolManager struct {
+	ctx     context.Context
+	logger  *zap.Logger
+	metrics *metrics.Metrics
+
+	mu      sync.Mutex
+	pools   map[string]*pool
+	handler *interfaces.HTTPHandler
+	routes  []config.RouteConfig
+	headers config.ClientCertHeaders
+}
+
+type pool struct {
+	useCase         *usecases.LoadBalancerUseCase
+	transport       *upstream.Transport
+	algorithm       string
+	interval        time.Duration
+	concurrency     *config.ConcurrencyConfig
+	discovery       *config.DiscoveryConfig
+	stopHealthCheck context.CancelFunc
+	stopDiscovery   context.CancelFunc
+}
+
+// poolPlan is a validated pool configuration with its candidate servers and
+// algorithm. Building plans never touches the running pools.
+type poolPlan struct {
+	cfg            config.PoolConfig
+	servers        []*domain.Server
+	lb             domain.LoadBalancer
+	transport      *upstream.Transport
+	limiter        *concurrency.Limiter
+	provider       discovery.Provider
+	circuitBreaker bool
+}
+
+func newPoolManager(ctx context.Context, logger *zap.Logger, m *metrics.Metrics) *poolManager {
+	return &poolManager{
+		ctx:     ctx,
+		logger:  logger,
+		metrics: m,
+		pools:   make(map[string]*pool),
+	}
+}
+
+// apply builds all pools of cfg and, only if that succeeds, reconciles the
+// running pools and routes with it. cfg must have been validated.
+func (pm *poolManager) apply(cfg *config.Config) error {
+	plans, err := planPools(cfg, pm.metrics)
+	if err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for name, p := range pm.pools {
+		if _, ok := plans[name]; !ok {
+			p.stopHealthCheck()
+			p.stopDiscovery()
+			p.transport.CloseIdleConnections()
+			delete(pm.pools, name)
+			pm.metrics.RemovePool(name)
+			pm.logger.Info("Removed pool", zap.String("pool", name))
+		}
+	}
+
+	for name, plan := range plans {
+		if p, ok := pm.pools[name]; ok {
+			pm.updatePool(p, plan)
+			continue
+		}
+		pm.pools[name] = pm.newPool(plan)
+		pm.logger.Info("Added pool", zap.String("pool", name), zap.Int("servers", len(plan.servers)))
+	}
+
+	pm.routes = cfg.Routes
+	pm.headers = cfg.TLS.ClientAuth.Headers
+	pm.applyRoutes()
+	return nil
+}
+
+// attach makes h route requests to the managed pools, now and after every
+// subsequent apply.
+func (pm *poolManager) attach(h *interfaces.HTTPHandler) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.handler = h
+	pm.applyRoutes()
+}
+
+func (pm *poolManager) defaultPool() *usecases.LoadBalancerUseCase {
+	return pm.pool(config.DefaultPoolName)
+}
+
+func (pm *poolManager) pool(name string) *usecases.LoadBalancerUseCase {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if p, ok := pm.pools[name]; ok {
+		return p.useCase
+	}
+	return nil
+}
+
+func (pm *poolManager) stop() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, p := range pm.pools {
+		p.stopHealthCheck()
+		p.stopDiscovery()
+	}
+}
+
+func (pm *poolManager) applyRoutes() {
+	if pm.handler == nil {
+		return
+	}
+	routes := make([]interfaces.Route, 0, len(pm.routes))
+	for _, rc := range pm.routes {
+		route := interfaces.Route{
+			Name:       rc.Name,
+			Host:       rc.Host,
+			PathPrefix: rc.PathPrefix,
+			Pool:       pm.pools[rc.Pool].useCase,
+		}
+		if p, ok := concurrency.ParsePriority(rc.Priority); ok {
+			route.Priority = p
+		}
+		if rc.ClientAuth != nil {
+			route.ClientAuth = &certs.Allowlist{SANs: rc.ClientAuth.AllowedSANs, CommonNames: rc.ClientAuth.AllowedCommonNames}
+		}
+		routes = append(routes, route)
+	}
+	pm.handler.SetRoutes(routes, pm.pools[config.DefaultPoolName].useCase)
+	pm.handler.SetClientCertHeaders(interfaces.ClientCertHeaders(pm.headers))
+}
+
+func (pm *poolManager) newPool(plan *poolPlan) *pool {
+	var cb *circuitbreaker.CircuitBreaker
+	if plan.circuitBreaker {
+		cb = circuitbreaker.NewCircuitBreaker(5, 10*time.Second)
+	}
+	useCase := usecases.NewLoadBalancerUseCase(plan.lb, cb,
+		usecases.WithName(plan.cfg.Name),
+		usecases.WithMetrics(pm.metrics),
+		usecases.WithMaxRetries(*plan.cfg.MaxRetries),
+		usecases.WithProxyProtocol(plan.cfg.ProxyProtocolVersion()),
+		usecases.WithConcurrencyLimiter(plan.limiter),
+		usecases.WithQueue(queueLimits(plan.cfg.Queue)),
+	)
+	connect(plan.servers, plan.transport)
+	p := &pool{useCase: useCase, transport: plan.transport, algorithm: plan.cfg.Algorithm, concurrency: plan.cfg.Concurrency}
+	pm.startHealthCheck(p, plan.cfg.HealthCheckInterval)
+	pm.startDiscovery(p, plan)
+	return p
+}
+
+func (pm *poolManager) updatePool(p *pool, plan *poolPlan) {
+	name := plan.cfg.Name
+	if err := p.transport.Update(upstreamTLSOptions(plan.cfg.UpstreamTLS)); err != nil {
+		// The files were read successfully while planning.
+		pm.logger.Error("Failed to update upstream TLS", zap.String("pool", name), zap.Error(err))
+	}
+
+	discoveryChanged := !reflect.DeepEqual(p.discovery, plan.cfg.Discovery)
+	if discoveryChanged {
+		p.stopDiscovery()
+	}
+	if plan.provider == nil {
+		connect(plan.servers, p.transport)
+		pm.syncServers(p, plan.servers)
+	}
+
+	if p.algorithm != plan.cfg.Algorithm {
+		lb, err := loadbalancers.New(plan.cfg.Algorithm, p.useCase.GetServers())
+		if err != nil {
+			// Unreachable: the algorithm was validated while planning.
+			pm.logger.Error("Failed to switch algorithm", zap.String("pool", name), zap.Error(err))
+		} else {
+			p.useCase.SetLoadBalancer(lb)
+			p.algorithm = plan.cfg.Algorithm
+			pm.logger.Info("Switched algorithm", zap.String("pool", name), zap.String("algorithm", p.algorithm))
+		}
+	}
+	if discoveryChanged {
+		pm.startDiscovery(p, plan)
+	}
+
+	p.useCase.SetMaxRetries(*plan.cfg.MaxRetries)
+	p.useCase.SetProxyProtocol(plan.cfg.ProxyProtocolVersion())
+	p.useCase.SetQueue(queueLimits(plan.cfg.Queue))
+	if !reflect.DeepEqual(p.concurrency, plan.cfg.Concurrency) {
+		// The new limiter starts over from its initial limit.
+		p.useCase.SetConcurrencyLimiter(plan.limiter)
+		p.concurrency = plan.cfg.Concurrency
+		pm.logger.Info("Replaced concurrency limiter", zap.String("pool", name))
+	}
+	if p.interval != plan.cfg.HealthCheckInterval {
+		p.stopHealthCheck()
+		pm.startHealthCheck(p, plan.cfg.HealthCheckInterval)
+	}
+}
+
+// connect makes servers reachable through the transport of their pool. The
+// health checks of tcp:// servers dial like it, so that they send the PROXY
+// protocol header the pool requests for them.
+func connect(servers []*domain.Server, transport *upstream.Transport) {
+	for _, s := range servers {
+		s.Transport = transport
+		s.DialContext = proxyprotocol.DialContext
+	}
+}
+
+// syncServers reconciles the servers of p with servers and logs the
+// difference.
+func (pm *poolManager) syncServers(p *pool, servers []*domain.Server) {
+	added, removed := p.useCase.SyncServers(servers)
+	for _, u := range removed {
+		pm.logger.Info("Removed server", zap.String("pool", p.useCase.Name()), zap.String("server", u))
+	}
+	for _, u := range added {
+		pm.logger.Info("Added server", zap.String("pool", p.useCase.Name()), zap.String("server", u))
+	}
+}
+
+func (pm *poolManager) startHealthCheck(p *pool, interval time.Duration) {
+	ctx, cancel := context.WithCancel(pm.ctx)
+	p.interval = interval
+	p.stopHealthCheck = cancel
+	go p.useCase.StartHealthCheck(ctx, interval)
+}
+
+func planPools(cfg *config.Config, m *metrics.Metrics) (map[string]*poolPlan, error) {
+	plans := make(map[string]*poolPlan)
+	for _, pc := range cfg.PoolConfigs() {
+		servers, err := initializeServers(pc.Backends)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+		}
+		lb, err := loadbalancers.New(pc.Algorithm, servers)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+		}
+		transport, err := upstream.NewTransport(upstreamTLSOptions(pc.UpstreamTLS))
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: upstream TLS: %w", pc.Name, err)
+		}
+		provider, err := newDiscoveryProvider(pc.Discovery)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: discovery: %w", pc.Name, err)
+		}
+		var limiter *concurrency.Limiter
+		if pc.Concurrency != nil {
+			limiter, err = concurrency.New(concurrency.Options(*pc.Concurrency), concurrency.WithMetrics(m, pc.Name))
+			if err != nil {
+				return nil, fmt.Errorf("pool %q: concurrency: %w", pc.Name, err)
+			}
+		}
+		plans[pc.Name] = &poolPlan{
+			cfg:            pc,
+			servers:        servers,
+			lb:             lb,
+			transport:      transport,
+			limiter:        limiter,
+			provider:       provider,
+			circuitBreaker: cfg.FeatureToggles.EnableCircuitBreaker,
+		}
+	}
+	return plans, nil
+}
+
+func queueLimits(cfg *config.QueueConfig) (int, time.Duration) {
+	if cfg == nil {
+		return 0, 0
+	}
+	return cfg.Size, cfg.Timeout
+}
+
+func upstreamTLSOptions(cfg *config.UpstreamTLSConfig) upstream.TLSOptions {
+	if cfg == nil {
+		return upstream.TLSOptions{}
+	}
+	return upstream.TLSOptions(*cfg)
+}
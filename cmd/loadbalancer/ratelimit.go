@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+// newRateLimitStore returns the store selected by cfg and a function that
+// closes it.
+func newRateLimitStore(cfg config.RateLimitingConfig, m *metrics.Metrics) (ratelimit.Store, func() error, error) {
+	local := ratelimit.NewMemoryStore(cfg.MaxEntries)
+	if cfg.Store != "redis" {
+		return local, func() error { return nil }, nil
+	}
+	r := cfg.Redis
+	store, err := ratelimit.NewRedisStore(ratelimit.RedisOptions{
+		Addr:          r.Address,
+		Username:      r.Username,
+		Password:      r.Password,
+		DB:            r.DB,
+		PoolSize:      r.PoolSize,
+		Timeout:       r.Timeout,
+		KeyPrefix:     r.KeyPrefix,
+		OnError:       r.OnError,
+		RetryInterval: r.RetryInterval,
+	}, ratelimit.WithFallback(local), ratelimit.WithMetrics(m))
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, store.Close, nil
+}
+
+// applyRateLimits sets the policies and rejection of cfg on rl, or no
+// policies if rate limiting is disabled.
+func applyRateLimits(rl *middleware.RateLimiter, cfg *config.Config) error {
+	if !cfg.FeatureToggles.EnableRateLimiting {
+		return rl.SetPolicies(nil, nil)
+	}
+	rejection, err := ratelimit.NewRejection(cfg.RateLimiting.Rejection.Format, cfg.RateLimiting.Rejection.Template)
+	if err != nil {
+		return err
+	}
+	var global *middleware.RateLimitPolicy
+	if g := cfg.RateLimiting.Global; g != nil {
+		p := rateLimitPolicy(*g)
+		global = &p
+	}
+	policies := make(map[string]middleware.RateLimitPolicy)
+	for _, p := range cfg.RateLimiting.Policies {
+		policies[p.Name] = rateLimitPolicy(p)
+	}
+	routes := make(map[string]middleware.RateLimitPolicy)
+	for _, r := range cfg.Routes {
+		if r.RateLimit != "" {
+			routes[r.Name] = policies[r.RateLimit]
+		}
+	}
+	if err := rl.SetPolicies(global, routes); err != nil {
+		return err
+	}
+	rl.SetRejection(rejection)
+	return nil
+}
+
+func rateLimitPolicy(p config.RateLimitPolicyConfig) middleware.RateLimitPolicy {
+	policy := middleware.RateLimitPolicy{
+		Name:   p.Name,
+		Rate:   p.Rate,
+		Burst:  p.Burst,
+		Key:    p.Key,
+		Header: p.Header,
+		Claim:  p.Claim,
+	}
+	if len(p.Overrides) > 0 {
+		policy.Overrides = make(map[string]middleware.RateLimit)
+		for _, o := range p.Overrides {
+			policy.Overrides[o.Key] = middleware.RateLimit{Rate: o.Rate, Burst: o.Burst}
+		}
+	}
+	return policy
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"go.uber.org/zap"
+)
+
+const defaultReloadDebounce = 500 * time.Millisecond
+
+// reloader re-reads the configuration file, with the same environment and
+// flag overrides, on SIGHUP and, if enabled, when
+// the file changes. A configuration that fails to load, validate or apply is
+// logged and the running configuration is kept.
+type reloader struct {
+	configFile  string
+	overrides   *config.FlagOverrides
+	logger      *zap.Logger
+	pools       *poolManager
+	rateLimiter *middleware.RateLimiter
+	frontend    *frontend
+	l4          *l4Listeners
+	current     *config.Config
+}
+
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var fileChanged <-chan struct{}
+	if r.current.Reload.WatchConfig {
+		changes, err := watchFiles(ctx, []string{r.configFile}, r.debounce(), r.logger)
+		if err != nil {
+			r.logger.Error("Failed to watch configuration file", zap.Error(err))
+		} else {
+			fileChanged = changes
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Info("Received SIGHUP, reloading configuration")
+			r.reload()
+		case <-fileChanged:
+			r.logger.Info("Configuration file changed, reloading configuration")
+			r.reload()
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	cfg, err := config.LoadLayered(r.configFile, os.Environ(), r.overrides)
+	if err != nil {
+		r.logger.Error("Configuration reload failed, keeping current configuration", zap.Error(err))
+		return
+	}
+	if err := r.apply(cfg); err != nil {
+		r.logger.Error("Configuration reload failed, keeping current configuration", zap.Error(err))
+		return
+	}
+	r.warnRestartRequired(cfg)
+	r.current = cfg
+	r.logger.Info("Configuration reloaded")
+}
+
+// apply applies cfg to every component. If one fails, all of them are
+// returned to the current configuration: the failed one may have been
+// applied in part, and the others may hold pools that cfg replaced.
+func (r *reloader) apply(cfg *config.Config) error {
+	steps := []func(*config.Config) error{
+		r.pools.apply,
+		func(cfg *config.Config) error { return applyRateLimits(r.rateLimiter, cfg) },
+		r.frontend.serve,
+		r.l4.apply,
+	}
+	for _, step := range steps {
+		if err := step(cfg); err != nil {
+			for _, restore := range steps {
+				if err := restore(r.current); err != nil {
+					r.logger.Error("Failed to restore the current configuration", zap.Error(err))
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// warnRestartRequired logs the changed sections that only take effect after a
+// restart.
+func (r *reloader) warnRestartRequired(cfg *config.Config) {
+	sections := map[string][2]interface{}{
+		"server.listen_addr":        {r.current.Server.ListenAddr, cfg.Server.ListenAddr},
+		"server.proxy_protocol":     {r.current.Server.ProxyProtocol, cfg.Server.ProxyProtocol},
+		"tls.acme.http_listen_addr": {r.current.TLS.ACME.HTTPListenAddr, cfg.TLS.ACME.HTTPListenAddr},
+		"rate_limiting.max_entries": {r.current.RateLimiting.MaxEntries, cfg.RateLimiting.MaxEntries},
+		"rate_limiting.store":       {r.current.RateLimiting.Store, cfg.RateLimiting.Store},
+		"rate_limiting.redis":       {r.current.RateLimiting.Redis, cfg.RateLimiting.Redis},
+		"logging":                   {r.current.Logging, cfg.Logging},
+		"access_log":                {r.current.AccessLog, cfg.AccessLog},
+		"tracing":                   {r.current.Tracing, cfg.Tracing},
+		"metrics":                   {r.current.Metrics, cfg.Metrics},
+		"reload":                    {r.current.Reload, cfg.Reload},
+	}
+	for name, values := range sections {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			r.logger.Warn("Configuration change requires a restart", zap.String("section", name))
+		}
+	}
+}
+
+func (r *reloader) debounce() time.Duration {
+	if r.current.Reload.Debounce > 0 {
+		return r.current.Reload.Debounce
+	}
+	return defaultReloadDebounce
+}
+
+// watchFiles signals on the returned channel when one of paths is written,
+// created or replaced. The parent directories are watched so that editors and
+// config management tools that replace a file by renaming are detected, and
+// bursts of events are coalesced into one signal after the debounce period.
+func watchFiles(ctx context.Context, paths []string, debounce time.Duration, logger *zap.Logger) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		watched[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !watched[filepath.Clean(event.Name)] || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(debounce)
+				} else {
+					timer.Reset(debounce)
+				}
+				fire = timer.C
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("File watcher error", zap.Error(err))
+			case <-fire:
+				fire = nil
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
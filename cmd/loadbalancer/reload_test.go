@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"go.uber.org/zap"
+)
+
+const reloadTestConfig = `
+server:
+  listen_addr: "127.0.0.1:0"
+backend_servers: ["http://127.0.0.1:1"]
+pools:
+%s
+listeners:
+%s
+`
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestReloadKeepsConfigWhenListenerFailsToBind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(pools, listeners string) {
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(reloadTestConfig, pools, listeners)), 0o644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	listenerA := freeAddr(t)
+	write(`  - {name: tcp, backends: ["tcp://127.0.0.1:1"]}`, fmt.Sprintf(`  - {name: a, protocol: tcp, listen_addr: %q, pool: tcp}`, listenerA))
+	cfg, err := config.LoadLayered(path, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zap.NewNop()
+	pools := newPoolManager(ctx, logger, nil)
+	if err := pools.apply(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer pools.stop()
+	tlsManager, err := newTLSManager(ctx, logger, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fe, err := newFrontend(cfg.Server, http.NotFoundHandler(), tlsManager, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fe.shutdown(context.Background())
+	if err := fe.serve(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l4 := newL4Listeners(logger, nil, pools)
+	if err := l4.apply(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l4.shutdown(context.Background())
+	r := &reloader{configFile: path, logger: logger, pools: pools, rateLimiter: middleware.NewRateLimiter(), frontend: fe, l4: l4, current: cfg}
+
+	// The new pool is applied before listener b fails to bind its address.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer taken.Close()
+	write(`  - {name: tcp, backends: ["tcp://127.0.0.1:1"]}
+  - {name: extra, backends: ["tcp://127.0.0.1:2"]}`, fmt.Sprintf(`  - {name: a, protocol: tcp, listen_addr: %q, pool: extra}
+  - {name: b, protocol: tcp, listen_addr: %q, pool: extra}`, listenerA, taken.Addr()))
+	r.reload()
+
+	if r.current != cfg {
+		t.Error("Expected the current configuration to be kept")
+	}
+	if pools.pool("extra") != nil {
+		t.Error("Expected the pool of the failed configuration to be removed")
+	}
+	l4.mu.Lock()
+	a, b := l4.running["a"], l4.running["b"]
+	l4.mu.Unlock()
+	if b != nil {
+		t.Error("Expected listener b not to run")
+	}
+	if a == nil || a.cfg.Pool != "tcp" {
+		t.Fatal("Expected listener a to keep its pool")
+	}
+	conn, err := net.DialTimeout("tcp", listenerA, time.Second)
+	if err != nil {
+		t.Fatalf("Expected listener a to accept connections: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// certWatchDebounce gives tools that write a certificate and its key as two
+// files time to finish both before they are reloaded.
+const certWatchDebounce = time.Second
+
+// tlsManager holds the TLS settings and certificates of the frontend. The
+// http.Server only sees a config that looks up the current settings on every
+// handshake, so certificates and settings change without restarting it.
+type tlsManager struct {
+	ctx     context.Context
+	logger  *zap.Logger
+	store   *certs.Store
+	tickets *certs.TicketKeys
+	current atomic.Pointer[tls.Config]
+	acme    atomic.Pointer[certs.ACME]
+
+	mu         sync.Mutex
+	cfg        config.TLSConfig
+	acmeOpts   certs.ACMEOptions
+	rotation   time.Duration
+	stopRotate context.CancelFunc
+	watched    []string
+	stopWatch  context.CancelFunc
+}
+
+func newTLSManager(ctx context.Context, logger *zap.Logger, m *metrics.Metrics) (*tlsManager, error) {
+	tickets, err := certs.NewTicketKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsManager{
+		ctx:     ctx,
+		logger:  logger,
+		store:   certs.NewStore(certs.WithMetrics(m)),
+		tickets: tickets,
+	}, nil
+}
+
+// apply loads the certificates and settings of cfg, which has been
+// validated. If the certificates fail to load, nothing is changed.
+func (t *tlsManager) apply(cfg config.TLSConfig) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	issuer, opts, err := t.acmeIssuer(cfg.ACME)
+	if err != nil {
+		return err
+	}
+	obtain := issuer != nil && issuer != t.acme.Load()
+	if err := t.load(cfg); err != nil {
+		if obtain {
+			issuer.Stop()
+		}
+		return err
+	}
+	t.acmeOpts = opts
+	t.cfg = cfg
+	if current := t.acme.Swap(issuer); current != nil && current != issuer {
+		current.Stop()
+	}
+	if obtain {
+		go func() {
+			if err := issuer.Obtain(); err != nil {
+				t.logger.Error("Failed to obtain ACME certificates, retrying on handshakes", zap.Error(err))
+				return
+			}
+			t.logger.Info("ACME certificates ready", zap.Strings("domains", cfg.ACME.Domains))
+		}()
+	}
+
+	if cfg.SessionTicketRotation != t.rotation {
+		t.stopRotation()
+		if cfg.SessionTicketRotation > 0 {
+			ctx, cancel := context.WithCancel(t.ctx)
+			t.stopRotate = cancel
+			go func() {
+				if err := t.tickets.Run(ctx, cfg.SessionTicketRotation); err != nil {
+					t.logger.Error("Session ticket key rotation failed", zap.Error(err))
+				}
+			}()
+		}
+		t.rotation = cfg.SessionTicketRotation
+	}
+
+	var files []string
+	if cfg.WatchCertificates {
+		files = t.store.Files()
+		if cfg.ClientAuth.Mode != "none" {
+			files = append(files, cfg.ClientAuth.CAFile)
+		}
+	}
+	if !slices.Equal(files, t.watched) {
+		t.stopWatching()
+		if len(files) > 0 {
+			t.watch(files)
+		}
+	}
+	return nil
+}
+
+// acmeIssuer returns the ACME issuer for cfg and its options. The current
+// one is kept while its options are unchanged, so certificates are not
+// requested again. A new one must be stopped if it is not used.
+func (t *tlsManager) acmeIssuer(cfg config.ACMEConfig) (*certs.ACME, certs.ACMEOptions, error) {
+	if !cfg.Enabled {
+		return nil, certs.ACMEOptions{}, nil
+	}
+	opts := certs.ACMEOptions{
+		DirectoryURL: cfg.DirectoryURL,
+		CAFile:       cfg.CAFile,
+		Email:        cfg.Email,
+		Domains:      cfg.Domains,
+		CacheDir:     cfg.CacheDir,
+		RenewBefore:  cfg.RenewBefore,
+	}
+	if current := t.acme.Load(); current != nil && reflect.DeepEqual(opts, t.acmeOpts) {
+		return current, opts, nil
+	}
+	issuer, err := certs.NewACME(opts)
+	return issuer, opts, err
+}
+
+// getCertificate serves ACME certificates for their domains and the static
+// certificates for all other names. Without static certificates, ACME
+// certificates are served for every name.
+func (t *tlsManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if issuer := t.acme.Load(); issuer != nil && (issuer.Handles(hello) || len(t.store.Files()) == 0) {
+		return issuer.GetCertificate(hello)
+	}
+	return t.store.GetCertificate(hello)
+}
+
+// acmeChallenges answers ACME HTTP-01 challenges while ACME is enabled and
+// passes all other requests to next.
+func (t *tlsManager) acmeChallenges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if issuer := t.acme.Load(); issuer != nil {
+			issuer.HTTPHandler(next).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// load reads the certificates and client CA bundle of cfg and switches new
+// handshakes to them.
+func (t *tlsManager) load(cfg config.TLSConfig) error {
+	var pairs []certs.Pair
+	for _, c := range cfg.AllCertificates() {
+		pairs = append(pairs, certs.Pair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	clientAuth, clientCAs := tls.NoClientCert, (*x509.CertPool)(nil)
+	if cfg.ClientAuth.Mode != "none" {
+		pool, err := certs.LoadCAPool(cfg.ClientAuth.CAFile)
+		if err != nil {
+			return err
+		}
+		clientAuth, clientCAs = tls.VerifyClientCertIfGiven, pool
+		if cfg.ClientAuth.Mode == "require" {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if err := t.store.Load(pairs); err != nil {
+		return err
+	}
+
+	version, _ := certs.ParseVersion(cfg.MinVersion)
+	suites, _ := certs.ParseCipherSuites(cfg.CipherSuites)
+	allowlist := certs.Allowlist{SANs: cfg.ClientAuth.AllowedSANs, CommonNames: cfg.ClientAuth.AllowedCommonNames}
+	protos := cfg.ALPN
+	if cfg.ACME.Enabled {
+		protos = append(slices.Clip(protos), certs.ALPNProto)
+	}
+	c := &tls.Config{
+		GetCertificate:         t.getCertificate,
+		MinVersion:             version,
+		CipherSuites:           suites,
+		NextProtos:             protos,
+		SessionTicketsDisabled: cfg.SessionTicketRotation == 0,
+		ClientAuth:             clientAuth,
+		ClientCAs:              clientCAs,
+	}
+	if !allowlist.Empty() {
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return allowlist.Check(cs.PeerCertificates[0])
+		}
+	}
+	t.tickets.Apply(c)
+	if old := t.current.Swap(c); old != nil {
+		t.tickets.Release(old)
+	}
+	return nil
+}
+
+// serverConfig returns the config for http.Server.TLSConfig. TLS-ALPN-01
+// validations get a config of their own, as the CA has no client
+// certificate and may not support the configured versions and suites.
+func (t *tlsManager) serverConfig() *tls.Config {
+	challenge := &tls.Config{GetCertificate: t.getCertificate, NextProtos: []string{certs.ALPNProto}}
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if t.acme.Load() != nil && certs.IsALPNChallenge(hello) {
+				return challenge, nil
+			}
+			return t.current.Load(), nil
+		},
+	}
+}
+
+// stop ends key rotation, certificate watching and serving ACME
+// certificates.
+func (t *tlsManager) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if issuer := t.acme.Swap(nil); issuer != nil {
+		issuer.Stop()
+	}
+	t.stopRotation()
+	t.rotation = 0
+	t.stopWatching()
+}
+
+func (t *tlsManager) watch(files []string) {
+	ctx, cancel := context.WithCancel(t.ctx)
+	changes, err := watchFiles(ctx, files, certWatchDebounce, t.logger)
+	if err != nil {
+		cancel()
+		t.logger.Error("Failed to watch certificate files", zap.Error(err))
+		return
+	}
+	t.watched, t.stopWatch = files, cancel
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+				t.mu.Lock()
+				err := t.load(t.cfg)
+				t.mu.Unlock()
+				if err != nil {
+					t.logger.Error("Certificate reload failed, keeping current certificates", zap.Error(err))
+					continue
+				}
+				t.logger.Info("Certificates reloaded")
+			}
+		}
+	}()
+}
+
+func (t *tlsManager) stopRotation() {
+	if t.stopRotate != nil {
+		t.stopRotate()
+		t.stopRotate = nil
+	}
+}
+
+func (t *tlsManager) stopWatching() {
+	if t.stopWatch != nil {
+		t.stopWatch()
+		t.stopWatch = nil
+	}
+	t.watched = nil
+}
+
+// serveChallenges answers ACME HTTP-01 challenges on addr, which is usually
+// :80 as that is where CAs connect. All other requests are redirected to
+// HTTPS on the port of the frontend listener.
+func (t *tlsManager) serveChallenges(addr, frontendAddr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(frontendAddr)
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	srv := &http.Server{Handler: t.acmeChallenges(redirect), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			t.logger.Error("ACME challenge server failed", zap.Error(err))
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+)
+
+// runValidate implements "loadbalancer validate -config file". It exits with
+// status 1 if the file is invalid, so it can gate deployments in CI.
+// Environment and flag overrides are applied as they would be at startup.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config", "config/config.yaml", "Path to configuration file")
+	overrides := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if _, err := config.LoadLayered(*configFile, os.Environ(), overrides); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", *configFile)
+	return 0
+}
+
+// runConfig implements "loadbalancer config print", which shows the
+// effective configuration and where each value came from.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: loadbalancer config print [-config file] [overrides]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	configFile := fs.String("config", "config/config.yaml", "Path to configuration file")
+	overrides := config.RegisterFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := config.LoadLayered(*configFile, os.Environ(), overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.Print(os.Stdout)
+	return 0
+}
@@ -1,39 +1,344 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
-	"os"
+	"gopkg.in/yaml.v3"
 )
 
+const DefaultPoolName = "default"
+
 type Config struct {
-	Server struct {
-		ListenAddr   string        `yaml:"listen_addr"`
-		ReadTimeout  time.Duration `yaml:"read_timeout"`
-		WriteTimeout time.Duration `yaml:"write_timeout"`
-		IdleTimeout  time.Duration `yaml:"idle_timeout"`
-	} `yaml:"server"`
-
-	LoadBalancer struct {
-		Algorithm           string        `yaml:"algorithm"`
-		HealthCheckInterval time.Duration `yaml:"health_check_interval"`
-	} `yaml:"load_balancer"`
-
-	BackendServers []string `yaml:"backend_servers"`
-
-	TLS struct {
-		Enabled  bool   `yaml:"enabled"`
-		CertFile string `yaml:"cert_file"`
-		KeyFile  string `yaml:"key_file"`
-	} `yaml:"tls"`
+	Server ServerConfig `yaml:"server"`
+
+	LoadBalancer LoadBalancerConfig `yaml:"load_balancer"`
+
+	BackendServers []BackendConfig `yaml:"backend_servers"`
+
+	Pools  []PoolConfig  `yaml:"pools"`
+	Routes []RouteConfig `yaml:"routes"`
+
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	Reload ReloadConfig `yaml:"reload"`
+
+	TLS TLSConfig `yaml:"tls"`
 
 	Logging LoggingConfig `yaml:"logging"`
 
-	Metrics struct {
-		Enabled bool `yaml:"enabled"`
-		Port    int  `yaml:"port"`
-	} `yaml:"metrics"`
+	AccessLog AccessLogConfig `yaml:"access_log"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	RateLimiting RateLimitingConfig `yaml:"rate_limiting"`
+
+	FeatureToggles FeatureTogglesConfig `yaml:"feature_toggles"`
+
+	// file and root record where the configuration was read from, so that
+	// validation errors can point at the offending line. sources maps field
+	// paths to the layer that set them; see Source.
+	file    string
+	root    *yaml.Node
+	sources map[string]string
+}
+
+type ServerConfig struct {
+	ListenAddr   string        `yaml:"listen_addr"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+}
+
+// ProxyProtocolConfig accepts PROXY protocol v1 and v2 headers on a listener
+// from the IP addresses and CIDR ranges in TrustedSources.
+type ProxyProtocolConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedSources []string `yaml:"trusted_sources"`
+}
+
+type LoadBalancerConfig struct {
+	Algorithm           string        `yaml:"algorithm"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	MaxRetries          int           `yaml:"max_retries"`
+
+	UpstreamTLS *UpstreamTLSConfig `yaml:"upstream_tls"`
+	Concurrency *ConcurrencyConfig `yaml:"concurrency"`
+	Queue       *QueueConfig       `yaml:"queue"`
+}
+
+// UpstreamTLSConfig configures TLS to https:// backends. CAFile replaces the
+// system roots, CertFile and KeyFile are a client certificate for backends
+// that require one, and ServerName overrides the name sent in SNI and
+// verified against backend certificates, which defaults to the backend host.
+type UpstreamTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// ConcurrencyConfig limits the HTTP requests in flight to a pool to a limit
+// that adapts to backend latency with the gradient (the default) or aimd
+// algorithm, between MinLimit (1) and MaxLimit (1000) starting from
+// InitialLimit (20). Up to QueueSize requests over the limit wait for at most
+// QueueTimeout (1s), newest first; others get a 503. The aimd algorithm backs
+// off when requests are slower than LatencyThreshold (1s). PriorityHeader
+// names a header whose value, critical, normal or sheddable, overrides the
+// priority of the route: the queue serves higher priorities first and a full
+// queue sheds lower ones.
+type ConcurrencyConfig struct {
+	Algorithm        string        `yaml:"algorithm"`
+	InitialLimit     int           `yaml:"initial_limit"`
+	MinLimit         int           `yaml:"min_limit"`
+	MaxLimit         int           `yaml:"max_limit"`
+	QueueSize        int           `yaml:"queue_size"`
+	QueueTimeout     time.Duration `yaml:"queue_timeout"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+	PriorityHeader   string        `yaml:"priority_header"`
+}
+
+// QueueConfig lets up to Size requests wait up to Timeout for a backend when
+// every backend that is up is at its max_connections.
+type QueueConfig struct {
+	Size    int           `yaml:"size"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DiscoveryConfig makes a pool find its backends at runtime with Provider.
+type DiscoveryConfig struct {
+	// Provider is "file", "dns", "consul" or "kubernetes".
+	Provider   string                    `yaml:"provider"`
+	File       FileDiscoveryConfig       `yaml:"file"`
+	DNS        DNSDiscoveryConfig        `yaml:"dns"`
+	Consul     ConsulDiscoveryConfig     `yaml:"consul"`
+	Kubernetes KubernetesDiscoveryConfig `yaml:"kubernetes"`
+}
+
+// FileDiscoveryConfig reads backends from a file of Prometheus file_sd target
+// groups, again when it changes (after Debounce, 500ms by default) and every
+// RefreshInterval (5m).
+type FileDiscoveryConfig struct {
+	Path            string        `yaml:"path"`
+	Debounce        time.Duration `yaml:"debounce"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// DNSDiscoveryConfig resolves backends from the A (the default), AAAA or SRV
+// records of Name, again when their TTL expires but no sooner than
+// MinInterval (1s) and no later than MaxInterval (5m). Port is required for A
+// and AAAA records. Resolver defaults to the first nameserver in
+// /etc/resolv.conf.
+type DNSDiscoveryConfig struct {
+	Name        string        `yaml:"name"`
+	Type        string        `yaml:"type"`
+	Port        int           `yaml:"port"`
+	Scheme      string        `yaml:"scheme"`
+	Resolver    string        `yaml:"resolver"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// ConsulDiscoveryConfig tracks the healthy instances of Service, with Tag if
+// set, through the Consul agent at Address (http://127.0.0.1:8500). The ACL
+// token is read from TokenFile.
+type ConsulDiscoveryConfig struct {
+	Address       string        `yaml:"address"`
+	Service       string        `yaml:"service"`
+	Tag           string        `yaml:"tag"`
+	Datacenter    string        `yaml:"datacenter"`
+	TokenFile     string        `yaml:"token_file"`
+	Scheme        string        `yaml:"scheme"`
+	WaitTime      time.Duration `yaml:"wait_time"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// KubernetesDiscoveryConfig watches the EndpointSlices of Service in
+// Namespace and uses the port named Port, by default the first one. Outside
+// a cluster, APIServer, and TokenFile and CAFile if needed, reach the API
+// server. Zone is the zone of the balancer, to follow topology hints.
+type KubernetesDiscoveryConfig struct {
+	APIServer     string        `yaml:"api_server"`
+	TokenFile     string        `yaml:"token_file"`
+	CAFile        string        `yaml:"ca_file"`
+	Namespace     string        `yaml:"namespace"`
+	Service       string        `yaml:"service"`
+	Port          string        `yaml:"port"`
+	Scheme        string        `yaml:"scheme"`
+	Zone          string        `yaml:"zone"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+type ReloadConfig struct {
+	WatchConfig bool          `yaml:"watch_config"`
+	Debounce    time.Duration `yaml:"debounce"`
+}
+
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Certificates are served alongside CertFile and chosen by the SNI
+	// server name. The first certificate is the default for clients whose
+	// server name matches none.
+	Certificates []CertificateConfig `yaml:"certificates"`
+
+	// WatchCertificates reloads the certificates when their files change.
+	// They are also reloaded on SIGHUP.
+	WatchCertificates bool `yaml:"watch_certificates"`
+
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	ALPN         []string `yaml:"alpn"`
+
+	// SessionTicketRotation is how often a new session ticket key is
+	// generated. Zero disables session tickets.
+	SessionTicketRotation time.Duration `yaml:"session_ticket_rotation"`
+
+	ClientAuth ClientAuthConfig `yaml:"client_auth"`
+
+	ACME ACMEConfig `yaml:"acme"`
+}
+
+// ACMEConfig obtains certificates for Domains from an ACME CA and renews
+// them before they expire. They are served for their domains alongside the
+// static certificates, which become optional. CAFile is trusted for the
+// directory instead of the system roots. HTTP-01 challenges are answered on
+// the listener and, if set, on HTTPListenAddr, which redirects all other
+// requests to HTTPS; TLS-ALPN-01 challenges are answered on the listener.
+type ACMEConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	DirectoryURL   string        `yaml:"directory_url"`
+	CAFile         string        `yaml:"ca_file"`
+	Email          string        `yaml:"email"`
+	Domains        []string      `yaml:"domains"`
+	CacheDir       string        `yaml:"cache_dir"`
+	RenewBefore    time.Duration `yaml:"renew_before"`
+	HTTPListenAddr string        `yaml:"http_listen_addr"`
+}
+
+// ClientAuthConfig verifies client certificates against the CA bundle in
+// CAFile. With Mode "optional", clients may connect without a certificate and
+// routes decide whether they need one; with "require", every client needs
+// one.
+type ClientAuthConfig struct {
+	Mode               string            `yaml:"mode"` // none, optional or require
+	CAFile             string            `yaml:"ca_file"`
+	AllowedSANs        []string          `yaml:"allowed_sans"`
+	AllowedCommonNames []string          `yaml:"allowed_common_names"`
+	Headers            ClientCertHeaders `yaml:"headers"`
+}
+
+// ClientCertHeaders name the request headers that carry the verified client
+// identity to backends. Clients cannot set them themselves; they are removed
+// from every request. An empty name disables the header.
+type ClientCertHeaders struct {
+	Subject     string `yaml:"subject"`
+	SANs        string `yaml:"sans"`
+	Fingerprint string `yaml:"fingerprint"`
+}
+
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// AllCertificates returns CertFile and KeyFile, if set, followed by
+// Certificates.
+func (t TLSConfig) AllCertificates() []CertificateConfig {
+	var all []CertificateConfig
+	if t.CertFile != "" || t.KeyFile != "" {
+		all = append(all, CertificateConfig{CertFile: t.CertFile, KeyFile: t.KeyFile})
+	}
+	return append(all, t.Certificates...)
+}
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// RateLimitingConfig limits request rates when
+// feature_toggles.enable_rate_limiting is set. A route uses the policy it
+// names in rate_limit; requests to other routes use Global, if set.
+// MaxEntries bounds the keys kept in memory; beyond it, the least recently
+// seen keys are forgotten. Store is memory, which limits each instance on its
+// own, or redis, which shares the state of keys between instances.
+// Rejection is the response to rejected requests.
+type RateLimitingConfig struct {
+	Global     *RateLimitPolicyConfig   `yaml:"global"`
+	Policies   []RateLimitPolicyConfig  `yaml:"policies"`
+	MaxEntries int                      `yaml:"max_entries"`
+	Store      string                   `yaml:"store"`
+	Redis      RateLimitRedisConfig     `yaml:"redis"`
+	Rejection  RateLimitRejectionConfig `yaml:"rejection"`
+}
+
+// RateLimitRejectionConfig renders the body of a 429 from a text/template
+// with .Policy, .Route, .Limit, .RetryAfter and .Reset (in seconds). With
+// format json, the body must be valid JSON and {{json .Policy}} encodes a
+// value. An empty template selects a default body for the format.
+type RateLimitRejectionConfig struct {
+	Format   string `yaml:"format"` // text or json
+	Template string `yaml:"template"`
+}
+
+// RateLimitRedisConfig connects to a Redis-protocol server (Redis 5 or
+// later). OnError is what happens while it cannot be reached: local limits
+// each instance on its own with MaxEntries keys, allow admits every request
+// and deny rejects every request. The server is tried again after
+// RetryInterval.
+type RateLimitRedisConfig struct {
+	Address       string        `yaml:"address"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	PoolSize      int           `yaml:"pool_size"`
+	Timeout       time.Duration `yaml:"timeout"`
+	KeyPrefix     string        `yaml:"key_prefix"`
+	OnError       string        `yaml:"on_error"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// RateLimitPolicyConfig lets requests that share a key through at Rate per
+// second with bursts of Burst. Key is ip (the default), header (the value of
+// Header), api_key (Header, X-API-Key by default, or the api_key query
+// parameter), jwt_claim (Claim of the bearer token, which is not verified)
+// or route. Requests without a value for the key are limited by client IP.
+// Overrides set other limits for individual key values.
+type RateLimitPolicyConfig struct {
+	Name      string                    `yaml:"name"`
+	Rate      float64                   `yaml:"rate"`
+	Burst     int                       `yaml:"burst"`
+	Key       string                    `yaml:"key"`
+	Header    string                    `yaml:"header"`
+	Claim     string                    `yaml:"claim"`
+	Overrides []RateLimitOverrideConfig `yaml:"overrides"`
+}
+
+type RateLimitOverrideConfig struct {
+	Key   string  `yaml:"key"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type FeatureTogglesConfig struct {
+	EnableCircuitBreaker bool `yaml:"enable_circuit_breaker"`
+	EnableRateLimiting   bool `yaml:"enable_rate_limiting"`
 }
 
 type LoggingConfig struct {
@@ -41,19 +346,334 @@ type LoggingConfig struct {
 	Format string `yaml:"format"`
 }
 
+// PoolConfig describes a named group of backends. Algorithm, health check
+// interval and retries default to the load_balancer section when unset.
+type PoolConfig struct {
+	Name                string          `yaml:"name"`
+	Algorithm           string          `yaml:"algorithm"`
+	HealthCheckInterval time.Duration   `yaml:"health_check_interval"`
+	MaxRetries          *int            `yaml:"max_retries"`
+	Backends            []BackendConfig `yaml:"backends"`
+
+	// ProxyProtocol is "v1" or "v2" to send PROXY protocol headers to the
+	// backends, or empty.
+	ProxyProtocol string `yaml:"proxy_protocol"`
+
+	UpstreamTLS *UpstreamTLSConfig `yaml:"upstream_tls"`
+	Concurrency *ConcurrencyConfig `yaml:"concurrency"`
+	Queue       *QueueConfig       `yaml:"queue"`
+
+	// Discovery takes the place of Backends.
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+}
+
+// ProxyProtocolVersion returns the PROXY protocol version to send, or 0.
+func (p PoolConfig) ProxyProtocolVersion() int {
+	switch p.ProxyProtocol {
+	case "v1":
+		return 1
+	case "v2":
+		return 2
+	}
+	return 0
+}
+
+// BackendConfig describes one backend server. In YAML it is either a plain
+// URL string or an object with a url key and optional attributes.
+type BackendConfig struct {
+	URL             string            `yaml:"url"`
+	Weight          int               `yaml:"weight"`
+	HealthCheckPath string            `yaml:"health_check_path"`
+	Zone            string            `yaml:"zone"`
+	Priority        int               `yaml:"priority"`
+	MaxConnections  int               `yaml:"max_connections"`
+	Tags            map[string]string `yaml:"tags"`
+}
+
+// backendFields is BackendConfig without its YAML methods.
+type backendFields BackendConfig
+
+func (b *BackendConfig) UnmarshalYAML(node *yaml.Node) error {
+	*b = BackendConfig{Weight: 1}
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&b.URL)
+	}
+	if node.Kind == yaml.MappingNode {
+		// Decode does not inherit KnownFields from the outer decoder.
+		known := make(map[string]bool)
+		t := reflect.TypeOf(backendFields{})
+		for i := 0; i < t.NumField(); i++ {
+			known[strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]] = true
+		}
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; !known[key.Value] {
+				return fmt.Errorf("yaml: unmarshal errors:\n  line %d: field %s not found in type config.BackendConfig", key.Line, key.Value)
+			}
+		}
+	}
+	return node.Decode((*backendFields)(b))
+}
+
+// MarshalYAML writes a backend without attributes in the short string form.
+func (b BackendConfig) MarshalYAML() (interface{}, error) {
+	if (BackendConfig{URL: b.URL, Weight: 1}).equal(b) {
+		return b.URL, nil
+	}
+	return backendFields(b), nil
+}
+
+func (b BackendConfig) equal(o BackendConfig) bool {
+	return b.URL == o.URL && b.Weight == o.Weight && b.HealthCheckPath == o.HealthCheckPath &&
+		b.Zone == o.Zone && b.Priority == o.Priority && b.MaxConnections == o.MaxConnections &&
+		maps.Equal(b.Tags, o.Tags)
+}
+
+type RouteConfig struct {
+	Name       string `yaml:"name"`
+	Host       string `yaml:"host"`
+	PathPrefix string `yaml:"path_prefix"`
+	Pool       string `yaml:"pool"`
+
+	// ClientAuth, if set, only admits clients with a verified certificate.
+	ClientAuth *RouteClientAuthConfig `yaml:"client_auth"`
+
+	// RateLimit names the rate_limiting policy for the route, which takes
+	// the place of the global policy.
+	RateLimit string `yaml:"rate_limit"`
+
+	// Priority is critical, normal (the default) or sheddable and orders
+	// requests when the pool limits concurrency.
+	Priority string `yaml:"priority"`
+}
+
+// RouteClientAuthConfig restricts a route to the listed certificate names.
+// Without names, the allowlist of tls.client_auth applies.
+type RouteClientAuthConfig struct {
+	AllowedSANs        []string `yaml:"allowed_sans"`
+	AllowedCommonNames []string `yaml:"allowed_common_names"`
+}
+
+// ListenerConfig describes a layer-4 listener that forwards connections or,
+// for UDP, flows of datagrams to the backends of Pool. ConnectTimeout
+// defaults to 5s and HalfClose to true; both only apply to TCP. A zero
+// IdleTimeout never closes idle TCP connections and expires UDP flows after
+// 30s.
+type ListenerConfig struct {
+	Name           string        `yaml:"name"`
+	Protocol       string        `yaml:"protocol"`
+	ListenAddr     string        `yaml:"listen_addr"`
+	Pool           string        `yaml:"pool"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	HalfClose      *bool         `yaml:"half_close"`
+
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+
+	// SNIRoutes route TLS connections of a TCP listener by server name
+	// without terminating TLS. Pool is used when no route matches.
+	SNIRoutes []SNIRouteConfig `yaml:"sni_routes"`
+}
+
+// SNIRouteConfig matches server names exactly or, as "*.example.com", by
+// wildcard, and optionally requires one of the ALPN protocols.
+type SNIRouteConfig struct {
+	ServerNames []string `yaml:"server_names"`
+	ALPN        []string `yaml:"alpn"`
+	Pool        string   `yaml:"pool"`
+}
+
+type AccessLogConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Format   string `yaml:"format"`   // json, combined or template
+	Template string `yaml:"template"` // text/template used when format is template
+	Output   string `yaml:"output"`   // stdout, file or syslog
+
+	File   AccessLogFileConfig   `yaml:"file"`
+	Syslog AccessLogSyslogConfig `yaml:"syslog"`
+
+	// Sampling maps a status class such as "2xx" to the fraction of requests logged.
+	Sampling map[string]float64 `yaml:"sampling"`
+}
+
+type AccessLogFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+type AccessLogSyslogConfig struct {
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	ServiceName string            `yaml:"service_name"`
+	Exporter    string            `yaml:"exporter"` // otlp-http or otlp-grpc
+	Endpoint    string            `yaml:"endpoint"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	Propagators []string          `yaml:"propagators"` // tracecontext, baggage, b3
+
+	SamplingRatio float64 `yaml:"sampling_ratio"`
+	IgnoreParent  bool    `yaml:"ignore_parent"`
+}
+
+// PoolConfigs returns all pools with inherited settings filled in. The
+// top-level backend_servers list forms the "default" pool unless a pool of
+// that name is configured explicitly.
+func (c *Config) PoolConfigs() []PoolConfig {
+	pools := make([]PoolConfig, 0, len(c.Pools)+1)
+	hasDefault := false
+	for _, p := range c.Pools {
+		if p.Name == DefaultPoolName {
+			hasDefault = true
+		}
+		pools = append(pools, c.inheritPoolDefaults(p))
+	}
+	if !hasDefault {
+		pools = append([]PoolConfig{c.inheritPoolDefaults(PoolConfig{
+			Name:     DefaultPoolName,
+			Backends: c.BackendServers,
+		})}, pools...)
+	}
+	return pools
+}
+
+// poolConfig returns the pool called name from PoolConfigs.
+func (c *Config) poolConfig(name string) PoolConfig {
+	for _, p := range c.PoolConfigs() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return PoolConfig{}
+}
+
+func (c *Config) inheritPoolDefaults(p PoolConfig) PoolConfig {
+	if p.Algorithm == "" {
+		p.Algorithm = c.LoadBalancer.Algorithm
+	}
+	if p.HealthCheckInterval == 0 {
+		p.HealthCheckInterval = c.LoadBalancer.HealthCheckInterval
+	}
+	if p.MaxRetries == nil {
+		retries := c.LoadBalancer.MaxRetries
+		p.MaxRetries = &retries
+	}
+	if p.UpstreamTLS == nil {
+		p.UpstreamTLS = c.LoadBalancer.UpstreamTLS
+	}
+	if p.Concurrency == nil {
+		p.Concurrency = c.LoadBalancer.Concurrency
+	}
+	if p.Queue == nil {
+		p.Queue = c.LoadBalancer.Queue
+	}
+	return p
+}
+
+// Default returns a configuration with every field set to its default value.
+func Default() *Config {
+	c := &Config{}
+	c.Server.ListenAddr = ":8080"
+	c.Server.ReadTimeout = 5 * time.Second
+	c.Server.WriteTimeout = 10 * time.Second
+	c.Server.IdleTimeout = 120 * time.Second
+
+	c.LoadBalancer.Algorithm = "round-robin"
+	c.LoadBalancer.HealthCheckInterval = 10 * time.Second
+	c.LoadBalancer.MaxRetries = 2
+
+	c.Reload.Debounce = 500 * time.Millisecond
+
+	c.TLS.WatchCertificates = true
+	c.TLS.MinVersion = "1.2"
+	c.TLS.ALPN = []string{"h2", "http/1.1"}
+	c.TLS.SessionTicketRotation = 24 * time.Hour
+	c.TLS.ClientAuth.Mode = "none"
+	c.TLS.ACME.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	c.TLS.ACME.CacheDir = "acme"
+	c.TLS.ACME.RenewBefore = 720 * time.Hour
+	c.TLS.ClientAuth.Headers = ClientCertHeaders{
+		Subject:     "X-Client-Cert-Subject",
+		SANs:        "X-Client-Cert-SANs",
+		Fingerprint: "X-Client-Cert-Fingerprint",
+	}
+
+	c.Logging = LoggingConfig{Level: "info", Format: "json"}
+
+	c.AccessLog.Enabled = true
+	c.AccessLog.Format = "json"
+	c.AccessLog.Output = "stdout"
+	c.AccessLog.File.Path = "access.log"
+	c.AccessLog.File.MaxSizeMB = 100
+	c.AccessLog.File.MaxBackups = 5
+	c.AccessLog.Syslog.Tag = "loadbalancer"
+
+	c.Tracing.ServiceName = "go-load-balancer"
+	c.Tracing.Exporter = "otlp-http"
+	c.Tracing.Endpoint = "localhost:4318"
+	c.Tracing.Propagators = []string{"tracecontext", "baggage", "b3"}
+	c.Tracing.SamplingRatio = 1.0
+
+	c.Metrics.Enabled = true
+	c.Metrics.Port = 9090
+
+	c.RateLimiting.Global = &RateLimitPolicyConfig{Name: "global", Rate: 100, Burst: 10, Key: "ip"}
+	c.RateLimiting.MaxEntries = 100000
+	c.RateLimiting.Store = "memory"
+	c.RateLimiting.Redis.Address = "localhost:6379"
+	c.RateLimiting.Redis.PoolSize = 10
+	c.RateLimiting.Redis.Timeout = 50 * time.Millisecond
+	c.RateLimiting.Redis.KeyPrefix = "lb:ratelimit:"
+	c.RateLimiting.Redis.OnError = "local"
+	c.RateLimiting.Redis.RetryInterval = 5 * time.Second
+	c.RateLimiting.Rejection.Format = "text"
+	c.FeatureToggles.EnableCircuitBreaker = true
+	return c
+}
+
+// Load reads filename on top of the defaults. Unknown keys are rejected and
+// the result is validated; see Validate.
 func Load(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return Parse(filename, data)
+}
 
-	var config Config
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&config)
+// Parse decodes data like Load. filename is only used in error messages.
+func Parse(filename string, data []byte) (*Config, error) {
+	config, err := decode(filename, data)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func decode(filename string, data []byte) (*Config, error) {
+	config := Default()
+	config.file = filename
+	config.sources = make(map[string]string)
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	config.root = &root
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
 
-	return &config, nil
+	config.markFileSources()
+	return config, nil
 }
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const EnvPrefix = "LB_"
+
+// Sources of a field value, as reported by Config.Source.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+)
+
+// Field is a leaf configuration setting that can be overridden by an
+// environment variable or a command-line flag.
+type Field struct {
+	Path string // dotted YAML path, e.g. server.listen_addr
+	Env  string // e.g. LB_SERVER_LISTEN_ADDR
+	Flag string // e.g. server.listen_addr
+}
+
+// secretFields are redacted by Print wherever their value came from.
+var secretFields = map[string]bool{
+	"rate_limiting.redis.password": true,
+	"tracing.headers":              true,
+}
+
+var (
+	durationType    = reflect.TypeOf(time.Duration(0))
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// Fields lists every overridable setting. Nested sections are flattened down
+// to scalars, lists and maps; lists of objects such as pools are a single
+// field whose value is given in YAML flow syntax.
+func Fields() []Field {
+	var fields []Field
+	walkFields(reflect.TypeOf(Config{}), "", func(path string, _ []int) {
+		fields = append(fields, Field{Path: path, Env: envName(path), Flag: path})
+	})
+	return fields
+}
+
+func walkFields(t reflect.Type, prefix string, fn func(path string, index []int), index ...int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if !f.IsExported() || tag == "" || tag == "-" {
+			continue
+		}
+		path := tag
+		if prefix != "" {
+			path = prefix + "." + tag
+		}
+		idx := append(append([]int(nil), index...), i)
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			walkFields(f.Type, path, fn, idx...)
+			continue
+		}
+		fn(path, idx)
+	}
+}
+
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// FlagOverrides collects the configuration flags set on the command line.
+type FlagOverrides struct {
+	values map[string]string
+}
+
+type overrideFlag struct {
+	path   string
+	values map[string]string
+}
+
+func (f *overrideFlag) String() string { return "" }
+
+func (f *overrideFlag) Set(s string) error {
+	f.values[f.path] = s
+	return nil
+}
+
+// RegisterFlags defines a flag on fs for every field in Fields, e.g.
+// -server.listen_addr=:9000.
+func RegisterFlags(fs *flag.FlagSet) *FlagOverrides {
+	o := &FlagOverrides{values: make(map[string]string)}
+	for _, f := range Fields() {
+		fs.Var(&overrideFlag{path: f.Path, values: o.values}, f.Flag, "overrides "+f.Path+" (env "+f.Env+")")
+	}
+	return o
+}
+
+// LoadLayered builds the configuration from the defaults, then filename,
+// then environment variables from environ, then flags. An environment
+// variable with a _FILE suffix, e.g. LB_TRACING_HEADERS_FILE, reads the value
+// from the named file, which keeps secrets out of the environment. flags may
+// be nil.
+func LoadLayered(filename string, environ []string, flags *FlagOverrides) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := decode(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.applyOverrides(environ, flags); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) applyOverrides(environ []string, flags *FlagOverrides) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+
+	root := reflect.ValueOf(c).Elem()
+	var errs []string
+	walkFields(root.Type(), "", func(path string, index []int) {
+		field := root.FieldByIndex(index)
+		name := envName(path)
+
+		raw, source, ok := "", "", false
+		if v, set := env[name]; set {
+			raw, source, ok = v, "env "+name, true
+		} else if file, set := env[name+"_FILE"]; set {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("env %s_FILE: %v", name, err))
+				return
+			}
+			raw, source, ok = strings.TrimRight(string(data), "\r\n"), "env "+name+"_FILE", true
+		}
+		if flags != nil {
+			if v, set := flags.values[path]; set {
+				raw, source, ok = v, "flag -"+path, true
+			}
+		}
+		if !ok {
+			return
+		}
+
+		if err := setField(field, raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %v", source, path, err))
+			return
+		}
+		c.sources[path] = source
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration overrides:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// setField parses raw into v. Lists of strings or of types with a string
+// form, such as backends, accept comma separated values or YAML
+// flow syntax, maps accept key=value pairs or YAML flow syntax, and any other
+// type is decoded as YAML.
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	trimmed := strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(trimmed)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(trimmed, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := setField(elem.Elem(), raw); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		scalar := elem.Kind() == reflect.String || reflect.PointerTo(elem).Implements(unmarshalerType)
+		if scalar && !strings.HasPrefix(trimmed, "[") {
+			items := reflect.MakeSlice(v.Type(), 0, 0)
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					value := reflect.New(elem).Elem()
+					if err := setField(value, item); err != nil {
+						return err
+					}
+					items = reflect.Append(items, value)
+				}
+			}
+			v.Set(items)
+			return nil
+		}
+	case reflect.Map:
+		if !strings.HasPrefix(trimmed, "{") {
+			m := reflect.MakeMap(v.Type())
+			for _, pair := range strings.Split(raw, ",") {
+				if strings.TrimSpace(pair) == "" {
+					continue
+				}
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok {
+					return fmt.Errorf("expected key=value, got %q", pair)
+				}
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := setField(elem, value); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), elem)
+			}
+			v.Set(m)
+			return nil
+		}
+	}
+
+	decoder := yaml.NewDecoder(strings.NewReader(raw))
+	decoder.KnownFields(true)
+	target := reflect.New(v.Type())
+	if err := decoder.Decode(target.Interface()); err != nil {
+		return err
+	}
+	v.Set(target.Elem())
+	return nil
+}
+
+// Source reports where the value of the field at path came from: "default",
+// "file", "env NAME", "env NAME_FILE" or "flag -path".
+func (c *Config) Source(path string) string {
+	if source, ok := c.sources[path]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// sourceOf returns the source of path or of its closest ancestor that has
+// one, e.g. "pools" for "pools[0].backends[1]".
+func (c *Config) sourceOf(path string) string {
+	for {
+		if source, ok := c.sources[path]; ok {
+			return source
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return SourceDefault
+		}
+		path = path[:i]
+	}
+}
+
+// markFileSources records every field present in the YAML document.
+func (c *Config) markFileSources() {
+	for _, f := range Fields() {
+		if nodeAt(c.root, f.Path) != nil {
+			c.sources[f.Path] = SourceFile
+		}
+	}
+}
+
+// Print writes every field with its effective value and source. Secrets such
+// as passwords and values read from _FILE variables are redacted.
+func (c *Config) Print(w io.Writer) {
+	root := reflect.ValueOf(c).Elem()
+	type line struct{ path, value, source string }
+	var lines []line
+	width := 0
+	walkFields(root.Type(), "", func(path string, index []int) {
+		source := c.Source(path)
+		field := root.FieldByIndex(index)
+		value := formatValue(field)
+		if strings.HasSuffix(source, "_FILE") || secretFields[path] && !field.IsZero() {
+			value = `"<redacted>"`
+		}
+		lines = append(lines, line{path, value, source})
+		if n := len(path) + len(value) + 2; n > width {
+			width = n
+		}
+	})
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].path < lines[j].path })
+	for _, l := range lines {
+		fmt.Fprintf(w, "%-*s  # %s\n", width, l.path+": "+l.value, l.source)
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	var node yaml.Node
+	if err := node.Encode(v.Interface()); err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	setFlowStyle(&node)
+	out, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func setFlowStyle(n *yaml.Node) {
+	n.Style |= yaml.FlowStyle
+	for _, child := range n.Content {
+		setFlowStyle(child)
+	}
+}
@@ -0,0 +1,768 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is a problem with one field. Line is set when the value came
+// from the configuration file, Source when it came from an override.
+type FieldError struct {
+	Path    string
+	Line    int
+	Source  string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Source != "" {
+		return e.Path + " (from " + e.Source + "): " + e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError collects every problem found in a configuration.
+type ValidationError struct {
+	File   string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d configuration error(s)", e.File, len(e.Errors))
+	for _, fe := range e.Errors {
+		b.WriteString("\n  ")
+		if fe.Line > 0 {
+			fmt.Fprintf(&b, "%s:%d: ", e.File, fe.Line)
+		}
+		b.WriteString(fe.Error())
+	}
+	return b.String()
+}
+
+type validator struct {
+	config *Config
+	errors []FieldError
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	fe := FieldError{Path: path, Message: fmt.Sprintf(format, args...)}
+	switch source := v.config.sourceOf(path); source {
+	case SourceDefault, SourceFile:
+		fe.Line = lineOf(v.config.root, path)
+	default:
+		fe.Source = source
+	}
+	v.errors = append(v.errors, fe)
+}
+
+// Validate checks the configuration for semantic errors and reports all of
+// them at once as a *ValidationError.
+func (c *Config) Validate() error {
+	v := &validator{config: c}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		v.errorf("server.listen_addr", "invalid address %q: %v", c.Server.ListenAddr, err)
+	}
+	v.nonNegative("server.read_timeout", int64(c.Server.ReadTimeout))
+	v.nonNegative("server.write_timeout", int64(c.Server.WriteTimeout))
+	v.nonNegative("server.idle_timeout", int64(c.Server.IdleTimeout))
+	v.proxyProtocol("server.proxy_protocol", c.Server.ProxyProtocol)
+
+	v.algorithm("load_balancer.algorithm", c.LoadBalancer.Algorithm)
+	if c.LoadBalancer.HealthCheckInterval <= 0 {
+		v.errorf("load_balancer.health_check_interval", "must be positive")
+	}
+	v.nonNegative("load_balancer.max_retries", int64(c.LoadBalancer.MaxRetries))
+	v.upstreamTLS("load_balancer.upstream_tls", c.LoadBalancer.UpstreamTLS)
+	v.concurrency("load_balancer.concurrency", c.LoadBalancer.Concurrency)
+	v.queue("load_balancer.queue", c.LoadBalancer.Queue)
+
+	for i, backend := range c.BackendServers {
+		v.backend(fmt.Sprintf("backend_servers[%d]", i), backend)
+	}
+
+	pools := make(map[string]bool)
+	for i, p := range c.Pools {
+		path := fmt.Sprintf("pools[%d]", i)
+		switch {
+		case p.Name == "":
+			v.errorf(path+".name", "is required")
+		case pools[p.Name]:
+			v.errorf(path+".name", "duplicate pool %q", p.Name)
+		}
+		pools[p.Name] = true
+		if p.Algorithm != "" {
+			v.algorithm(path+".algorithm", p.Algorithm)
+		}
+		v.nonNegative(path+".health_check_interval", int64(p.HealthCheckInterval))
+		if p.ProxyProtocol != "" {
+			v.oneOf(path+".proxy_protocol", p.ProxyProtocol, "v1", "v2")
+		}
+		v.upstreamTLS(path+".upstream_tls", p.UpstreamTLS)
+		v.concurrency(path+".concurrency", p.Concurrency)
+		v.queue(path+".queue", p.Queue)
+		v.discovery(path+".discovery", p.Discovery)
+		if p.Discovery != nil && len(p.Backends) > 0 {
+			v.errorf(path+".backends", "cannot be combined with discovery")
+		}
+		if p.MaxRetries != nil {
+			v.nonNegative(path+".max_retries", int64(*p.MaxRetries))
+		}
+		for j, backend := range p.Backends {
+			v.backend(fmt.Sprintf("%s.backends[%d]", path, j), backend)
+		}
+	}
+
+	policies := c.validateRateLimiting(v)
+	routes := make(map[string]bool)
+	for i, r := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case r.Name == "":
+			v.errorf(path+".name", "is required")
+		case routes[r.Name]:
+			v.errorf(path+".name", "duplicate route %q", r.Name)
+		}
+		routes[r.Name] = true
+		if !pools[r.Pool] && r.Pool != DefaultPoolName {
+			v.errorf(path+".pool", "unknown pool %q", r.Pool)
+		}
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			v.errorf(path+".path_prefix", "must start with /")
+		}
+		if r.ClientAuth != nil && (!c.TLS.Enabled || c.TLS.ClientAuth.Mode == "none") {
+			v.errorf(path+".client_auth", "requires tls.enabled and a tls.client_auth.mode other than none")
+		}
+		if r.RateLimit != "" && !policies[r.RateLimit] {
+			v.errorf(path+".rate_limit", "unknown rate limit policy %q", r.RateLimit)
+		}
+		if r.Priority != "" {
+			v.oneOf(path+".priority", r.Priority, "critical", "normal", "sheddable")
+		}
+	}
+
+	c.validateListeners(v, pools)
+	c.validateBackendSchemes(v)
+
+	v.nonNegative("reload.debounce", int64(c.Reload.Debounce))
+
+	c.validateTLS(v)
+
+	v.oneOf("logging.level", c.Logging.Level, "debug", "info", "warn", "error")
+	v.oneOf("logging.format", c.Logging.Format, "json", "console")
+
+	c.validateAccessLog(v)
+	c.validateTracing(v)
+
+	if c.Metrics.Enabled && (c.Metrics.Port < 1 || c.Metrics.Port > 65535) {
+		v.errorf("metrics.port", "must be between 1 and 65535")
+	}
+
+	if len(v.errors) > 0 {
+		sort.SliceStable(v.errors, func(i, j int) bool {
+			return v.errors[i].Line < v.errors[j].Line
+		})
+		return &ValidationError{File: c.file, Errors: v.errors}
+	}
+	return nil
+}
+
+func (c *Config) validateListeners(v *validator, pools map[string]bool) {
+	addrs := map[string]bool{"tcp " + c.Server.ListenAddr: true}
+	names := make(map[string]bool)
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		switch {
+		case l.Name == "":
+			v.errorf(path+".name", "is required")
+		case names[l.Name]:
+			v.errorf(path+".name", "duplicate listener %q", l.Name)
+		}
+		names[l.Name] = true
+		v.oneOf(path+".protocol", l.Protocol, "tcp", "udp")
+		// TCP and UDP can share a port number.
+		addr := l.Protocol + " " + l.ListenAddr
+		if _, _, err := net.SplitHostPort(l.ListenAddr); err != nil {
+			v.errorf(path+".listen_addr", "invalid address %q: %v", l.ListenAddr, err)
+		} else if addrs[addr] {
+			v.errorf(path+".listen_addr", "address %q is already in use", l.ListenAddr)
+		}
+		addrs[addr] = true
+		if !pools[l.Pool] && l.Pool != DefaultPoolName {
+			v.errorf(path+".pool", "unknown pool %q", l.Pool)
+		}
+		v.nonNegative(path+".connect_timeout", int64(l.ConnectTimeout))
+		v.nonNegative(path+".idle_timeout", int64(l.IdleTimeout))
+
+		v.proxyProtocol(path+".proxy_protocol", l.ProxyProtocol)
+		if l.ProxyProtocol.Enabled && l.Protocol != "tcp" {
+			v.errorf(path+".proxy_protocol", "only supported for tcp listeners")
+		}
+		if l.Protocol == "udp" && c.poolConfig(l.Pool).ProxyProtocol != "" {
+			v.errorf(path+".pool", "pool %q sends the PROXY protocol, which is not supported for udp listeners", l.Pool)
+		}
+		if len(l.SNIRoutes) > 0 && l.Protocol != "tcp" {
+			v.errorf(path+".sni_routes", "only supported for tcp listeners")
+		}
+		for j, r := range l.SNIRoutes {
+			routePath := fmt.Sprintf("%s.sni_routes[%d]", path, j)
+			if len(r.ServerNames) == 0 {
+				v.errorf(routePath+".server_names", "is required")
+			}
+			for k, name := range r.ServerNames {
+				if strings.Contains(strings.TrimPrefix(name, "*."), "*") || name == "" {
+					v.errorf(fmt.Sprintf("%s.server_names[%d]", routePath, k), "invalid server name %q, expected a host name or *.domain", name)
+				}
+			}
+			if !pools[r.Pool] && r.Pool != DefaultPoolName {
+				v.errorf(routePath+".pool", "unknown pool %q", r.Pool)
+			}
+		}
+	}
+}
+
+// validateBackendSchemes checks that pools serving HTTP routes have http(s)
+// backends and pools serving layer-4 listeners have backends of the
+// listener's protocol.
+func (c *Config) validateBackendSchemes(v *validator) {
+	paths := map[string]string{DefaultPoolName: "backend_servers"}
+	for i, p := range c.Pools {
+		paths[p.Name] = fmt.Sprintf("pools[%d].backends", i)
+	}
+	backends := make(map[string][]BackendConfig)
+	for _, p := range c.PoolConfigs() {
+		backends[p.Name] = p.Backends
+	}
+
+	checked := make(map[string]bool)
+	check := func(pool, user string, schemes ...string) {
+		key := pool + " " + strings.Join(schemes, ",")
+		if checked[key] {
+			return
+		}
+		checked[key] = true
+		for i, b := range backends[pool] {
+			u, err := url.Parse(b.URL)
+			if err != nil {
+				continue // reported by backendURL
+			}
+			if !contains(schemes, u.Scheme) {
+				v.errorf(fmt.Sprintf("%s[%d]", paths[pool], i), "pool %q is used by %s and needs %s:// backends",
+					pool, user, strings.Join(schemes, ":// or "))
+			}
+		}
+	}
+
+	check(DefaultPoolName, "the default route", "http", "https")
+	for _, r := range c.Routes {
+		check(r.Pool, fmt.Sprintf("route %q", r.Name), "http", "https")
+	}
+	for _, l := range c.Listeners {
+		check(l.Pool, fmt.Sprintf("listener %q", l.Name), l.Protocol)
+		for _, r := range l.SNIRoutes {
+			check(r.Pool, fmt.Sprintf("listener %q", l.Name), l.Protocol)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var statusClassPattern = regexp.MustCompile(`^[1-5]xx$`)
+
+func (c *Config) validateAccessLog(v *validator) {
+	al := c.AccessLog
+	if !al.Enabled {
+		return
+	}
+	if v.oneOf("access_log.format", al.Format, "json", "combined", "template") && al.Format == "template" {
+		if _, err := template.New("").Parse(al.Template); err != nil || al.Template == "" {
+			v.errorf("access_log.template", "a valid text/template is required for the template format")
+		}
+	}
+	if v.oneOf("access_log.output", al.Output, "stdout", "file", "syslog") && al.Output == "file" {
+		if al.File.Path == "" {
+			v.errorf("access_log.file.path", "is required for file output")
+		}
+		v.nonNegative("access_log.file.max_size_mb", int64(al.File.MaxSizeMB))
+		v.nonNegative("access_log.file.max_backups", int64(al.File.MaxBackups))
+	}
+	for class, ratio := range al.Sampling {
+		path := "access_log.sampling." + class
+		if !statusClassPattern.MatchString(class) {
+			v.errorf(path, "unknown status class, expected 1xx to 5xx")
+		}
+		if ratio < 0 || ratio > 1 {
+			v.errorf(path, "must be between 0 and 1")
+		}
+	}
+}
+
+func (c *Config) validateTLS(v *validator) {
+	t := c.TLS
+	if !t.Enabled {
+		return
+	}
+	if t.CertFile != "" || t.KeyFile != "" || (len(t.Certificates) == 0 && !t.ACME.Enabled) {
+		v.file("tls.cert_file", t.CertFile)
+		v.file("tls.key_file", t.KeyFile)
+	}
+	for i, cert := range t.Certificates {
+		path := fmt.Sprintf("tls.certificates[%d]", i)
+		v.file(path+".cert_file", cert.CertFile)
+		v.file(path+".key_file", cert.KeyFile)
+	}
+
+	version, err := certs.ParseVersion(t.MinVersion)
+	if err != nil {
+		v.errorf("tls.min_version", "%v", err)
+	}
+	suites, err := certs.ParseCipherSuites(t.CipherSuites)
+	if err != nil {
+		v.errorf("tls.cipher_suites", "%v", err)
+	}
+	for i, proto := range t.ALPN {
+		v.oneOf(fmt.Sprintf("tls.alpn[%d]", i), proto, "h2", "http/1.1")
+	}
+	// HTTP/2 clients abort connections that negotiated a suite other than
+	// these over TLS 1.2 (RFC 7540, section 9.2.2).
+	if len(suites) > 0 && version < tls.VersionTLS13 && slices.Contains(t.ALPN, "h2") &&
+		!slices.Contains(suites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+		!slices.Contains(suites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		v.errorf("tls.cipher_suites", "must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 when h2 is offered")
+	}
+	v.nonNegative("tls.session_ticket_rotation", int64(t.SessionTicketRotation))
+
+	if v.oneOf("tls.client_auth.mode", t.ClientAuth.Mode, "none", "optional", "require") && t.ClientAuth.Mode != "none" {
+		v.file("tls.client_auth.ca_file", t.ClientAuth.CAFile)
+	}
+	c.validateACME(v)
+}
+
+func (c *Config) validateACME(v *validator) {
+	a := c.TLS.ACME
+	if !a.Enabled {
+		return
+	}
+	if u, err := url.Parse(a.DirectoryURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		v.errorf("tls.acme.directory_url", "invalid URL %q", a.DirectoryURL)
+	}
+	if a.CAFile != "" {
+		v.file("tls.acme.ca_file", a.CAFile)
+	}
+	if len(a.Domains) == 0 {
+		v.errorf("tls.acme.domains", "is required when ACME is enabled")
+	}
+	for i, domain := range a.Domains {
+		if strings.Contains(domain, "*") || !strings.Contains(strings.Trim(domain, "."), ".") {
+			v.errorf(fmt.Sprintf("tls.acme.domains[%d]", i), "invalid domain %q, expected a fully qualified name without wildcards", domain)
+		}
+	}
+	if a.CacheDir == "" {
+		v.errorf("tls.acme.cache_dir", "is required when ACME is enabled")
+	}
+	if a.RenewBefore <= time.Hour {
+		v.errorf("tls.acme.renew_before", "must be longer than 1h")
+	}
+}
+
+// validateRateLimiting checks the policies and returns their names.
+func (c *Config) validateRateLimiting(v *validator) map[string]bool {
+	names := make(map[string]bool)
+	if g := c.RateLimiting.Global; g != nil {
+		v.rateLimitPolicy("rate_limiting.global", *g)
+		names[g.Name] = true
+	}
+	policies := make(map[string]bool)
+	for i, p := range c.RateLimiting.Policies {
+		path := fmt.Sprintf("rate_limiting.policies[%d]", i)
+		switch {
+		case p.Name == "":
+			v.errorf(path+".name", "is required")
+		case names[p.Name]:
+			v.errorf(path+".name", "duplicate policy %q", p.Name)
+		}
+		names[p.Name] = true
+		policies[p.Name] = true
+		v.rateLimitPolicy(path, p)
+	}
+	if c.RateLimiting.MaxEntries < 1 {
+		v.errorf("rate_limiting.max_entries", "must be at least 1")
+	}
+	if v.oneOf("rate_limiting.store", c.RateLimiting.Store, "memory", "redis") && c.RateLimiting.Store == "redis" {
+		v.rateLimitRedis("rate_limiting.redis", c.RateLimiting.Redis)
+	}
+	rej := c.RateLimiting.Rejection
+	if v.oneOf("rate_limiting.rejection.format", rej.Format, "text", "json") {
+		if _, err := ratelimit.NewRejection(rej.Format, rej.Template); err != nil {
+			v.errorf("rate_limiting.rejection.template", "%v", err)
+		}
+	}
+	return policies
+}
+
+func (v *validator) rateLimitRedis(path string, r RateLimitRedisConfig) {
+	if _, _, err := net.SplitHostPort(r.Address); err != nil {
+		v.errorf(path+".address", "invalid address %q: %v", r.Address, err)
+	}
+	v.nonNegative(path+".db", int64(r.DB))
+	if r.PoolSize < 1 {
+		v.errorf(path+".pool_size", "must be at least 1")
+	}
+	if r.Timeout <= 0 {
+		v.errorf(path+".timeout", "must be positive")
+	}
+	v.oneOf(path+".on_error", r.OnError, "local", "allow", "deny")
+	if r.RetryInterval <= 0 {
+		v.errorf(path+".retry_interval", "must be positive")
+	}
+}
+
+func (v *validator) rateLimitPolicy(path string, p RateLimitPolicyConfig) {
+	v.rateLimit(path, p.Rate, p.Burst)
+	if p.Key != "" && v.oneOf(path+".key", p.Key, "ip", "header", "api_key", "jwt_claim", "route") {
+		if p.Key == "header" && p.Header == "" {
+			v.errorf(path+".header", "is required for key header")
+		}
+		if p.Key == "jwt_claim" && p.Claim == "" {
+			v.errorf(path+".claim", "is required for key jwt_claim")
+		}
+	}
+	seen := make(map[string]bool)
+	for i, o := range p.Overrides {
+		opath := fmt.Sprintf("%s.overrides[%d]", path, i)
+		switch {
+		case o.Key == "":
+			v.errorf(opath+".key", "is required")
+		case seen[o.Key]:
+			v.errorf(opath+".key", "duplicate override %q", o.Key)
+		}
+		seen[o.Key] = true
+		v.rateLimit(opath, o.Rate, o.Burst)
+	}
+}
+
+func (v *validator) rateLimit(path string, rate float64, burst int) {
+	if rate <= 0 {
+		v.errorf(path+".rate", "must be positive")
+	}
+	if burst < 1 {
+		v.errorf(path+".burst", "must be at least 1")
+	}
+}
+
+func (c *Config) validateTracing(v *validator) {
+	t := c.Tracing
+	if !t.Enabled {
+		return
+	}
+	v.oneOf("tracing.exporter", t.Exporter, "otlp-http", "otlp-grpc")
+	if t.SamplingRatio < 0 || t.SamplingRatio > 1 {
+		v.errorf("tracing.sampling_ratio", "must be between 0 and 1")
+	}
+	for i, p := range t.Propagators {
+		v.oneOf(fmt.Sprintf("tracing.propagators[%d]", i), p, "tracecontext", "baggage", "b3")
+	}
+}
+
+func (v *validator) proxyProtocol(path string, pp ProxyProtocolConfig) {
+	if !pp.Enabled {
+		return
+	}
+	if len(pp.TrustedSources) == 0 {
+		v.errorf(path+".trusted_sources", "is required when the PROXY protocol is enabled")
+	}
+	for i, source := range pp.TrustedSources {
+		if _, err := proxyprotocol.ParseTrusted([]string{source}); err != nil {
+			v.errorf(fmt.Sprintf("%s.trusted_sources[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func (v *validator) upstreamTLS(path string, t *UpstreamTLSConfig) {
+	if t == nil {
+		return
+	}
+	if t.CAFile != "" {
+		v.file(path+".ca_file", t.CAFile)
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		v.file(path+".cert_file", t.CertFile)
+		v.file(path+".key_file", t.KeyFile)
+	}
+}
+
+func (v *validator) concurrency(path string, cc *ConcurrencyConfig) {
+	if cc == nil {
+		return
+	}
+	if cc.Algorithm != "" && !v.oneOf(path+".algorithm", cc.Algorithm, "gradient", "aimd") {
+		return
+	}
+	v.nonNegative(path+".initial_limit", int64(cc.InitialLimit))
+	v.nonNegative(path+".min_limit", int64(cc.MinLimit))
+	v.nonNegative(path+".max_limit", int64(cc.MaxLimit))
+	v.nonNegative(path+".queue_size", int64(cc.QueueSize))
+	v.nonNegative(path+".queue_timeout", int64(cc.QueueTimeout))
+	v.nonNegative(path+".latency_threshold", int64(cc.LatencyThreshold))
+	if _, err := concurrency.New(concurrency.Options(*cc)); err != nil {
+		v.errorf(path, "%v", err)
+	}
+}
+
+func (v *validator) queue(path string, q *QueueConfig) {
+	if q == nil {
+		return
+	}
+	v.nonNegative(path+".size", int64(q.Size))
+	if q.Size > 0 && q.Timeout <= 0 {
+		v.errorf(path+".timeout", "must be positive")
+	}
+}
+
+func (v *validator) discovery(path string, d *DiscoveryConfig) {
+	if d == nil || !v.oneOf(path+".provider", d.Provider, "file", "dns", "consul", "kubernetes") {
+		return
+	}
+	switch d.Provider {
+	case "file":
+		if d.File.Path == "" {
+			v.errorf(path+".file.path", "is required")
+		}
+		v.nonNegative(path+".file.debounce", int64(d.File.Debounce))
+		v.nonNegative(path+".file.refresh_interval", int64(d.File.RefreshInterval))
+	case "dns":
+		v.dnsDiscovery(path+".dns", d.DNS)
+	case "consul":
+		v.consulDiscovery(path+".consul", d.Consul)
+	case "kubernetes":
+		v.kubernetesDiscovery(path+".kubernetes", d.Kubernetes)
+	}
+}
+
+func (v *validator) kubernetesDiscovery(path string, k KubernetesDiscoveryConfig) {
+	if k.Service == "" {
+		v.errorf(path+".service", "is required")
+	}
+	if k.APIServer != "" {
+		if u, err := url.Parse(k.APIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path+".api_server", "invalid URL %q, expected http(s)://host[:port]", k.APIServer)
+		}
+	}
+	if k.TokenFile != "" {
+		v.file(path+".token_file", k.TokenFile)
+	}
+	if k.CAFile != "" {
+		v.file(path+".ca_file", k.CAFile)
+	}
+	if k.Scheme != "" {
+		v.oneOf(path+".scheme", k.Scheme, "http", "https", "tcp", "udp")
+	}
+	v.nonNegative(path+".retry_interval", int64(k.RetryInterval))
+}
+
+func (v *validator) consulDiscovery(path string, c ConsulDiscoveryConfig) {
+	if c.Service == "" {
+		v.errorf(path+".service", "is required")
+	}
+	if c.Address != "" {
+		if u, err := url.Parse(c.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path+".address", "invalid URL %q, expected http(s)://host[:port]", c.Address)
+		}
+	}
+	if c.TokenFile != "" {
+		v.file(path+".token_file", c.TokenFile)
+	}
+	if c.Scheme != "" {
+		v.oneOf(path+".scheme", c.Scheme, "http", "https", "tcp", "udp")
+	}
+	v.nonNegative(path+".wait_time", int64(c.WaitTime))
+	v.nonNegative(path+".retry_interval", int64(c.RetryInterval))
+}
+
+func (v *validator) dnsDiscovery(path string, d DNSDiscoveryConfig) {
+	if d.Name == "" {
+		v.errorf(path+".name", "is required")
+	}
+	if d.Type != "" && !v.oneOf(path+".type", d.Type, "A", "AAAA", "SRV") {
+		return
+	}
+	if d.Type != "SRV" && (d.Port <= 0 || d.Port > 65535) {
+		v.errorf(path+".port", "must be between 1 and 65535")
+	}
+	if d.Scheme != "" {
+		v.oneOf(path+".scheme", d.Scheme, "http", "https", "tcp", "udp")
+	}
+	if d.Resolver != "" {
+		if _, _, err := net.SplitHostPort(d.Resolver); err != nil {
+			v.errorf(path+".resolver", "%v", err)
+		}
+	}
+	v.nonNegative(path+".min_interval", int64(d.MinInterval))
+	v.nonNegative(path+".max_interval", int64(d.MaxInterval))
+	v.nonNegative(path+".timeout", int64(d.Timeout))
+	if d.MinInterval > 0 && d.MaxInterval > 0 && d.MinInterval > d.MaxInterval {
+		v.errorf(path+".max_interval", "must not be less than min_interval")
+	}
+}
+
+func (v *validator) nonNegative(path string, n int64) {
+	if n < 0 {
+		v.errorf(path, "must not be negative")
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	v.errorf(path, "invalid value %q, expected one of %s", value, strings.Join(allowed, ", "))
+	return false
+}
+
+func (v *validator) algorithm(path, name string) {
+	v.oneOf(path, name, loadbalancers.Algorithms...)
+}
+
+func (v *validator) backend(path string, b BackendConfig) {
+	v.backendURL(path, b.URL)
+	if b.Weight < 1 {
+		v.errorf(path+".weight", "must be at least 1")
+	}
+	if b.HealthCheckPath != "" && !strings.HasPrefix(b.HealthCheckPath, "/") {
+		v.errorf(path+".health_check_path", "must start with /")
+	}
+	v.nonNegative(path+".priority", int64(b.Priority))
+	v.nonNegative(path+".max_connections", int64(b.MaxConnections))
+}
+
+func (v *validator) backendURL(path, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.errorf(path, "invalid URL: %v", err)
+		return
+	}
+	switch {
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	case (u.Scheme == "tcp" || u.Scheme == "udp") && u.Port() != "":
+	default:
+		v.errorf(path, "invalid URL %q, expected http(s)://host[:port], tcp://host:port or udp://host:port", raw)
+	}
+}
+
+func (v *validator) file(path, name string) {
+	if name == "" {
+		v.errorf(path, "is required")
+		return
+	}
+	if _, err := os.Stat(name); err != nil {
+		v.errorf(path, "%v", err)
+	}
+}
+
+// lineOf returns the line of the YAML node at path, such as
+// "pools[1].backends[0]". If the path is not present in the document, the
+// line of the closest present ancestor is returned, or 0 if there is none.
+func lineOf(root *yaml.Node, path string) int {
+	for path != "" {
+		if node := nodeAt(root, path); node != nil {
+			return node.Line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// nodeAt returns the YAML node at path, or nil if it is not in the document.
+func nodeAt(root *yaml.Node, path string) *yaml.Node {
+	if root == nil {
+		return nil
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		node = node.Content[0]
+	}
+	for _, part := range splitPath(path) {
+		if node = childNode(node, part); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func splitPath(path string) []string {
+	var parts []string
+	for _, field := range strings.Split(path, ".") {
+		for {
+			i := strings.IndexByte(field, '[')
+			if i < 0 {
+				break
+			}
+			if i > 0 {
+				parts = append(parts, field[:i])
+			}
+			j := strings.IndexByte(field, ']')
+			if j < i {
+				break
+			}
+			parts = append(parts, field[i:j+1])
+			field = field[j+1:]
+		}
+		if field != "" {
+			parts = append(parts, field)
+		}
+	}
+	return parts
+}
+
+func childNode(node *yaml.Node, part string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == part {
+				return node.Content[i+1]
+			}
+		}
+	case yaml.SequenceNode:
+		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
+			i, err := strconv.Atoi(part[1 : len(part)-1])
+			if err == nil && i >= 0 && i < len(node.Content) {
+				return node.Content[i]
+			}
+		}
+	}
+	return nil
+}
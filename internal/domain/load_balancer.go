@@ -10,3 +10,17 @@ type LoadBalancer interface {
 	RemoveServer(url string) error
 	GetServers() []*Server
 }
+
+type hashKeyContextKey struct{}
+
+// WithHashKey returns a context carrying the key that hash-based algorithms
+// use to pick a server, typically the client IP.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+// HashKey returns the key set by WithHashKey.
+func HashKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyContextKey{}).(string)
+	return key, ok
+}
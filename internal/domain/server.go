@@ -1,9 +1,12 @@
 package domain
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -17,6 +20,27 @@ type Server struct {
 	HealthCheckPath string
 	Weight          int
 	FailureCount    int
+
+	// Zone and Tags are free-form metadata. Servers with a lower Priority are
+	// preferred; higher ones are only used when none of those are available.
+	// MaxConnections caps concurrent connections, 0 means unlimited.
+	Zone           string
+	Priority       int
+	MaxConnections int
+	Tags           map[string]string
+
+	// attrMu guards the attributes read outside the lock of the balancer
+	// holding the server, MaxConnections and HealthCheckPath, once
+	// SetAttributes may change them.
+	attrMu sync.RWMutex
+
+	// Transport reaches http(s):// servers, for proxied requests as well as
+	// health checks. Nil uses http.DefaultTransport for health checks and
+	// the handler's transport for requests.
+	Transport http.RoundTripper
+	// DialContext opens the connections of health checks of tcp:// servers.
+	// Nil uses a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 func NewServer(urlStr string) (*Server, error) {
@@ -35,11 +59,101 @@ func NewServer(urlStr string) (*Server, error) {
 	return server, nil
 }
 
+// SetAttributes copies the attributes of from, such as Weight, Priority and
+// MaxConnections, keeping the state and connections of s. Algorithms read
+// the attributes under the lock of their balancer, so the balancer must hold
+// it for writing, as LoadBalancer.UpdateServer does.
+func (s *Server) SetAttributes(from *Server) {
+	s.attrMu.Lock()
+	defer s.attrMu.Unlock()
+	s.HealthCheckPath = from.HealthCheckPath
+	s.Weight = from.Weight
+	s.Zone = from.Zone
+	s.Priority = from.Priority
+	s.MaxConnections = from.MaxConnections
+	s.Tags = from.Tags
+}
+
+func (s *Server) maxConnections() int64 {
+	s.attrMu.RLock()
+	defer s.attrMu.RUnlock()
+	return int64(s.MaxConnections)
+}
+
+// Available reports whether the server is healthy and below its connection
+// cap.
+func (s *Server) Available() bool {
+	if !s.Active.Load() {
+		return false
+	}
+	limit := s.maxConnections()
+	return limit <= 0 || atomic.LoadInt64(&s.Connections) < limit
+}
+
+// Acquire counts a request against MaxConnections if the server is below
+// it, and reports whether it was. A successful Acquire must be followed by
+// Release.
+func (s *Server) Acquire() bool {
+	limit := s.maxConnections()
+	for {
+		n := atomic.LoadInt64(&s.Connections)
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.Connections, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release ends a request counted by Acquire and returns the number left.
+func (s *Server) Release() int64 {
+	return atomic.AddInt64(&s.Connections, -1)
+}
+
+// AtCapacity reports whether the server is healthy but at its connection
+// cap.
+func (s *Server) AtCapacity() bool {
+	limit := s.maxConnections()
+	return s.Active.Load() && limit > 0 && atomic.LoadInt64(&s.Connections) >= limit
+}
+
+// HealthCheck probes the server: tcp:// servers by opening a connection,
+// others with an HTTP GET of HealthCheckPath. UDP has no connection to probe,
+// so udp:// servers always pass and are only taken out passively, when the
+// proxy sees them refuse datagrams.
 func (s *Server) HealthCheck() error {
+	return s.HealthCheckContext(context.Background())
+}
+
+// HealthCheckContext is HealthCheck with a context, which is passed on to
+// Transport and DialContext. Connections of HTTP checks are not reused, as
+// the context may have set them up for health checks only.
+func (s *Server) HealthCheckContext(ctx context.Context) error {
+	switch s.URL.Scheme {
+	case "tcp":
+		return s.dialCheck(ctx)
+	case "udp":
+		s.LastChecked = time.Now()
+		s.FailureCount = 0
+		s.Active.Store(true)
+		return nil
+	}
+
 	client := &http.Client{
-		Timeout: 5 * time.Second,
+		Transport: s.Transport,
+		Timeout:   5 * time.Second,
 	}
-	resp, err := client.Get(s.URL.String() + s.HealthCheckPath)
+	s.attrMu.RLock()
+	path := s.HealthCheckPath
+	s.attrMu.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL.String()+path, nil)
+	if err != nil {
+		s.FailureCount++
+		return err
+	}
+	req.Close = true
+	resp, err := client.Do(req)
 	if err != nil {
 		s.FailureCount++
 		return err
@@ -58,3 +172,25 @@ func (s *Server) HealthCheck() error {
 	s.Active.Store(true)
 	return nil
 }
+
+func (s *Server) dialCheck(ctx context.Context) error {
+	dial := s.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", s.URL.Host)
+	if err != nil {
+		s.FailureCount++
+		return err
+	}
+	conn.Close()
+
+	s.ResponseTime = time.Since(start)
+	s.LastChecked = time.Now()
+	s.FailureCount = 0
+	s.Active.Store(true)
+	return nil
+}
@@ -0,0 +1,56 @@
+package accesslog
+
+import (
+	"context"
+	"time"
+)
+
+type Entry struct {
+	Time            time.Time
+	RequestID       string
+	ClientIP        string
+	User            string
+	Method          string
+	Host            string
+	URI             string
+	Proto           string
+	Status          int
+	BytesIn         int64
+	BytesOut        int64
+	Duration        time.Duration
+	UpstreamAddr    string
+	UpstreamLatency time.Duration
+	Route           string
+	Pool            string
+	Retries         int
+	Referer         string
+	UserAgent       string
+	TLSVersion      string
+	TLSCipher       string
+	TLSServerName   string
+}
+
+// StatusClass returns the status class of the entry, e.g. "2xx".
+func (e *Entry) StatusClass() string {
+	if e.Status < 100 || e.Status > 599 {
+		return "unknown"
+	}
+	return string(rune('0'+e.Status/100)) + "xx"
+}
+
+type contextKey struct{}
+
+// WithEntry returns a copy of ctx carrying entry, so that handlers further down
+// the chain can fill in upstream details.
+func WithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the entry stored in ctx. If there is none, a throwaway
+// entry is returned so callers never have to check for nil.
+func FromContext(ctx context.Context) *Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*Entry); ok {
+		return entry
+	}
+	return &Entry{}
+}
@@ -0,0 +1,152 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+type Formatter interface {
+	Format(entry *Entry) ([]byte, error)
+}
+
+func NewFormatter(format, tmpl string) (Formatter, error) {
+	switch format {
+	case "", "json":
+		return JSONFormatter{}, nil
+	case "combined":
+		return CombinedFormatter{}, nil
+	case "template":
+		return NewTemplateFormatter(tmpl)
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+}
+
+type JSONFormatter struct{}
+
+type jsonEntry struct {
+	Time              string  `json:"time"`
+	RequestID         string  `json:"request_id,omitempty"`
+	ClientIP          string  `json:"client_ip"`
+	User              string  `json:"user,omitempty"`
+	Method            string  `json:"method"`
+	Host              string  `json:"host"`
+	URI               string  `json:"uri"`
+	Proto             string  `json:"proto"`
+	Status            int     `json:"status"`
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	DurationMs        float64 `json:"duration_ms"`
+	UpstreamAddr      string  `json:"upstream_addr,omitempty"`
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms,omitempty"`
+	Route             string  `json:"route,omitempty"`
+	Pool              string  `json:"pool,omitempty"`
+	Retries           int     `json:"retries"`
+	Referer           string  `json:"referer,omitempty"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+	TLSVersion        string  `json:"tls_version,omitempty"`
+	TLSCipher         string  `json:"tls_cipher,omitempty"`
+	TLSServerName     string  `json:"tls_server_name,omitempty"`
+}
+
+func (JSONFormatter) Format(e *Entry) ([]byte, error) {
+	b, err := json.Marshal(jsonEntry{
+		Time:              e.Time.UTC().Format(time.RFC3339Nano),
+		RequestID:         e.RequestID,
+		ClientIP:          e.ClientIP,
+		User:              e.User,
+		Method:            e.Method,
+		Host:              e.Host,
+		URI:               e.URI,
+		Proto:             e.Proto,
+		Status:            e.Status,
+		BytesIn:           e.BytesIn,
+		BytesOut:          e.BytesOut,
+		DurationMs:        milliseconds(e.Duration),
+		UpstreamAddr:      e.UpstreamAddr,
+		UpstreamLatencyMs: milliseconds(e.UpstreamLatency),
+		Route:             e.Route,
+		Pool:              e.Pool,
+		Retries:           e.Retries,
+		Referer:           e.Referer,
+		UserAgent:         e.UserAgent,
+		TLSVersion:        e.TLSVersion,
+		TLSCipher:         e.TLSCipher,
+		TLSServerName:     e.TLSServerName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// CombinedFormatter writes the Apache combined log format.
+type CombinedFormatter struct{}
+
+func (CombinedFormatter) Format(e *Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(orDash(e.ClientIP))
+	buf.WriteString(" - ")
+	buf.WriteString(orDash(e.User))
+	buf.WriteString(" [")
+	buf.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString("] \"")
+	buf.WriteString(e.Method + " " + e.URI + " " + e.Proto)
+	buf.WriteString("\" ")
+	buf.WriteString(strconv.Itoa(e.Status))
+	buf.WriteByte(' ')
+	if e.BytesOut > 0 {
+		buf.WriteString(strconv.FormatInt(e.BytesOut, 10))
+	} else {
+		buf.WriteByte('-')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(orDash(e.Referer)))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(orDash(e.UserAgent)))
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// TemplateFormatter renders entries with a user supplied text/template, e.g.
+// `{{.ClientIP}} {{.Method}} {{.URI}} {{.Status}} {{.Duration}}`.
+type TemplateFormatter struct {
+	tmpl *template.Template
+}
+
+func NewTemplateFormatter(text string) (*TemplateFormatter, error) {
+	if text == "" {
+		return nil, fmt.Errorf("access log template is empty")
+	}
+	tmpl, err := template.New("access_log").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log template: %w", err)
+	}
+	return &TemplateFormatter{tmpl: tmpl}, nil
+}
+
+func (f *TemplateFormatter) Format(e *Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
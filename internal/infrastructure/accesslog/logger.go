@@ -0,0 +1,57 @@
+package accesslog
+
+import (
+	"io"
+	"math/rand/v2"
+	"sync"
+)
+
+// Sampling maps a status class ("2xx", "5xx", ...) to the fraction of entries
+// that are written. Classes that are not listed are always written.
+type Sampling map[string]float64
+
+func (s Sampling) keep(class string) bool {
+	ratio, ok := s[class]
+	if !ok || ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return rand.Float64() < ratio
+}
+
+type Logger struct {
+	formatter Formatter
+	sampling  Sampling
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewLogger(formatter Formatter, out io.Writer, sampling Sampling) *Logger {
+	return &Logger{formatter: formatter, out: out, sampling: sampling}
+}
+
+func (l *Logger) Log(entry *Entry) error {
+	if !l.sampling.keep(entry.StatusClass()) {
+		return nil
+	}
+
+	line, err := l.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.out.Write(line)
+	return err
+}
+
+func (l *Logger) Close() error {
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.WriteCloser that rotates the underlying file once it
+// grows past maxSize bytes, keeping at most maxBackups old files named
+// path.1, path.2, ... with path.1 being the most recent.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rotateErr = rf.rotate()
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate moves the file aside and opens a new one. If it cannot be moved
+// aside, the file is reopened so that writes go on appending to it.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err == nil {
+		err = rf.moveAside()
+	}
+	if openErr := rf.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (rf *RotatingFile) moveAside() error {
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(rf.backupName(i), rf.backupName(i+1))
+		}
+		return os.Rename(rf.path, rf.backupName(1))
+	}
+	return os.Remove(rf.path)
+}
+
+func (rf *RotatingFile) backupName(n int) string {
+	return fmt.Sprintf("%s.%d", rf.path, n)
+}
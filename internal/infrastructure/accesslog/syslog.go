@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// NewSyslogWriter connects to the syslog daemon. An empty network and address
+// use the local syslog socket.
+func NewSyslogWriter(network, address, tag string) (io.WriteCloser, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
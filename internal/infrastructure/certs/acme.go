@@ -0,0 +1,194 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrACMEStopped is returned by an ACME issuer after Stop.
+var ErrACMEStopped = errors.New("acme: issuer stopped")
+
+// ALPNProto is the protocol a CA offers when it validates a TLS-ALPN-01
+// challenge. Servers must include it in their NextProtos.
+const ALPNProto = acme.ALPNProto
+
+// ACMEOptions configure certificates obtained from an ACME CA. CAFile
+// replaces the system roots when connecting to DirectoryURL, for internal CAs
+// and test servers such as Pebble. Certificates and the account key are
+// stored in CacheDir. RenewBefore of an hour or less means 30 days.
+type ACMEOptions struct {
+	DirectoryURL string
+	CAFile       string
+	Email        string
+	Domains      []string
+	CacheDir     string
+	RenewBefore  time.Duration
+}
+
+// ACME obtains certificates for a fixed set of domains from an ACME CA and
+// renews them in the background before they expire. Both the HTTP-01 and the
+// TLS-ALPN-01 challenges are answered; the CA picks one.
+type ACME struct {
+	manager   *autocert.Manager
+	domains   map[string]bool
+	fallback  string
+	challenge http.Handler
+	stopped   *atomic.Bool
+}
+
+func NewACME(opts ACMEOptions) (*ACME, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CAFile != "" {
+		pool, err := LoadCAPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	stopped := new(atomic.Bool)
+	client := &acme.Client{
+		DirectoryURL: opts.DirectoryURL,
+		UserAgent:    "go-load-balancer",
+		HTTPClient:   &http.Client{Transport: &stoppableTransport{next: transport, stopped: stopped}},
+	}
+
+	a := &ACME{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       &stoppableCache{next: autocert.DirCache(opts.CacheDir), stopped: stopped},
+			HostPolicy:  autocert.HostWhitelist(opts.Domains...),
+			RenewBefore: opts.RenewBefore,
+			Email:       opts.Email,
+			Client:      client,
+		},
+		domains:  make(map[string]bool),
+		fallback: strings.ToLower(opts.Domains[0]),
+		stopped:  stopped,
+	}
+	for _, d := range opts.Domains {
+		a.domains[strings.ToLower(d)] = true
+	}
+	// Creating the handler is what enables HTTP-01 in autocert.
+	a.challenge = a.manager.HTTPHandler(http.NotFoundHandler())
+	return a, nil
+}
+
+// IsALPNChallenge reports whether the handshake is a TLS-ALPN-01
+// validation, which offers no protocol but ALPNProto.
+func IsALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto
+}
+
+// Handles reports whether the handshake is for one of the domains or is a
+// TLS-ALPN-01 validation by the CA.
+func (a *ACME) Handles(hello *tls.ClientHelloInfo) bool {
+	return IsALPNChallenge(hello) || a.domains[strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")]
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate that
+// is not cached yet is obtained during the handshake. Clients whose server
+// name is none of the domains get the certificate of the first domain.
+func (a *ACME) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !a.Handles(hello) {
+		h := *hello
+		h.ServerName = a.fallback
+		hello = &h
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// Obtain loads or obtains the certificates of all domains, which also
+// starts their renewal. ECDSA certificates are requested, as for handshakes
+// of current clients.
+func (a *ACME) Obtain() error {
+	var errs []error
+	for domain := range a.domains {
+		_, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HTTPHandler answers HTTP-01 challenges under /.well-known/acme-challenge/
+// and passes other requests to next.
+func (a *ACME) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The host policy does not expect a port, which listeners other
+		// than :80 see in the Host header.
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			r = r.Clone(r.Context())
+			r.Host = host
+		}
+		a.challenge.ServeHTTP(w, r)
+	})
+}
+
+// Stop ends renewals, for an issuer that is replaced or no longer used.
+// autocert cannot stop its renewal timers, so they are cut off instead:
+// they fail without reaching the CA or the cache, which other issuers for
+// the same directory share.
+func (a *ACME) Stop() {
+	a.stopped.Store(true)
+}
+
+type stoppableCache struct {
+	next    autocert.Cache
+	stopped *atomic.Bool
+}
+
+func (c *stoppableCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if c.stopped.Load() {
+		return nil, ErrACMEStopped
+	}
+	return c.next.Get(ctx, key)
+}
+
+func (c *stoppableCache) Put(ctx context.Context, key string, data []byte) error {
+	if c.stopped.Load() {
+		return ErrACMEStopped
+	}
+	return c.next.Put(ctx, key, data)
+}
+
+func (c *stoppableCache) Delete(ctx context.Context, key string) error {
+	if c.stopped.Load() {
+		return ErrACMEStopped
+	}
+	return c.next.Delete(ctx, key)
+}
+
+type stoppableTransport struct {
+	next    http.RoundTripper
+	stopped *atomic.Bool
+}
+
+func (t *stoppableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.stopped.Load() {
+		return nil, ErrACMEStopped
+	}
+	return t.next.RoundTrip(req)
+}
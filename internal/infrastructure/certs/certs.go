@@ -0,0 +1,154 @@
+// Package certs serves TLS certificates chosen by the SNI server name of a
+// connection and replaces them at runtime without dropping connections.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+// Pair names the PEM files of a certificate chain and its private key.
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Store holds the certificates currently served. It is safe for concurrent
+// use, and Load can be called while handshakes are in progress.
+type Store struct {
+	metrics *metrics.Metrics
+
+	// loadMu serializes loads, so that a Reload cannot overwrite the
+	// certificates of a concurrent Load with the previous ones.
+	loadMu sync.Mutex
+
+	mu    sync.RWMutex
+	pairs []Pair
+	set   *certSet
+}
+
+type Option func(*Store)
+
+// WithMetrics exports the expiry time of every loaded certificate.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *Store) {
+		s.metrics = m
+	}
+}
+
+func NewStore(opts ...Option) *Store {
+	s := &Store{set: &certSet{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// certSet indexes certificates by the names they are valid for. Wildcard
+// names are kept as is, e.g. "*.example.com".
+type certSet struct {
+	all    []*tls.Certificate
+	byName map[string][]*tls.Certificate
+}
+
+// Load reads pairs from disk and replaces the served certificates. If any pair
+// fails to load, the previous certificates are kept and the error is returned.
+func (s *Store) Load(pairs []Pair) error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+	return s.load(pairs)
+}
+
+// Reload reads the files of the last successful Load again.
+func (s *Store) Reload() error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+	s.mu.RLock()
+	pairs := s.pairs
+	s.mu.RUnlock()
+	return s.load(pairs)
+}
+
+func (s *Store) load(pairs []Pair) error {
+	set := &certSet{byName: make(map[string][]*tls.Certificate)}
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("certificate %s: %w", p.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("certificate %s: %w", p.CertFile, err)
+		}
+		cert.Leaf = leaf
+		set.add(&cert)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pairs = append([]Pair(nil), pairs...)
+	s.set = set
+	s.metrics.ResetCertificateExpiry()
+	for i, cert := range set.all {
+		s.metrics.SetCertificateExpiry(pairs[i].CertFile, cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// Files returns the certificate and key files of the last successful Load.
+func (s *Store) Files() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make([]string, 0, 2*len(s.pairs))
+	for _, p := range s.pairs {
+		files = append(files, p.CertFile, p.KeyFile)
+	}
+	return files
+}
+
+func (set *certSet) add(cert *tls.Certificate) {
+	set.all = append(set.all, cert)
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		set.byName[name] = append(set.byName[name], cert)
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate for the
+// exact server name is preferred over a wildcard one, and among those the
+// first one the client supports, so RSA and ECDSA certificates for the same
+// name can be served side by side. Without a match, the first certificate is
+// the default.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	set := s.set
+	s.mu.RUnlock()
+	if len(set.all) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	candidates := set.byName[name]
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		candidates = append(candidates[:len(candidates):len(candidates)], set.byName["*"+name[i:]]...)
+	}
+	for _, cert := range candidates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0], nil
+	}
+	return set.all[0], nil
+}
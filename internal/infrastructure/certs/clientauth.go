@@ -0,0 +1,111 @@
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// LoadCAPool reads a PEM bundle of CA certificates.
+func LoadCAPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+// Identity is what a client certificate says about its holder.
+type Identity struct {
+	Subject     string
+	CommonName  string
+	SANs        []string // prefixed by type, e.g. DNS:api.internal or URI:spiffe://...
+	Fingerprint string   // hex SHA-256 of the DER certificate
+}
+
+func IdentityOf(cert *x509.Certificate) Identity {
+	id := Identity{
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+	}
+	for _, name := range cert.DNSNames {
+		id.SANs = append(id.SANs, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		id.SANs = append(id.SANs, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		id.SANs = append(id.SANs, "URI:"+uri.String())
+	}
+	sum := sha256.Sum256(cert.Raw)
+	id.Fingerprint = hex.EncodeToString(sum[:])
+	return id
+}
+
+// Allowlist restricts client certificates to the listed subject alternative
+// names and common names. A certificate is allowed if it matches any entry
+// of either list; an empty allowlist allows every certificate. SANs are
+// written without a type prefix, and a DNS name entry may be a wildcard such
+// as *.internal.example.com, which matches a single label.
+type Allowlist struct {
+	SANs        []string
+	CommonNames []string
+}
+
+func (a Allowlist) Empty() bool {
+	return len(a.SANs) == 0 && len(a.CommonNames) == 0
+}
+
+// Check returns an error if cert is not allowed.
+func (a Allowlist) Check(cert *x509.Certificate) error {
+	if a.Empty() || slices.Contains(a.CommonNames, cert.Subject.CommonName) {
+		return nil
+	}
+	for _, allowed := range a.SANs {
+		if matchesSAN(cert, allowed) {
+			return nil
+		}
+	}
+	return errors.New("client certificate is not in the allowlist")
+}
+
+func matchesSAN(cert *x509.Certificate, allowed string) bool {
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if label, rest, found := strings.Cut(name, "."); found && label != "" && strings.EqualFold(rest, suffix) {
+				return true
+			}
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if strings.EqualFold(email, allowed) {
+			return true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == allowed {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == allowed {
+			return true
+		}
+	}
+	return false
+}
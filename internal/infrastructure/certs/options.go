@@ -0,0 +1,120 @@
+package certs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version such as "1.2".
+func ParseVersion(s string) (uint16, error) {
+	v, ok := versions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses cipher suite names as listed by tls.CipherSuites,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites with known security
+// issues are rejected. TLS 1.3 suites are not configurable and ignored.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	byName := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs
+	}
+	var ids []uint16
+	for _, name := range names {
+		cs, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			continue
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// TicketKeys rotates the session ticket keys of TLS configurations. Tickets
+// are issued with the newest key and accepted with the previous one too, so
+// a ticket stays valid for at least one rotation interval.
+type TicketKeys struct {
+	mu      sync.Mutex
+	keys    [][32]byte
+	configs []*tls.Config
+}
+
+// NewTicketKeys returns ticket keys starting with a random key.
+func NewTicketKeys() (*TicketKeys, error) {
+	k := &TicketKeys{}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Apply makes cfg use the keys, now and after every rotation.
+func (k *TicketKeys) Apply(cfg *tls.Config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.configs = append(k.configs, cfg)
+	cfg.SetSessionTicketKeys(k.keys)
+}
+
+// Release stops updating cfg.
+func (k *TicketKeys) Release(cfg *tls.Config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, c := range k.configs {
+		if c == cfg {
+			k.configs = append(k.configs[:i], k.configs[i+1:]...)
+			break
+		}
+	}
+}
+
+// Rotate generates a new key and drops the oldest one.
+func (k *TicketKeys) Rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([][32]byte{key}, k.keys...)
+	if len(k.keys) > 2 {
+		k.keys = k.keys[:2]
+	}
+	for _, cfg := range k.configs {
+		cfg.SetSessionTicketKeys(k.keys)
+	}
+	return nil
+}
+
+// Run rotates the keys every interval until ctx is done.
+func (k *TicketKeys) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := k.Rotate(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -45,8 +45,29 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 	}
 }
 
+func (cb *CircuitBreaker) State() State {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// Neutral marks err as an outcome that says nothing about the health of
+// what the breaker protects, such as every backend being busy. Execute
+// returns err without counting it as a success or a failure.
+func Neutral(err error) error {
+	return neutral{err}
+}
+
+type neutral struct{ err error }
+
+func (n neutral) Error() string { return n.err.Error() }
+func (n neutral) Unwrap() error { return n.err }
+
 func (cb *CircuitBreaker) executeClosed(fn func() error) error {
 	err := fn()
+	if n, ok := err.(neutral); ok {
+		return n.err
+	}
 	if err != nil {
 		cb.failures++
 		if cb.failures >= cb.threshold {
@@ -60,6 +81,9 @@ func (cb *CircuitBreaker) executeClosed(fn func() error) error {
 
 func (cb *CircuitBreaker) executeHalfOpen(fn func() error) error {
 	err := fn()
+	if n, ok := err.(neutral); ok {
+		return n.err
+	}
 	if err != nil {
 		cb.tripBreaker()
 	} else {
@@ -0,0 +1,68 @@
+package concurrency
+
+import (
+	"math"
+	"time"
+)
+
+// algorithm computes the next limit from the latency of a finished request.
+// inflight is the number of requests in flight when it was admitted.
+type algorithm interface {
+	update(limit float64, inflight int, rtt time.Duration, dropped bool) float64
+}
+
+const backoffRatio = 0.9
+
+// aimd grows the limit by one while it is in use and multiplies it by
+// backoffRatio when a request is dropped or slower than threshold.
+type aimd struct {
+	threshold time.Duration
+}
+
+func (a *aimd) update(limit float64, inflight int, rtt time.Duration, dropped bool) float64 {
+	if dropped || rtt > a.threshold {
+		return limit * backoffRatio
+	}
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+const (
+	gradientWindow    = 600 // samples averaged into the long-term latency
+	gradientTolerance = 1.5
+	gradientSmoothing = 0.2
+)
+
+// gradient follows Netflix's Gradient2: it compares each latency with a
+// long-term average and shrinks the limit in proportion once latency rises
+// beyond the tolerance, while leaving room for a queue of sqrt(limit)
+// requests at the backends so the limit can grow.
+type gradient struct {
+	longRTT float64
+}
+
+func (g *gradient) update(limit float64, inflight int, rtt time.Duration, dropped bool) float64 {
+	if dropped {
+		return limit * backoffRatio
+	}
+	short := float64(rtt)
+	if g.longRTT == 0 {
+		g.longRTT = short
+	} else {
+		g.longRTT += (short - g.longRTT) * 2 / (gradientWindow + 1)
+	}
+	if g.longRTT/short > 2 {
+		// Latency dropped well below the average, e.g. after an overload:
+		// let the average catch up faster.
+		g.longRTT *= 0.95
+	}
+	if float64(inflight) < limit/2 {
+		// Too little traffic to say whether a higher limit is safe.
+		return limit
+	}
+	grad := math.Max(0.5, math.Min(1, gradientTolerance*g.longRTT/short))
+	next := limit*grad + math.Sqrt(limit)
+	return limit*(1-gradientSmoothing) + next*gradientSmoothing
+}
@@ -0,0 +1,323 @@
+// Package concurrency limits the requests in flight to a pool to a limit that
+// adapts to the latency the backends show, in the manner of Netflix's
+// concurrency-limits. Requests over the limit wait in a bounded LIFO queue or
+// are shed.
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+var (
+	// ErrLimitExceeded is returned when the limit is reached and the queue
+	// is full of requests with at least the same priority.
+	ErrLimitExceeded = errors.New("concurrency limit exceeded")
+	// ErrEvicted is returned to a queued request that made room for one of
+	// higher priority.
+	ErrEvicted = errors.New("evicted from the queue by a request of higher priority")
+	// ErrQueueTimeout is returned when a request waited for QueueTimeout.
+	ErrQueueTimeout = errors.New("timed out waiting in the queue")
+)
+
+// Priority orders requests for shedding: the queue is served from the
+// highest priority, and a full queue evicts the lowest. The zero value is
+// Normal.
+type Priority int
+
+const (
+	Sheddable Priority = iota - 1
+	Normal
+	Critical
+)
+
+const numPriorities = int(Critical-Sheddable) + 1
+
+var priorityNames = [numPriorities]string{"sheddable", "normal", "critical"}
+
+func (p Priority) String() string {
+	if p < Sheddable || p > Critical {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p.index()]
+}
+
+func (p Priority) index() int {
+	return int(p - Sheddable)
+}
+
+// ParsePriority returns the priority called name, ignoring case.
+func ParsePriority(name string) (Priority, bool) {
+	for i, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return Sheddable + Priority(i), true
+		}
+	}
+	return Normal, false
+}
+
+// Options configure a Limiter. Zero values select the defaults.
+type Options struct {
+	// Algorithm is "gradient" (the default) or "aimd".
+	Algorithm string
+	// InitialLimit defaults to 20, MinLimit to 1 and MaxLimit to 1000.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// QueueSize is how many requests may wait for the limit; 0 sheds
+	// requests over the limit right away.
+	QueueSize int
+	// QueueTimeout bounds the wait in the queue, 1s by default.
+	QueueTimeout time.Duration
+	// LatencyThreshold makes the aimd algorithm treat slower requests as
+	// dropped, 1s by default.
+	LatencyThreshold time.Duration
+	// PriorityHeader, if set, names the header that carries the priority of
+	// a request.
+	PriorityHeader string
+}
+
+// Limiter admits up to its limit of requests at once. The limit is adjusted
+// after every request by the algorithm.
+type Limiter struct {
+	opts      Options
+	algorithm algorithm
+	metrics   *metrics.Metrics
+	pool      string
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	queued   int
+	queues   [numPriorities]list.List // of *waiter, oldest first
+}
+
+type waiter struct {
+	priority Priority
+	elem     *list.Element
+	inflight int
+	// done receives nil when the request is admitted or the reason it was
+	// shed.
+	done chan error
+}
+
+type Option func(*Limiter)
+
+// WithMetrics reports the limit, the queue and shed requests of pool.
+func WithMetrics(m *metrics.Metrics, pool string) Option {
+	return func(l *Limiter) {
+		l.metrics = m
+		l.pool = pool
+	}
+}
+
+func New(opts Options, options ...Option) (*Limiter, error) {
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = max(1000, opts.MinLimit)
+	}
+	if opts.InitialLimit <= 0 {
+		opts.InitialLimit = min(max(20, opts.MinLimit), opts.MaxLimit)
+	}
+	if opts.MinLimit > opts.MaxLimit || opts.InitialLimit < opts.MinLimit || opts.InitialLimit > opts.MaxLimit {
+		return nil, fmt.Errorf("limits must satisfy min %d <= initial %d <= max %d", opts.MinLimit, opts.InitialLimit, opts.MaxLimit)
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = time.Second
+	}
+	if opts.LatencyThreshold <= 0 {
+		opts.LatencyThreshold = time.Second
+	}
+	l := &Limiter{opts: opts, limit: float64(opts.InitialLimit)}
+	switch opts.Algorithm {
+	case "", "gradient":
+		l.algorithm = &gradient{}
+	case "aimd":
+		l.algorithm = &aimd{threshold: opts.LatencyThreshold}
+	default:
+		return nil, fmt.Errorf("unknown concurrency algorithm %q", opts.Algorithm)
+	}
+	for _, opt := range options {
+		opt(l)
+	}
+	return l, nil
+}
+
+// Options returns the options the limiter was created with, with defaults
+// filled in.
+func (l *Limiter) Options() Options {
+	return l.opts
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentLimit()
+}
+
+// Queued returns the number of requests waiting in the queue.
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+func (l *Limiter) currentLimit() int {
+	return int(l.limit)
+}
+
+// Priority returns the priority named by the priority header of r, or def
+// if it names none.
+func (l *Limiter) Priority(r *http.Request, def Priority) Priority {
+	if l.opts.PriorityHeader == "" {
+		return def
+	}
+	if p, ok := ParsePriority(r.Header.Get(l.opts.PriorityHeader)); ok {
+		return p
+	}
+	return def
+}
+
+// Acquire admits a request of priority p, waiting in the queue if the limit
+// is reached. The returned token must be released when the request is done.
+func (l *Limiter) Acquire(ctx context.Context, p Priority) (*Token, error) {
+	p = min(max(p, Sheddable), Critical)
+	l.mu.Lock()
+	if l.inflight < l.currentLimit() {
+		l.inflight++
+		t := &Token{l: l, inflight: l.inflight}
+		l.mu.Unlock()
+		return t, nil
+	}
+	if l.queued >= l.opts.QueueSize && !l.evict(p) {
+		l.mu.Unlock()
+		return nil, l.shed(p, ErrLimitExceeded)
+	}
+	w := &waiter{priority: p, done: make(chan error, 1)}
+	w.elem = l.queues[p.index()].PushBack(w)
+	l.queued++
+	l.metrics.SetConcurrency(l.pool, l.currentLimit(), l.queued)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	gaveUp := false
+	select {
+	case err = <-w.done:
+	case <-timer.C:
+		err, gaveUp = ErrQueueTimeout, true
+	case <-ctx.Done():
+		err, gaveUp = ctx.Err(), true
+	}
+	if gaveUp {
+		l.mu.Lock()
+		queued := w.elem != nil
+		if queued {
+			l.remove(w)
+		}
+		l.mu.Unlock()
+		if !queued {
+			// Admitted or evicted in the meantime.
+			err = <-w.done
+		}
+	}
+	switch {
+	case err == nil:
+		return &Token{l: l, inflight: w.inflight}, nil
+	case err == ctx.Err():
+		return nil, err
+	}
+	return nil, l.shed(p, err)
+}
+
+// evict sheds the oldest queued request with a priority lower than p and
+// reports whether there was one.
+func (l *Limiter) evict(p Priority) bool {
+	for q := Sheddable; q < p; q++ {
+		if front := l.queues[q.index()].Front(); front != nil {
+			w := front.Value.(*waiter)
+			l.remove(w)
+			w.done <- ErrEvicted
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Limiter) remove(w *waiter) {
+	l.queues[w.priority.index()].Remove(w.elem)
+	w.elem = nil
+	l.queued--
+	l.metrics.SetConcurrency(l.pool, l.currentLimit(), l.queued)
+}
+
+func (l *Limiter) shed(p Priority, err error) error {
+	reason := "limit"
+	switch err {
+	case ErrEvicted:
+		reason = "evicted"
+	case ErrQueueTimeout:
+		reason = "timeout"
+	}
+	l.metrics.IncConcurrencyShed(l.pool, p.String(), reason)
+	return err
+}
+
+// release ends a request and, if rtt is positive, adjusts the limit by its
+// latency. Freed capacity goes to the newest queued request of the highest
+// priority.
+func (l *Limiter) release(rtt time.Duration, dropped bool, inflight int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if rtt > 0 || dropped {
+		next := l.algorithm.update(l.limit, inflight, rtt, dropped)
+		l.limit = math.Max(float64(l.opts.MinLimit), math.Min(float64(l.opts.MaxLimit), next))
+	}
+	for p := Critical; p >= Sheddable && l.inflight < l.currentLimit(); {
+		back := l.queues[p.index()].Back()
+		if back == nil {
+			p--
+			continue
+		}
+		w := back.Value.(*waiter)
+		l.remove(w)
+		l.inflight++
+		w.inflight = l.inflight
+		w.done <- nil
+	}
+	l.metrics.SetConcurrency(l.pool, l.currentLimit(), l.queued)
+}
+
+// Token is an admitted request.
+type Token struct {
+	l        *Limiter
+	inflight int
+	once     sync.Once
+}
+
+// Release ends the request. rtt is how long the backend took to respond and
+// dropped reports a request that failed for lack of capacity, such as a
+// connection error or a 503. Calls after the first have no effect.
+func (t *Token) Release(rtt time.Duration, dropped bool) {
+	t.once.Do(func() { t.l.release(rtt, dropped, t.inflight) })
+}
+
+// Ignore ends a request that says nothing about the capacity of the
+// backends, such as one that never reached them.
+func (t *Token) Ignore() {
+	t.Release(0, false)
+}
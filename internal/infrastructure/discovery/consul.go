@@ -0,0 +1,285 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+// Service metadata keys that set server attributes rather than tags.
+const (
+	MetaScheme          = "scheme"
+	MetaHealthCheckPath = "health_check_path"
+	MetaWeight          = "weight"
+	MetaZone            = "zone"
+	MetaPriority        = "priority"
+	MetaMaxConnections  = "max_connections"
+)
+
+// ConsulOptions configure a ConsulProvider. Zero values select the defaults.
+type ConsulOptions struct {
+	// Address is the URL of the Consul agent, http://127.0.0.1:8500 by
+	// default.
+	Address string
+	// Service is the name of the service; only instances with Tag, if set,
+	// in Datacenter, if set, are used.
+	Service    string
+	Tag        string
+	Datacenter string
+	// Token is sent as X-Consul-Token.
+	Token string
+	// Scheme of the backend URLs, http by default.
+	Scheme string
+	// WaitTime bounds each blocking query, 5m by default.
+	WaitTime time.Duration
+	// Failed queries are retried after RetryInterval (1s), backing off to
+	// a minute.
+	RetryInterval time.Duration
+}
+
+// ConsulProvider tracks the instances of a Consul service with blocking
+// queries on the health endpoint, so changes are seen as they happen.
+// Instances with a critical or maintenance check are left out; those with a
+// warning are used with their warning weight, or left out if it is 0.
+//
+// The weight, zone, priority, max_connections, health_check_path and scheme
+// service metadata set the attributes of the servers; the weight otherwise
+// comes from the Consul weights of the service. Other metadata and tags
+// become tags of the servers, tags of the form key=value split in two. A
+// service without usable instances is an error, so that the servers stay in
+// use and are left to the health checks of the balancer.
+type ConsulProvider struct {
+	opts   ConsulOptions
+	url    string
+	client *http.Client
+}
+
+const maxConsulBackoff = time.Minute
+
+func NewConsulProvider(opts ConsulOptions) (*ConsulProvider, error) {
+	if opts.Service == "" {
+		return nil, errors.New("Consul service name is required")
+	}
+	if opts.Address == "" {
+		opts.Address = "http://127.0.0.1:8500"
+	}
+	u, err := url.Parse(opts.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Consul address %q", opts.Address)
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.WaitTime <= 0 {
+		opts.WaitTime = 5 * time.Minute
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	return &ConsulProvider{
+		opts: opts,
+		url:  strings.TrimSuffix(opts.Address, "/") + "/v1/health/service/" + url.PathEscape(opts.Service),
+		// Consul adds up to WaitTime/16 of jitter to a blocking query.
+		client: &http.Client{Timeout: opts.WaitTime + opts.WaitTime/16 + 10*time.Second},
+	}, nil
+}
+
+func (c *ConsulProvider) Run(ctx context.Context, updates chan<- Update) {
+	var index uint64
+	backoff := c.opts.RetryInterval
+	for {
+		servers, skipped, next, err := c.fetch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			send(ctx, updates, Update{Err: err})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxConsulBackoff)
+			continue
+		}
+		backoff = c.opts.RetryInterval
+		if index != 0 && next == index {
+			continue // the wait ended without a change
+		}
+		// The next query waits for a change after this answer, even if the
+		// index went backwards, as after a restore. Consul indexes start
+		// at 1.
+		index = max(next, 1)
+		if len(servers) == 0 {
+			send(ctx, updates, Update{Skipped: skipped, Err: fmt.Errorf("no usable instances of Consul service %q", c.opts.Service)})
+			continue
+		}
+		send(ctx, updates, Update{Servers: servers, Skipped: skipped})
+	}
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// fetch returns the usable instances and the index of the answer, waiting
+// for a change since index if it is not 0. Instances with invalid metadata
+// are skipped and reported, and of instances with the same address only the
+// first is used.
+func (c *ConsulProvider) fetch(ctx context.Context, index uint64) ([]*domain.Server, []error, uint64, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%dms", c.opts.WaitTime.Milliseconds()))
+	}
+	if c.opts.Tag != "" {
+		query.Set("tag", c.opts.Tag)
+	}
+	if c.opts.Datacenter != "" {
+		query.Set("dc", c.opts.Datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", c.opts.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("querying Consul: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, 0, fmt.Errorf("querying Consul: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("querying Consul: invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, nil, 0, fmt.Errorf("decoding Consul response: %w", err)
+	}
+
+	var servers []*domain.Server
+	var skipped []error
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		s, err := c.newServer(e)
+		switch {
+		case err != nil:
+			skipped = append(skipped, err)
+		case s != nil && !seen[s.URL.Host]:
+			seen[s.URL.Host] = true
+			servers = append(servers, s)
+		}
+	}
+	return servers, skipped, next, nil
+}
+
+// newServer returns the server of a usable instance, or nil.
+func (c *ConsulProvider) newServer(e consulEntry) (*domain.Server, error) {
+	weights := e.Service.Weights
+	if weights.Passing == 0 && weights.Warning == 0 {
+		// Not reported by older agents.
+		weights.Passing, weights.Warning = 1, 1
+	}
+	weight := max(1, weights.Passing)
+	for _, check := range e.Checks {
+		switch check.Status {
+		case "passing":
+		case "warning":
+			weight = weights.Warning
+		default:
+			return nil, nil
+		}
+	}
+	if weight <= 0 {
+		return nil, nil
+	}
+
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+	if host == "" {
+		return nil, fmt.Errorf("Consul instance on port %d has no address", e.Service.Port)
+	}
+	scheme := c.opts.Scheme
+	if v, ok := e.Service.Meta[MetaScheme]; ok {
+		scheme = v
+	}
+	s, err := domain.NewServer(scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("Consul instance %s:%d: %w", host, e.Service.Port, err)
+	}
+	s.Weight = weight
+	invalid := func(key, value string) error {
+		return fmt.Errorf("Consul instance %s: invalid %s metadata %q", s.URL.Host, key, value)
+	}
+	tag := func(key, value string) {
+		if s.Tags == nil {
+			s.Tags = make(map[string]string)
+		}
+		s.Tags[key] = value
+	}
+	for key, value := range e.Service.Meta {
+		switch key {
+		case MetaScheme:
+		case MetaHealthCheckPath:
+			if !strings.HasPrefix(value, "/") {
+				return nil, invalid(key, value)
+			}
+			s.HealthCheckPath = value
+		case MetaZone:
+			s.Zone = value
+		case MetaWeight, MetaPriority, MetaMaxConnections:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (key == MetaWeight && n < 1) {
+				return nil, invalid(key, value)
+			}
+			switch key {
+			case MetaWeight:
+				s.Weight = n
+			case MetaPriority:
+				s.Priority = n
+			default:
+				s.MaxConnections = n
+			}
+		default:
+			tag(key, value)
+		}
+	}
+	for _, t := range e.Service.Tags {
+		key, value, _ := strings.Cut(t, "=")
+		tag(key, value)
+	}
+	return s, nil
+}
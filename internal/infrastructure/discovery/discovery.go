@@ -0,0 +1,35 @@
+// Package discovery finds the backends of a pool at runtime, from sources
+// such as a targets file, instead of the static configuration.
+package discovery
+
+import (
+	"context"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+// Update is the outcome of a lookup: the complete set of backends, or the
+// error that kept the provider from getting it. The backends of the last
+// successful update should stay in use after an error. Skipped reports
+// backends left out of the set because their registration is invalid.
+type Update struct {
+	Servers []*domain.Server
+	Skipped []error
+	Err     error
+}
+
+// Provider watches a source of backends.
+type Provider interface {
+	// Run sends an Update on updates after every lookup, until ctx is done.
+	// The servers are new on every update; a consumer keeps the ones it
+	// already has.
+	Run(ctx context.Context, updates chan<- Update)
+}
+
+// send delivers u unless ctx is done first.
+func send(ctx context.Context, updates chan<- Update, u Update) {
+	select {
+	case updates <- u:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,261 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+// DNSOptions configure a DNSProvider. Zero values select the defaults.
+type DNSOptions struct {
+	// Name is the fully qualified name to resolve, such as
+	// _http._tcp.api.example.com for SRV records.
+	Name string
+	// Type is "A" (the default), "AAAA" or "SRV".
+	Type string
+	// Port of the backends at A and AAAA addresses. SRV records carry their
+	// own.
+	Port int
+	// Scheme of the backend URLs, http by default.
+	Scheme string
+	// Resolver is the host:port of the DNS server, by default the first
+	// nameserver in /etc/resolv.conf.
+	Resolver string
+	// The records are resolved again when their TTL expires, but no sooner
+	// than MinInterval (1s) and no later than MaxInterval (5m). Failed
+	// lookups are retried from MinInterval, backing off to MaxInterval.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Timeout bounds each query, 5s by default.
+	Timeout time.Duration
+}
+
+// DNSProvider resolves backends from A, AAAA or SRV records. SRV priority
+// and weight become the Priority and Weight of the servers, and SRV targets
+// are resolved to addresses through the additional section of the answer or
+// A queries. An answer without records is an error, so that the servers stay
+// in use, like after any other failed lookup.
+type DNSProvider struct {
+	opts   DNSOptions
+	qtype  uint16
+	client *dns.Client
+}
+
+func NewDNSProvider(opts DNSOptions) (*DNSProvider, error) {
+	if opts.Name == "" {
+		return nil, errors.New("DNS name is required")
+	}
+	opts.Name = dns.Fqdn(opts.Name)
+	if opts.Type == "" {
+		opts.Type = "A"
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.MinInterval <= 0 {
+		opts.MinInterval = time.Second
+	}
+	if opts.MaxInterval <= 0 {
+		opts.MaxInterval = max(5*time.Minute, opts.MinInterval)
+	}
+	if opts.MinInterval > opts.MaxInterval {
+		return nil, fmt.Errorf("min interval %s exceeds max interval %s", opts.MinInterval, opts.MaxInterval)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	d := &DNSProvider{opts: opts, client: &dns.Client{Timeout: opts.Timeout}}
+	switch strings.ToUpper(opts.Type) {
+	case "A":
+		d.qtype = dns.TypeA
+	case "AAAA":
+		d.qtype = dns.TypeAAAA
+	case "SRV":
+		d.qtype = dns.TypeSRV
+	default:
+		return nil, fmt.Errorf("unknown DNS record type %q", opts.Type)
+	}
+	if d.qtype != dns.TypeSRV && (opts.Port <= 0 || opts.Port > 65535) {
+		return nil, fmt.Errorf("a port is required for %s records", opts.Type)
+	}
+
+	if d.opts.Resolver == "" {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("reading resolver configuration: %w", err)
+		}
+		if len(conf.Servers) == 0 {
+			return nil, errors.New("no nameserver in /etc/resolv.conf")
+		}
+		d.opts.Resolver = net.JoinHostPort(conf.Servers[0], conf.Port)
+	} else if _, _, err := net.SplitHostPort(d.opts.Resolver); err != nil {
+		return nil, fmt.Errorf("resolver: %w", err)
+	}
+	return d, nil
+}
+
+func (d *DNSProvider) Run(ctx context.Context, updates chan<- Update) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	backoff := d.opts.MinInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		servers, ttl, err := d.lookup(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			send(ctx, updates, Update{Err: err})
+			timer.Reset(backoff)
+			backoff = min(backoff*2, d.opts.MaxInterval)
+			continue
+		}
+		send(ctx, updates, Update{Servers: servers})
+		backoff = d.opts.MinInterval
+		timer.Reset(min(max(ttl, d.opts.MinInterval), d.opts.MaxInterval))
+	}
+}
+
+// lookup resolves the servers and returns them with the lowest TTL of the
+// records they came from.
+func (d *DNSProvider) lookup(ctx context.Context) ([]*domain.Server, time.Duration, error) {
+	answer, err := d.query(ctx, d.opts.Name, d.qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := time.Duration(-1)
+	observe := func(rr dns.RR) {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	var servers []*domain.Server
+	seen := make(map[string]bool)
+	add := func(host string, port, priority, weight int) error {
+		u := d.opts.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+		if seen[u] {
+			return nil
+		}
+		seen[u] = true
+		s, err := domain.NewServer(u)
+		if err != nil {
+			return err
+		}
+		s.Priority = priority
+		s.Weight = max(1, weight)
+		servers = append(servers, s)
+		return nil
+	}
+
+	for _, rr := range answer.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if d.qtype != dns.TypeA {
+				continue
+			}
+			observe(rr)
+			if err := add(rr.A.String(), d.opts.Port, 0, 1); err != nil {
+				return nil, 0, err
+			}
+		case *dns.AAAA:
+			if d.qtype != dns.TypeAAAA {
+				continue
+			}
+			observe(rr)
+			if err := add(rr.AAAA.String(), d.opts.Port, 0, 1); err != nil {
+				return nil, 0, err
+			}
+		case *dns.SRV:
+			observe(rr)
+			hosts, err := d.targetAddresses(ctx, rr.Target, answer.Extra, observe)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, host := range hosts {
+				if err := add(host, int(rr.Port), int(rr.Priority), int(rr.Weight)); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no %s records for %s", d.opts.Type, d.opts.Name)
+	}
+	return servers, ttl, nil
+}
+
+// targetAddresses returns the addresses of an SRV target from the additional
+// section, or else from an A query. A target with no addresses is used by
+// name.
+func (d *DNSProvider) targetAddresses(ctx context.Context, target string, extra []dns.RR, observe func(dns.RR)) ([]string, error) {
+	var hosts []string
+	collect := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				observe(rr)
+				hosts = append(hosts, rr.A.String())
+			case *dns.AAAA:
+				observe(rr)
+				hosts = append(hosts, rr.AAAA.String())
+			}
+		}
+	}
+	collect(extra)
+	if len(hosts) > 0 {
+		return hosts, nil
+	}
+	answer, err := d.query(ctx, target, dns.TypeA)
+	if err != nil && !errors.Is(err, errNoSuchName) {
+		return nil, err
+	}
+	if answer != nil {
+		collect(answer.Answer)
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, strings.TrimSuffix(target, "."))
+	}
+	return hosts, nil
+}
+
+var errNoSuchName = errors.New("no such name")
+
+// query sends a query over UDP, and again over TCP if the answer was
+// truncated.
+func (d *DNSProvider) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	answer, _, err := d.client.ExchangeContext(ctx, m, d.opts.Resolver)
+	if err == nil && answer.Truncated {
+		tcp := &dns.Client{Net: "tcp", Timeout: d.opts.Timeout}
+		answer, _, err = tcp.ExchangeContext(ctx, m, d.opts.Resolver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s %s: %w", dns.TypeToString[qtype], name, err)
+	}
+	switch answer.Rcode {
+	case dns.RcodeSuccess:
+		return answer, nil
+	case dns.RcodeNameError:
+		return nil, fmt.Errorf("resolving %s %s: %w", dns.TypeToString[qtype], name, errNoSuchName)
+	}
+	return nil, fmt.Errorf("resolving %s %s: %s", dns.TypeToString[qtype], name, dns.RcodeToString[answer.Rcode])
+}
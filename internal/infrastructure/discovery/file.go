@@ -0,0 +1,220 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"gopkg.in/yaml.v3"
+)
+
+// Labels of a target group that set server attributes rather than tags.
+const (
+	LabelScheme          = "__scheme__"
+	LabelHealthCheckPath = "__health_check_path__"
+	LabelWeight          = "__weight__"
+	LabelZone            = "__zone__"
+	LabelPriority        = "__priority__"
+	LabelMaxConnections  = "__max_connections__"
+)
+
+// FileOptions configure a FileProvider. Zero durations select the defaults.
+type FileOptions struct {
+	Path string
+	// Debounce coalesces bursts of changes to the file, 500ms by default.
+	Debounce time.Duration
+	// RefreshInterval re-reads the file even if no change was seen, for
+	// filesystems without change notifications, 5m by default.
+	RefreshInterval time.Duration
+}
+
+// FileProvider reads backends from a JSON or YAML file of target groups in
+// the format of Prometheus file_sd:
+//
+//	[{"targets": ["10.0.0.1:8080"], "labels": {"__scheme__": "https", "env": "prod"}}]
+//
+// Targets are host:port. The __scheme__ (http by default),
+// __health_check_path__, __weight__, __zone__, __priority__ and
+// __max_connections__ labels set the attributes of the servers, other labels
+// become their tags. The file is read again whenever it changes.
+type FileProvider struct {
+	opts FileOptions
+}
+
+func NewFileProvider(opts FileOptions) (*FileProvider, error) {
+	if opts.Path == "" {
+		return nil, errors.New("targets file path is required")
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = 500 * time.Millisecond
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 5 * time.Minute
+	}
+	return &FileProvider{opts: opts}, nil
+}
+
+func (f *FileProvider) Run(ctx context.Context, updates chan<- Update) {
+	path := filepath.Clean(f.opts.Path)
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	// The directory is watched so that files replaced by renaming, as most
+	// tools write them, are seen.
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		send(ctx, updates, Update{Err: fmt.Errorf("watching %s, reading it every %s instead: %w", path, f.opts.RefreshInterval, err)})
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	send(ctx, updates, f.read())
+	refresh := time.NewTicker(f.opts.RefreshInterval)
+	defer refresh.Stop()
+	debounce := time.NewTimer(0)
+	<-debounce.C
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) {
+				continue
+			}
+			debounce.Reset(f.opts.Debounce)
+			fire = debounce.C
+		case err, ok := <-watchErrors:
+			if !ok {
+				watchErrors = nil
+				continue
+			}
+			send(ctx, updates, Update{Err: fmt.Errorf("watching %s: %w", path, err)})
+		case <-fire:
+			fire = nil
+			send(ctx, updates, f.read())
+		case <-refresh.C:
+			send(ctx, updates, f.read())
+		}
+	}
+}
+
+func (f *FileProvider) read() Update {
+	data, err := os.ReadFile(f.opts.Path)
+	if err != nil {
+		return Update{Err: err}
+	}
+	servers, err := ParseTargets(data)
+	if err != nil {
+		return Update{Err: fmt.Errorf("%s: %w", f.opts.Path, err)}
+	}
+	return Update{Servers: servers}
+}
+
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// ParseTargets parses target groups in JSON or YAML. An empty document is an
+// error, as it is most likely a file caught while being written; a file
+// without backends holds an empty list.
+func ParseTargets(data []byte) ([]*domain.Server, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("empty targets file")
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var groups []targetGroup
+	if err := dec.Decode(&groups); err != nil {
+		return nil, err
+	}
+
+	var servers []*domain.Server
+	seen := make(map[string]bool)
+	for i, g := range groups {
+		for _, target := range g.Targets {
+			s, err := newTarget(target, g.Labels)
+			if err != nil {
+				return nil, fmt.Errorf("group %d: %w", i, err)
+			}
+			if seen[s.URL.String()] {
+				return nil, fmt.Errorf("group %d: duplicate target %s", i, s.URL)
+			}
+			seen[s.URL.String()] = true
+			servers = append(servers, s)
+		}
+	}
+	return servers, nil
+}
+
+func newTarget(target string, labels map[string]string) (*domain.Server, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("target %q: %w", target, err)
+	}
+	scheme := "http"
+	if v, ok := labels[LabelScheme]; ok {
+		scheme = v
+	}
+	switch scheme {
+	case "http", "https", "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("target %q: unknown scheme %q", target, scheme)
+	}
+	s, err := domain.NewServer(scheme + "://" + target)
+	if err != nil {
+		return nil, fmt.Errorf("target %q: %w", target, err)
+	}
+	for name, value := range labels {
+		switch name {
+		case LabelScheme:
+		case LabelHealthCheckPath:
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("target %q: label %s must start with /", target, name)
+			}
+			s.HealthCheckPath = value
+		case LabelZone:
+			s.Zone = value
+		case LabelWeight, LabelPriority, LabelMaxConnections:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (name == LabelWeight && n < 1) {
+				return nil, fmt.Errorf("target %q: invalid %s %q", target, name, value)
+			}
+			switch name {
+			case LabelWeight:
+				s.Weight = n
+			case LabelPriority:
+				s.Priority = n
+			default:
+				s.MaxConnections = n
+			}
+		default:
+			if strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("target %q: unknown label %s", target, name)
+			}
+			if s.Tags == nil {
+				s.Tags = make(map[string]string)
+			}
+			s.Tags[name] = value
+		}
+	}
+	return s, nil
+}
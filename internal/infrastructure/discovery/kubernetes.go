@@ -0,0 +1,407 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// Priorities of Kubernetes endpoints: ready endpoints hinted for the zone of
+// the balancer, other ready endpoints, and terminating endpoints that are
+// still serving, which only take requests when no others are available.
+const (
+	PriorityReady       = 0
+	PriorityOtherZone   = 1
+	PriorityTerminating = 2
+)
+
+// KubernetesOptions configure a KubernetesProvider. Zero values select the
+// in-cluster defaults.
+type KubernetesOptions struct {
+	// APIServer is the URL of the API server, by default taken from
+	// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT, in which case
+	// TokenFile, CAFile and Namespace default to those of the service
+	// account of the pod.
+	APIServer string
+	TokenFile string
+	CAFile    string
+	// Namespace and Service name the Kubernetes service.
+	Namespace string
+	Service   string
+	// Port is the name of the port of the service to use, by default the
+	// first one.
+	Port string
+	// Scheme of the backend URLs, http by default.
+	Scheme string
+	// Zone, if set, is the zone of the balancer, preferring endpoints the
+	// topology hints assign to it.
+	Zone string
+	// Failed requests are retried after RetryInterval (1s), backing off to
+	// 30s.
+	RetryInterval time.Duration
+}
+
+// KubernetesProvider watches the EndpointSlices of a service. Ready
+// endpoints are used; terminating endpoints that are still serving are
+// drained: they get PriorityTerminating, so they only take new requests when
+// no ready endpoint is available, until they stop serving. With a Zone, the
+// topology hints are followed like kube-proxy does, if every ready endpoint
+// has them and some are for Zone: endpoints hinted for other zones get
+// PriorityOtherZone.
+type KubernetesProvider struct {
+	opts   KubernetesOptions
+	url    string
+	client *http.Client
+}
+
+const maxKubernetesBackoff = 30 * time.Second
+
+// errExpired means the resource version of a watch is too old, after which
+// the slices are listed again.
+var errExpired = errors.New("resource version expired")
+
+func NewKubernetesProvider(opts KubernetesOptions) (*KubernetesProvider, error) {
+	if opts.Service == "" {
+		return nil, errors.New("Kubernetes service name is required")
+	}
+	if opts.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a cluster: set the API server")
+		}
+		opts.APIServer = "https://" + net.JoinHostPort(host, port)
+		if opts.TokenFile == "" {
+			opts.TokenFile = serviceAccountDir + "token"
+		}
+		if opts.CAFile == "" {
+			opts.CAFile = serviceAccountDir + "ca.crt"
+		}
+		if opts.Namespace == "" {
+			if ns, err := os.ReadFile(serviceAccountDir + "namespace"); err == nil {
+				opts.Namespace = strings.TrimSpace(string(ns))
+			}
+		}
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	u, err := url.Parse(opts.APIServer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid API server %q", opts.APIServer)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", opts.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &KubernetesProvider{
+		opts: opts,
+		url: strings.TrimSuffix(opts.APIServer, "/") + "/apis/discovery.k8s.io/v1/namespaces/" +
+			url.PathEscape(opts.Namespace) + "/endpointslices",
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (k *KubernetesProvider) Run(ctx context.Context, updates chan<- Update) {
+	backoff := k.opts.RetryInterval
+	for {
+		listed, err := k.listAndWatch(ctx, updates)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errExpired) {
+			continue
+		}
+		if listed {
+			backoff = k.opts.RetryInterval
+		}
+		send(ctx, updates, Update{Err: err})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxKubernetesBackoff)
+	}
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		Hints *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+		NodeName  string `json:"nodeName"`
+		Zone      string `json:"zone"`
+		TargetRef *struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port *int   `json:"port"`
+	} `json:"ports"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// listAndWatch lists the slices of the service and then follows their
+// changes, sending the servers after each, until the watch fails. It reports
+// whether the list succeeded.
+func (k *KubernetesProvider) listAndWatch(ctx context.Context, updates chan<- Update) (bool, error) {
+	query := url.Values{"labelSelector": {"kubernetes.io/service-name=" + k.opts.Service}}
+	resp, err := k.get(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("decoding EndpointSlices: %w", err)
+	}
+	current := make(map[string]endpointSlice)
+	for _, s := range list.Items {
+		current[s.Metadata.Name] = s
+	}
+	k.send(ctx, updates, current)
+
+	version := list.Metadata.ResourceVersion
+	for {
+		query.Set("watch", "true")
+		query.Set("allowWatchBookmarks", "true")
+		query.Set("resourceVersion", version)
+		query.Set("timeoutSeconds", "300")
+		resp, err := k.get(ctx, query)
+		if err != nil {
+			return true, err
+		}
+		version, err = k.watch(ctx, resp.Body, version, current, updates)
+		resp.Body.Close()
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// watch applies the events of a watch to current until the API server ends
+// it, and returns the last resource version seen.
+func (k *KubernetesProvider) watch(ctx context.Context, body io.Reader, version string, current map[string]endpointSlice, updates chan<- Update) (string, error) {
+	dec := json.NewDecoder(body)
+	for {
+		var event watchEvent
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return version, nil
+			}
+			return version, fmt.Errorf("watching EndpointSlices: %w", err)
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errExpired
+			}
+			return version, fmt.Errorf("watching EndpointSlices: %s", status.Message)
+		}
+		var s endpointSlice
+		if err := json.Unmarshal(event.Object, &s); err != nil {
+			return version, fmt.Errorf("decoding EndpointSlice: %w", err)
+		}
+		version = s.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			current[s.Metadata.Name] = s
+		case "DELETED":
+			delete(current, s.Metadata.Name)
+		default: // BOOKMARK
+			continue
+		}
+		k.send(ctx, updates, current)
+	}
+}
+
+func (k *KubernetesProvider) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.opts.TokenFile != "" {
+		// Read every time, as service account tokens are rotated.
+		token, err := os.ReadFile(k.opts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying EndpointSlices: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errExpired
+		}
+		return nil, fmt.Errorf("querying EndpointSlices: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// send sends the servers of slices, even none: a service scaled to zero has
+// no endpoints, and the addresses of deleted pods go to other pods.
+func (k *KubernetesProvider) send(ctx context.Context, updates chan<- Update, slices map[string]endpointSlice) {
+	send(ctx, updates, Update{Servers: k.servers(slices)})
+}
+
+// servers returns the servers of the usable endpoints in slices. An endpoint
+// in more than one slice, as while it moves between them, is used once.
+func (k *KubernetesProvider) servers(slices map[string]endpointSlice) []*domain.Server {
+	type endpoint struct {
+		server      *domain.Server
+		hinted      bool
+		forZone     bool
+		terminating bool
+	}
+	var endpoints []*endpoint
+	byURL := make(map[string]*endpoint)
+	useHints := k.opts.Zone != ""
+	for _, slice := range slices {
+		port := k.port(slice)
+		if port == 0 || (slice.AddressType != "IPv4" && slice.AddressType != "IPv6" && slice.AddressType != "FQDN") {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			c := ep.Conditions
+			terminating := c.Terminating != nil && *c.Terminating
+			// Unknown conditions count as ready, as in Kubernetes.
+			ready := c.Ready == nil || *c.Ready
+			serving := ready
+			if c.Serving != nil {
+				serving = *c.Serving
+			}
+			if len(ep.Addresses) == 0 || (!ready && !(terminating && serving)) {
+				continue
+			}
+			s, err := domain.NewServer(k.opts.Scheme + "://" + net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port)))
+			if err != nil {
+				continue
+			}
+			s.Zone = ep.Zone
+			if ep.NodeName != "" || ep.TargetRef != nil {
+				s.Tags = make(map[string]string)
+				if ep.NodeName != "" {
+					s.Tags["node"] = ep.NodeName
+				}
+				if ep.TargetRef != nil {
+					s.Tags["pod"] = ep.TargetRef.Name
+				}
+			}
+			e := &endpoint{server: s, terminating: !ready}
+			if ep.Hints != nil {
+				e.hinted = true
+				for _, z := range ep.Hints.ForZones {
+					e.forZone = e.forZone || z.Name == k.opts.Zone
+				}
+			}
+
+			u := s.URL.String()
+			if prev, ok := byURL[u]; ok {
+				if prev.terminating && !e.terminating {
+					*prev = *e
+				}
+				continue
+			}
+			byURL[u] = e
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	// Hints are only followed if every ready endpoint has them and some are
+	// for the zone of the balancer.
+	anyForZone := false
+	for _, e := range endpoints {
+		if !e.terminating {
+			useHints = useHints && e.hinted
+			anyForZone = anyForZone || e.forZone
+		}
+	}
+	useHints = useHints && anyForZone
+
+	servers := make([]*domain.Server, 0, len(endpoints))
+	for _, e := range endpoints {
+		switch {
+		case e.terminating:
+			e.server.Priority = PriorityTerminating
+		case useHints && !e.forZone:
+			e.server.Priority = PriorityOtherZone
+		default:
+			e.server.Priority = PriorityReady
+		}
+		servers = append(servers, e.server)
+	}
+	return servers
+}
+
+// port returns the number of the configured port in slice, or 0.
+func (k *KubernetesProvider) port(slice endpointSlice) int {
+	for _, p := range slice.Ports {
+		if p.Port != nil && (k.opts.Port == "" || p.Name == k.opts.Port) {
+			return *p.Port
+		}
+	}
+	return 0
+}
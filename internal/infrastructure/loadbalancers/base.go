@@ -12,31 +12,40 @@ type BaseLoadBalancer struct {
 	mu      sync.RWMutex
 }
 
+// UpdateServer gives the server with the URL of server the attributes of
+// server. It keeps its state and connections, which requests in flight on it
+// still count.
 func (b *BaseLoadBalancer) UpdateServer(server *domain.Server) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	for i, s := range b.servers {
+	for _, s := range b.servers {
 		if s.URL.String() == server.URL.String() {
-			b.servers[i] = server
+			if s != server {
+				s.SetAttributes(server)
+			}
 			break
 		}
 	}
 }
 
+// HealthCheck checks all servers concurrently and returns once every check
+// has finished. The servers are not locked meanwhile, so slow checks do not
+// hold up picking or changing servers.
 func (b *BaseLoadBalancer) HealthCheck(ctx context.Context) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
-	for _, server := range b.servers {
+	var wg sync.WaitGroup
+	for _, server := range b.GetServers() {
+		wg.Add(1)
 		go func(s *domain.Server) {
-			if err := s.HealthCheck(); err != nil {
+			defer wg.Done()
+			if err := s.HealthCheckContext(ctx); err != nil {
 				s.Active.Store(false)
 			} else {
 				s.Active.Store(true)
 			}
 		}(server)
 	}
+	wg.Wait()
 }
 
 func (b *BaseLoadBalancer) AddServer(server *domain.Server) error {
@@ -62,4 +71,31 @@ func (b *BaseLoadBalancer) GetServers() []*domain.Server {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return append([]*domain.Server{}, b.servers...)
-}
\ No newline at end of file
+}
+
+// available returns the servers that can take a request: those that are
+// active and below their connection cap, limited to the lowest priority
+// present among them. The caller must hold b.mu.
+func (b *BaseLoadBalancer) available() []*domain.Server {
+	servers := make([]*domain.Server, 0, len(b.servers))
+	for _, server := range b.servers {
+		if !server.Available() {
+			continue
+		}
+		if len(servers) > 0 && server.Priority != servers[0].Priority {
+			if server.Priority > servers[0].Priority {
+				continue
+			}
+			servers = servers[:0]
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func weight(s *domain.Server) int64 {
+	if s.Weight < 1 {
+		return 1
+	}
+	return int64(s.Weight)
+}
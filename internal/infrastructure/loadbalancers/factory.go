@@ -0,0 +1,27 @@
+package loadbalancers
+
+import (
+	"fmt"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+// Algorithms lists the names accepted by New.
+var Algorithms = []string{"round-robin", "least-connections", "weighted-response-time", "ip-hash", "consistent-hash"}
+
+func New(algorithm string, servers []*domain.Server) (domain.LoadBalancer, error) {
+	switch algorithm {
+	case "round-robin":
+		return NewRoundRobin(servers), nil
+	case "least-connections":
+		return NewLeastConnections(servers), nil
+	case "weighted-response-time":
+		return NewWeightedResponseTime(servers), nil
+	case "ip-hash":
+		return NewIPHash(servers), nil
+	case "consistent-hash":
+		return NewConsistentHash(servers), nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm: %s", algorithm)
+	}
+}
@@ -0,0 +1,81 @@
+package loadbalancers
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+// IPHash maps the hash key of a request, see domain.WithHashKey, onto the
+// available servers by modulo. Requests without a key are balanced round
+// robin.
+type IPHash struct {
+	RoundRobin
+}
+
+func NewIPHash(servers []*domain.Server) *IPHash {
+	return &IPHash{RoundRobin: RoundRobin{BaseLoadBalancer: BaseLoadBalancer{servers: servers}}}
+}
+
+func (h *IPHash) NextServer(ctx context.Context) (*domain.Server, error) {
+	key, ok := domain.HashKey(ctx)
+	if !ok {
+		return h.RoundRobin.NextServer(ctx)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	servers := h.available()
+	if len(servers) == 0 {
+		return nil, ErrNoServersAvailable
+	}
+	return servers[hashString(key)%uint64(len(servers))], nil
+}
+
+// ConsistentHash picks servers by weighted rendezvous hashing: every server
+// scores the key and the highest score wins. Adding or removing a server only
+// moves the keys that it wins or won. Requests without a key are balanced
+// round robin.
+type ConsistentHash struct {
+	RoundRobin
+}
+
+func NewConsistentHash(servers []*domain.Server) *ConsistentHash {
+	return &ConsistentHash{RoundRobin: RoundRobin{BaseLoadBalancer: BaseLoadBalancer{servers: servers}}}
+}
+
+func (h *ConsistentHash) NextServer(ctx context.Context) (*domain.Server, error) {
+	key, ok := domain.HashKey(ctx)
+	if !ok {
+		return h.RoundRobin.NextServer(ctx)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	servers := h.available()
+	if len(servers) == 0 {
+		return nil, ErrNoServersAvailable
+	}
+
+	var best *domain.Server
+	bestScore := math.Inf(-1)
+	for _, s := range servers {
+		// Map the hash into (0, 1) and weight it as in Schindelhauer's
+		// weighted rendezvous hashing: score = -w / ln(h).
+		u := (float64(hashString(s.URL.String()+"\x00"+key)>>11) + 0.5) / (1 << 53)
+		if score := -float64(weight(s)) / math.Log(u); score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best, nil
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
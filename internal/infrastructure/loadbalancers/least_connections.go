@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
 	"sort"
+	"sync/atomic"
 )
 
 type LeastConnections struct {
@@ -22,19 +23,16 @@ func (lc *LeastConnections) NextServer(ctx context.Context) (*domain.Server, err
 		return nil, ErrNoServersAvailable
 	}
 
-	activeServers := make([]*domain.Server, 0, len(lc.servers))
-	for _, server := range lc.servers {
-		if server.Active.Load() {
-			activeServers = append(activeServers, server)
-		}
-	}
-
+	activeServers := lc.available()
 	if len(activeServers) == 0 {
 		return nil, ErrNoServersAvailable
 	}
 
+	// Compare connections per unit of weight without dividing.
 	sort.Slice(activeServers, func(i, j int) bool {
-		return activeServers[i].Connections < activeServers[j].Connections
+		ci := atomic.LoadInt64(&activeServers[i].Connections)
+		cj := atomic.LoadInt64(&activeServers[j].Connections)
+		return ci*weight(activeServers[j]) < cj*weight(activeServers[i])
 	})
 
 	return activeServers[0], nil
@@ -3,12 +3,18 @@ package loadbalancers
 import (
 	"context"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"sync"
 	"sync/atomic"
 )
 
 type RoundRobin struct {
 	BaseLoadBalancer
 	current int64
+
+	// weights holds the smooth weighted round robin state, used when the
+	// candidate servers do not all have the same weight.
+	weightsMu sync.Mutex
+	weights   map[*domain.Server]int64
 }
 
 func NewRoundRobin(servers []*domain.Server) *RoundRobin {
@@ -19,17 +25,54 @@ func (rr *RoundRobin) NextServer(ctx context.Context) (*domain.Server, error) {
 	rr.mu.RLock()
 	defer rr.mu.RUnlock()
 
-	if len(rr.servers) == 0 {
+	servers := rr.available()
+	if len(servers) == 0 {
 		return nil, ErrNoServersAvailable
 	}
 
-	startIndex := int(atomic.AddInt64(&rr.current, 1) % int64(len(rr.servers)))
-	for i := 0; i < len(rr.servers); i++ {
-		index := (startIndex + i) % len(rr.servers)
-		if rr.servers[index].Active.Load() {
-			return rr.servers[index], nil
+	for _, s := range servers[1:] {
+		if weight(s) != weight(servers[0]) {
+			return rr.nextWeighted(servers), nil
+		}
+	}
+
+	index := int(atomic.AddInt64(&rr.current, 1) % int64(len(servers)))
+	return servers[index], nil
+}
+
+// nextWeighted picks the server with the highest current weight after adding
+// each server's weight to it, then lowers the winner by the total. This
+// spreads picks evenly instead of sending bursts to the heaviest server.
+func (rr *RoundRobin) nextWeighted(servers []*domain.Server) *domain.Server {
+	rr.weightsMu.Lock()
+	defer rr.weightsMu.Unlock()
+
+	if rr.weights == nil {
+		rr.weights = make(map[*domain.Server]int64)
+	}
+	var total int64
+	var best *domain.Server
+	for _, s := range servers {
+		rr.weights[s] += weight(s)
+		total += weight(s)
+		if best == nil || rr.weights[s] > rr.weights[best] {
+			best = s
 		}
 	}
+	rr.weights[best] -= total
+	return best
+}
 
-	return nil, ErrNoServersAvailable
+func (rr *RoundRobin) RemoveServer(url string) error {
+	if err := rr.BaseLoadBalancer.RemoveServer(url); err != nil {
+		return err
+	}
+	rr.weightsMu.Lock()
+	defer rr.weightsMu.Unlock()
+	for s := range rr.weights {
+		if s.URL.String() == url {
+			delete(rr.weights, s)
+		}
+	}
+	return nil
 }
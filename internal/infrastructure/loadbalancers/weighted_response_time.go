@@ -22,19 +22,14 @@ func (wrt *WeightedResponseTime) NextServer(ctx context.Context) (*domain.Server
 		return nil, ErrNoServersAvailable
 	}
 
-	activeServers := make([]*domain.Server, 0, len(wrt.servers))
-	for _, server := range wrt.servers {
-		if server.Active.Load() {
-			activeServers = append(activeServers, server)
-		}
-	}
-
+	activeServers := wrt.available()
 	if len(activeServers) == 0 {
 		return nil, ErrNoServersAvailable
 	}
 
 	sort.Slice(activeServers, func(i, j int) bool {
-		return activeServers[i].ResponseTime < activeServers[j].ResponseTime
+		return int64(activeServers[i].ResponseTime)*weight(activeServers[j]) <
+			int64(activeServers[j].ResponseTime)*weight(activeServers[i])
 	})
 
 	return activeServers[0], nil
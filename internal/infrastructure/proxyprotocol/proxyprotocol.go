@@ -0,0 +1,161 @@
+// Package proxyprotocol reads and writes PROXY protocol v1 and v2 headers,
+// which carry the original client address across layer-4 proxies.
+package proxyprotocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// The dialer settings of http.DefaultTransport.
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// ParseTrusted parses IP addresses and CIDR ranges.
+func ParseTrusted(sources []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(sources))
+	for _, s := range sources {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// NewListener wraps ln so that connections from trusted sources may start
+// with a PROXY protocol header, whose source address then becomes the
+// connection's RemoteAddr. Connections from other sources that send a header
+// fail on their first read.
+func NewListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &listener{Listener: &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			// Never return an error here: it would fail Accept and stop
+			// the server.
+			if addr, ok := upstream.(*net.TCPAddr); ok {
+				for _, n := range trusted {
+					if n.Contains(addr.IP) {
+						return proxyproto.USE, nil
+					}
+				}
+			}
+			return proxyproto.REJECT, nil
+		},
+	}}
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		return &conn{Conn: pc}, nil
+	}
+	return c, nil
+}
+
+// conn adds CloseWrite, which proxyproto.Conn lacks, so TCP half-close still
+// works on accepted connections.
+type conn struct {
+	*proxyproto.Conn
+}
+
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Raw().(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// WriteHeader writes a version 1 or 2 header announcing a connection from src
+// to dst. Without addresses, it announces a connection of the proxy itself:
+// a LOCAL command in version 2 and UNKNOWN in version 1.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	if version != 1 && version != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := proxyproto.HeaderProxyFromAddrs(byte(version), src, dst).WriteTo(w)
+	return err
+}
+
+type headerContextKey struct{}
+
+type header struct {
+	version  int
+	src, dst net.Addr
+}
+
+// WithHeader returns a context that makes connections dialed by a transport
+// from NewTransport start with a PROXY protocol header for r's client.
+func WithHeader(r *http.Request, version int) context.Context {
+	src, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return r.Context()
+	}
+	dst, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if dst == nil {
+		dst = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return context.WithValue(r.Context(), headerContextKey{}, header{version: version, src: src, dst: dst})
+}
+
+// WithLocalHeader returns a context that makes connections dialed by a
+// transport from NewTransport, or by DialContext, start with a header for
+// a connection of the proxy itself, as for health checks.
+func WithLocalHeader(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, headerContextKey{}, header{version: version})
+}
+
+// NewTransport returns a clone of http.DefaultTransport that writes the
+// header of WithHeader on new connections. Such requests must not share
+// connections with other clients, so they should be sent with Close set.
+func NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = DialContext
+	return t
+}
+
+// DialContext dials addr like the transports of NewTransport, writing the
+// header requested through ctx, if any.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := (&net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAlive}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := ctx.Value(headerContextKey{}).(header); ok {
+		if err := WriteHeader(c, h.version, h.src, h.dst); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const memoryShards = 32
+
+// MemoryStore keeps rate limit state in process, spread over shards with a
+// lock each. It holds at most about maxEntries keys: when a shard is full,
+// its least recently used key is dropped, which gives that key a full burst
+// again. Keys whose whole burst is available carry no state and are dropped
+// first.
+type MemoryStore struct {
+	seed     maphash.Seed
+	perShard int
+	shards   [memoryShards]memoryShard
+	now      func() time.Time
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *memoryEntry, most recently used first
+}
+
+type memoryEntry struct {
+	key string
+	tat time.Time
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	s := &MemoryStore{
+		seed:     maphash.MakeSeed(),
+		perShard: max(1, (maxEntries+memoryShards-1)/memoryShards),
+		now:      time.Now,
+	}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[string]*list.Element)
+	}
+	return s
+}
+
+func (s *MemoryStore) Allow(_ context.Context, key string, limit Limit) (Result, error) {
+	sh := &s.shards[maphash.String(s.seed, key)%memoryShards]
+	now := s.now()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	el, ok := sh.entries[key]
+	var tat time.Time
+	if ok {
+		tat = el.Value.(*memoryEntry).tat
+	}
+	tat, res := Decide(tat, limit, now)
+	switch {
+	case ok:
+		el.Value.(*memoryEntry).tat = tat
+		sh.lru.MoveToFront(el)
+	case tat.After(now):
+		sh.evict(now, s.perShard-1)
+		sh.entries[key] = sh.lru.PushFront(&memoryEntry{key: key, tat: tat})
+	}
+	return res, nil
+}
+
+// Len returns the number of keys with state.
+func (s *MemoryStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// evict drops idle keys from the end of the LRU list, then the least
+// recently used keys beyond size.
+func (sh *memoryShard) evict(now time.Time, size int) {
+	for el := sh.lru.Back(); el != nil; el = sh.lru.Back() {
+		e := el.Value.(*memoryEntry)
+		if e.tat.After(now) && len(sh.entries) <= size {
+			return
+		}
+		sh.lru.Remove(el)
+		delete(sh.entries, e.key)
+	}
+}
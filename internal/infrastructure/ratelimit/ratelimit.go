@@ -0,0 +1,70 @@
+// Package ratelimit decides whether requests are within their rate limit
+// using the generic cell rate algorithm (GCRA), which behaves like a token
+// bucket but only needs one timestamp of state per key.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit admits Rate requests per second on average and up to Burst at once.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// interval is the time one request takes from the budget.
+func (l Limit) interval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// Result is the decision for one request and the state of its key after it.
+type Result struct {
+	Allowed bool
+	Limit   Limit
+	// Remaining is the number of requests that would be admitted now.
+	Remaining int
+	// RetryAfter is how long a rejected request has to wait.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the full burst is available again.
+	ResetAfter time.Duration
+}
+
+// Store keeps the rate limit state of each key, so that where the state
+// lives is independent of the algorithm. Allow decides a request for key
+// and records it if admitted.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Decide applies GCRA to a request at now. tat is the theoretical arrival
+// time of the key: the point at which its whole burst is available again,
+// or the zero time for a key without state. It returns the new tat, which is
+// unchanged for a rejected request.
+func Decide(tat time.Time, limit Limit, now time.Time) (time.Time, Result) {
+	interval := limit.interval()
+	window := time.Duration(limit.Burst) * interval
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+	var retryAfter time.Duration
+	if allowAt := next.Add(-window); now.Before(allowAt) {
+		retryAfter = allowAt.Sub(now)
+	} else {
+		tat = next
+	}
+	return tat, newResult(limit, retryAfter == 0, retryAfter, tat.Sub(now))
+}
+
+func newResult(limit Limit, allowed bool, retryAfter, resetAfter time.Duration) Result {
+	window := time.Duration(limit.Burst) * limit.interval()
+	return Result{
+		Allowed:    allowed,
+		Limit:      limit,
+		Remaining:  int((window - resetAfter) / limit.interval()),
+		RetryAfter: retryAfter,
+		ResetAfter: resetAfter,
+	}
+}
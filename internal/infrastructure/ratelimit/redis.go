@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+// What RedisStore does while the server cannot be reached.
+const (
+	OnErrorLocal = "local"
+	OnErrorAllow = "allow"
+	OnErrorDeny  = "deny"
+)
+
+// gcraScript applies GCRA like Decide, with the tat of KEYS[1] in
+// microseconds of the server clock, so that all instances sharing the server
+// agree on time. ARGV are the interval in microseconds and the burst. It
+// returns whether the request is allowed, the retry after and the reset after
+// in microseconds. Calling TIME before a write needs Redis 5 or later.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local nxt = tat + interval
+local allow_at = nxt - interval * burst
+if now < allow_at then
+	return {0, allow_at - now, tat - now}
+end
+redis.call('SET', KEYS[1], nxt, 'PX', math.ceil((nxt - now) / 1000))
+return {1, 0, nxt - now}
+`)
+
+type RedisOptions struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	PoolSize int
+	// Timeout bounds dialing and each command, so that a slow server
+	// delays requests by at most about that long.
+	Timeout   time.Duration
+	KeyPrefix string
+	// OnError is OnErrorLocal (the default), OnErrorAllow or OnErrorDeny.
+	OnError string
+	// RetryInterval is how long the server is left alone after an error.
+	RetryInterval time.Duration
+}
+
+// RedisStore keeps rate limit state in a Redis-protocol server, so that
+// instances sharing it enforce limits together. Each decision is one atomic
+// script call over a pooled connection. When a call fails, the store stops
+// using the server for RetryInterval and decides by OnError meanwhile:
+// OnErrorLocal limits each instance on its own with the fallback store,
+// OnErrorAllow admits every request and OnErrorDeny rejects every request.
+type RedisStore struct {
+	client    *redis.Client
+	prefix    string
+	onError   string
+	retry     time.Duration
+	fallback  Store
+	metrics   *metrics.Metrics
+	downUntil atomic.Int64
+	now       func() time.Time
+}
+
+type RedisOption func(*RedisStore)
+
+// WithFallback sets the store used while the server is down with
+// OnErrorLocal, by default an in-memory store of 10000 keys.
+func WithFallback(s Store) RedisOption {
+	return func(r *RedisStore) {
+		r.fallback = s
+	}
+}
+
+func WithMetrics(m *metrics.Metrics) RedisOption {
+	return func(r *RedisStore) {
+		r.metrics = m
+	}
+}
+
+func NewRedisStore(opts RedisOptions, options ...RedisOption) (*RedisStore, error) {
+	switch opts.OnError {
+	case "":
+		opts.OnError = OnErrorLocal
+	case OnErrorLocal, OnErrorAllow, OnErrorDeny:
+	default:
+		return nil, fmt.Errorf("unknown on_error %q", opts.OnError)
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 5 * time.Second
+	}
+	s := &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:         opts.Addr,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			DB:           opts.DB,
+			PoolSize:     opts.PoolSize,
+			DialTimeout:  opts.Timeout,
+			ReadTimeout:  opts.Timeout,
+			WriteTimeout: opts.Timeout,
+			// The rate limiter has its own answer to a failing server.
+			MaxRetries: -1,
+		}),
+		prefix:  opts.KeyPrefix,
+		onError: opts.OnError,
+		retry:   opts.RetryInterval,
+		now:     time.Now,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	if s.fallback == nil && s.onError == OnErrorLocal {
+		s.fallback = NewMemoryStore(10000)
+	}
+	return s, nil
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if s.now().UnixNano() < s.downUntil.Load() {
+		return s.fail(ctx, key, limit)
+	}
+	interval := max(1, limit.interval().Microseconds())
+	v, err := gcraScript.Run(ctx, s.client, []string{s.prefix + key}, interval, limit.Burst).Int64Slice()
+	if err == nil && len(v) != 3 {
+		err = fmt.Errorf("unexpected script reply %v", v)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			// The request went away, the server did not.
+			return Result{}, err
+		}
+		s.metrics.IncRateLimitErrors("redis")
+		s.downUntil.Store(s.now().Add(s.retry).UnixNano())
+		return s.fail(ctx, key, limit)
+	}
+	return newResult(limit, v[0] == 1, time.Duration(v[1])*time.Microsecond, time.Duration(v[2])*time.Microsecond), nil
+}
+
+// fail decides a request while the server is down.
+func (s *RedisStore) fail(ctx context.Context, key string, limit Limit) (Result, error) {
+	switch s.onError {
+	case OnErrorAllow:
+		return newResult(limit, true, 0, 0), nil
+	case OnErrorDeny:
+		res := newResult(limit, false, s.retry, 0)
+		res.Remaining = 0
+		return res, nil
+	}
+	return s.fallback.Allow(ctx, key, limit)
+}
+
+// Close closes the connections to the server.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+)
+
+const (
+	defaultTextRejection = "Too Many Requests\n"
+	defaultJSONRejection = `{"error":"too many requests","retry_after":{{.RetryAfter}}}` + "\n"
+)
+
+// RejectionData is available to rejection templates. Durations are in whole
+// seconds, rounded up.
+type RejectionData struct {
+	Policy     string
+	Route      string
+	Limit      int
+	RetryAfter int
+	Reset      int
+}
+
+// Rejection renders the body of rejected requests from a text/template, e.g.
+// {"error":"slow down","policy":{{json .Policy}}} with the json format. The
+// json function encodes a value as JSON.
+type Rejection struct {
+	contentType string
+	tmpl        *template.Template
+}
+
+// NewRejection parses text for format "text" (the default) or "json". An
+// empty text selects a default body. A json template must render valid JSON.
+func NewRejection(format, text string) (*Rejection, error) {
+	r := &Rejection{}
+	switch format {
+	case "", "text":
+		r.contentType = "text/plain; charset=utf-8"
+		if text == "" {
+			text = defaultTextRejection
+		}
+	case "json":
+		r.contentType = "application/json"
+		if text == "" {
+			text = defaultJSONRejection
+		}
+	default:
+		return nil, fmt.Errorf("unknown rejection format %q", format)
+	}
+	tmpl, err := template.New("rejection").Funcs(template.FuncMap{"json": jsonValue}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rejection template: %w", err)
+	}
+	r.tmpl = tmpl
+	if format == "json" {
+		body, err := r.render(RejectionData{Policy: "p", Route: "r", Limit: 1, RetryAfter: 1, Reset: 1})
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("rejection template does not render valid JSON: %s", body)
+		}
+	}
+	return r, nil
+}
+
+func jsonValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (r *Rejection) render(data RejectionData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering rejection template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Write sends a 429 with the rendered body. A template that fails to render
+// falls back to the status text.
+func (r *Rejection) Write(w http.ResponseWriter, data RejectionData) {
+	body, err := r.render(data)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", r.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(body)
+}
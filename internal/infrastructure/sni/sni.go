@@ -0,0 +1,80 @@
+// Package sni reads the ClientHello of a TLS connection without terminating
+// TLS, so that the connection can be routed by server name and passed through
+// to a backend unchanged.
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ClientHello holds the routing fields of a TLS ClientHello.
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+var errHelloRead = errors.New("sni: client hello read")
+
+// Peek reads the ClientHello from conn and returns it with a connection that
+// replays the bytes read so far before continuing with conn. If the client
+// does not speak TLS, err is set and the returned connection can still be
+// used to pass the bytes on.
+func Peek(conn net.Conn) (*ClientHello, net.Conn, error) {
+	var peeked bytes.Buffer
+	var hello *ClientHello
+
+	// Let crypto/tls parse the handshake, which may span several records,
+	// and abort it as soon as the ClientHello is known.
+	reader := readOnlyConn{r: io.TeeReader(conn, &peeked)}
+	err := tls.Server(reader, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{ServerName: info.ServerName, ALPN: info.SupportedProtos}
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	replay := &Conn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked.Bytes()), conn)}
+	if hello == nil {
+		return nil, replay, err
+	}
+	return hello, replay, nil
+}
+
+// Conn is a connection that first returns previously peeked bytes.
+type Conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite closes the write side of the underlying connection if it
+// supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readOnlyConn feeds the handshake and discards everything crypto/tls tries
+// to send, such as alerts.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const instrumentationName = "github.com/sdfpt05/go_load_balancer/v2"
+
+type Options struct {
+	ServiceName   string
+	Exporter      string // otlp-http or otlp-grpc
+	Endpoint      string
+	Insecure      bool
+	Headers       map[string]string
+	SamplingRatio float64
+	// IgnoreParent makes the sampling decision from SamplingRatio alone instead
+	// of following the sampled flag of an incoming trace context.
+	IgnoreParent bool
+}
+
+// NewTracerProvider creates a tracer provider that batches spans to an OTLP
+// collector. The caller must call Shutdown on the provider to flush spans.
+func NewTracerProvider(ctx context.Context, opts Options) (*sdktrace.TracerProvider, error) {
+	exporter, err := newExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(NewSampler(opts.SamplingRatio, opts.IgnoreParent)),
+	), nil
+}
+
+func NewSampler(ratio float64, ignoreParent bool) sdktrace.Sampler {
+	root := sdktrace.TraceIDRatioBased(ratio)
+	if ignoreParent {
+		return root
+	}
+	return sdktrace.ParentBased(root)
+}
+
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, error) {
+	switch opts.Exporter {
+	case "", "otlp-http":
+		httpOpts := []otlptracehttp.Option{otlptracehttp.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			httpOpts = append(httpOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, httpOpts...)
+	case "otlp-grpc":
+		grpcOpts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(opts.Headers)}
+		if opts.Endpoint != "" {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, grpcOpts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", opts.Exporter)
+	}
+}
+
+// NewPropagator builds a composite propagator from names such as
+// "tracecontext", "baggage" and "b3". B3 extraction accepts both the single
+// and the multi header encodings.
+func NewPropagator(names []string) (propagation.TextMapPropagator, error) {
+	if len(names) == 0 {
+		names = []string{"tracecontext", "baggage", "b3"}
+	}
+
+	propagators := make([]propagation.TextMapPropagator, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("unknown propagator: %s", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
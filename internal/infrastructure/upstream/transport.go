@@ -0,0 +1,98 @@
+// Package upstream builds the HTTP transports used to reach the backends of
+// a pool.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+)
+
+// TLSOptions configure TLS to https:// backends. CAFile replaces the system
+// roots, CertFile and KeyFile are a client certificate for backends that
+// require one, and ServerName overrides the name sent in SNI and verified
+// against the backend certificate, which defaults to the backend host.
+type TLSOptions struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Transport is an http.Transport whose TLS settings can be replaced while
+// it is in use. Connections that are already open keep their settings.
+type Transport struct {
+	*http.Transport
+	tls atomic.Pointer[tls.Config]
+}
+
+// NewTransport returns a transport that, like proxyprotocol.NewTransport,
+// sends PROXY protocol headers requested with proxyprotocol.WithHeader.
+func NewTransport(opts TLSOptions) (*Transport, error) {
+	t := &Transport{Transport: proxyprotocol.NewTransport()}
+	if err := t.Update(opts); err != nil {
+		return nil, err
+	}
+	dial := t.DialContext
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := t.tls.Load()
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return t, nil
+}
+
+// Update reads the files of opts and uses them for new connections. Idle
+// connections are closed so they are not reused with the old settings. On
+// error the previous settings are kept.
+func (t *Transport) Update(opts TLSOptions) error {
+	cfg, err := clientConfig(opts)
+	if err != nil {
+		return err
+	}
+	if t.tls.Swap(cfg) != nil {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+func clientConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+	if opts.CAFile != "" {
+		pool, err := certs.LoadCAPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
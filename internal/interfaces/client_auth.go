@@ -0,0 +1,63 @@
+package interfaces
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+)
+
+// ClientCertHeaders name the request headers that carry the identity of a
+// verified client certificate to backends. An empty name disables the
+// header. The headers are removed from requests without a verified
+// certificate, so clients cannot forge them.
+type ClientCertHeaders struct {
+	Subject     string
+	SANs        string
+	Fingerprint string
+}
+
+// SetClientCertHeaders changes the identity headers of new requests.
+func (h *HTTPHandler) SetClientCertHeaders(headers ClientCertHeaders) {
+	h.certHeaders.Store(&headers)
+}
+
+// authorizeClient reports whether the client may use route. Routes with
+// ClientAuth set need a certificate verified during the handshake that
+// passes the route's allowlist.
+func authorizeClient(r *http.Request, route Route) bool {
+	if route.ClientAuth == nil {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	return route.ClientAuth.Check(r.TLS.VerifiedChains[0][0]) == nil
+}
+
+// setIdentityHeaders replaces the identity headers of r with those of its
+// verified client certificate, if any.
+func (h *HTTPHandler) setIdentityHeaders(r *http.Request) {
+	headers := h.certHeaders.Load()
+	if headers == nil {
+		return
+	}
+	for _, name := range []string{headers.Subject, headers.SANs, headers.Fingerprint} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return
+	}
+
+	id := certs.IdentityOf(r.TLS.VerifiedChains[0][0])
+	set := func(name, value string) {
+		if name != "" && value != "" {
+			r.Header.Set(name, value)
+		}
+	}
+	set(headers.Subject, id.Subject)
+	set(headers.SANs, strings.Join(id.SANs, ","))
+	set(headers.Fingerprint, id.Fingerprint)
+}
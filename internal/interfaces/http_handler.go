@@ -2,31 +2,67 @@ package interfaces
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
 	"time"
 
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/accesslog"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
 	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
 	"go.uber.org/zap"
 )
 
 type HTTPHandler struct {
-	loadBalancerUseCase *usecases.LoadBalancerUseCase
-	logger              *zap.Logger
+	routes      atomic.Pointer[routeTable]
+	certHeaders atomic.Pointer[ClientCertHeaders]
+	logger      *zap.Logger
+	transport   http.RoundTripper
+	wrap        func(http.RoundTripper) http.RoundTripper
+	metrics     *metrics.Metrics
 }
 
-func NewHTTPHandler(uc *usecases.LoadBalancerUseCase, logger *zap.Logger) *HTTPHandler {
-	return &HTTPHandler{loadBalancerUseCase: uc, logger: logger}
+type HandlerOption func(*HTTPHandler)
+
+// WithTransport sets the round tripper used to reach backends. The default
+// is http.DefaultTransport. Pools that send the PROXY protocol need a
+// transport built on proxyprotocol.NewTransport.
+func WithTransport(rt http.RoundTripper) HandlerOption {
+	return func(h *HTTPHandler) {
+		h.transport = rt
+	}
 }
 
-func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	startTime := time.Now()
-	logger := h.logger.With(zap.String("request_id", r.Header.Get("X-Request-ID")))
+// WithTransportWrapper decorates the transport of every request, including
+// the transports of servers that have their own, e.g. for tracing.
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) HandlerOption {
+	return func(h *HTTPHandler) {
+		h.wrap = wrap
+	}
+}
+
+func WithMetrics(m *metrics.Metrics) HandlerOption {
+	return func(h *HTTPHandler) {
+		h.metrics = m
+	}
+}
 
-	logger.Info("Incoming request", zap.String("path", r.URL.Path))
+func NewHTTPHandler(uc *usecases.LoadBalancerUseCase, logger *zap.Logger, opts ...HandlerOption) *HTTPHandler {
+	h := &HTTPHandler{logger: logger}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.SetRoutes(nil, uc)
+	return h
+}
 
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/health":
 		h.handleHealth(w, r)
@@ -42,10 +78,6 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		h.handleProxy(w, r)
 	}
-
-	duration := time.Since(startTime)
-	logger.Info("Request completed", zap.Duration("duration", duration))
-	metrics.RequestDuration.Observe(duration.Seconds())
 }
 
 func (h *HTTPHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -54,7 +86,7 @@ func (h *HTTPHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HTTPHandler) handleGetServers(w http.ResponseWriter, r *http.Request) {
-	servers := h.loadBalancerUseCase.GetServers()
+	servers := h.routes.Load().fallback.Pool.GetServers()
 	json.NewEncoder(w).Encode(servers)
 }
 
@@ -73,7 +105,7 @@ func (h *HTTPHandler) handleAddServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.loadBalancerUseCase.AddServer(server); err != nil {
+	if err := h.routes.Load().fallback.Pool.AddServer(server); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -82,23 +114,179 @@ func (h *HTTPHandler) handleAddServer(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HTTPHandler) handleProxy(w http.ResponseWriter, r *http.Request) {
-	server, err := h.loadBalancerUseCase.GetNextServer(r.Context())
-	if err != nil {
-		http.Error(w, "No server available", http.StatusServiceUnavailable)
-		h.logger.Error("No server available", zap.Error(err))
-		metrics.RequestsTotal.WithLabelValues("error").Inc()
+	startTime := time.Now()
+	route := h.routes.Load().match(r)
+	pool := route.Pool
+
+	entry := accesslog.FromContext(r.Context())
+	entry.Route = route.Name
+	entry.Pool = pool.Name()
+
+	observed := metrics.Request{Route: route.Name, Pool: pool.Name(), Method: r.Method}
+	defer func() {
+		observed.Duration = time.Since(startTime)
+		h.metrics.ObserveRequest(observed)
+	}()
+
+	if !authorizeClient(r, route) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		observed.Status = http.StatusForbidden
 		return
 	}
+	h.setIdentityHeaders(r)
+
+	if limiter := pool.ConcurrencyLimiter(); limiter != nil {
+		token, err := limiter.Acquire(r.Context(), limiter.Priority(r, route.Priority))
+		if err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			observed.Status = http.StatusServiceUnavailable
+			return
+		}
+		defer func() { releaseToken(token, r, entry.UpstreamLatency, observed.Status) }()
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &observed.BytesIn}
+	}
+
+	ctx := domain.WithHashKey(r.Context(), remoteIP(r.RemoteAddr))
+	for attempt := 0; ; attempt++ {
+		server, err := pool.AcquireServer(ctx)
+		if err != nil {
+			http.Error(w, "No server available", http.StatusServiceUnavailable)
+			h.logger.Error("No server available", zap.Error(err))
+			observed.Status = http.StatusServiceUnavailable
+			return
+		}
+
+		entry.UpstreamAddr = server.URL.Host
+		observed.Backend = server.URL.Host
+
+		err = h.proxy(w, r, pool, server, entry, &observed)
+		if err == nil {
+			return
+		}
+
+		h.logger.Error("Proxy error", zap.String("backend", server.URL.Host), zap.Error(err))
+		server.Active.Store(false)
+		pool.UpdateServerStatus(server)
+
+		if attempt >= pool.MaxRetries() || !retryable(r, err) {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			observed.Status = http.StatusServiceUnavailable
+			return
+		}
+		entry.Retries++
+		h.metrics.IncRetries(route.Name, pool.Name())
+	}
+}
+
+// proxy forwards r to server, which was acquired from uc and is released
+// here. It returns the transport error when the backend could not be
+// reached, in which case nothing has been written to w yet.
+func (h *HTTPHandler) proxy(w http.ResponseWriter, r *http.Request, uc *usecases.LoadBalancerUseCase, server *domain.Server, entry *accesslog.Entry, observed *metrics.Request) error {
+	pool := uc.Name()
+	h.metrics.SetActiveConnections(pool, server.URL.Host, atomic.LoadInt64(&server.Connections))
+	defer func() {
+		h.metrics.SetActiveConnections(pool, server.URL.Host, uc.ReleaseServer(server))
+	}()
+
+	var proxyErr error
+	upstreamStart := time.Now()
 
 	proxy := httputil.NewSingleHostReverseProxy(server.URL)
+	proxy.Transport = h.transportFor(server)
+	if version := uc.ProxyProtocol(); version != 0 {
+		// The header is written when the connection is dialed, so the
+		// connection must not be reused for another client.
+		r = r.WithContext(proxyprotocol.WithHeader(r, version))
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Close = true
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		entry.UpstreamLatency = time.Since(upstreamStart)
+		h.metrics.ObserveUpstreamLatency(pool, server.URL.Host, entry.UpstreamLatency)
+		observed.Status = resp.StatusCode
+		// The body of an upgraded connection must stay an
+		// io.ReadWriteCloser for the proxy to tunnel it.
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Body = &countingReader{ReadCloser: resp.Body, n: &observed.BytesOut}
+		}
+		return nil
+	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		h.logger.Error("Proxy error", zap.Error(err))
-		server.Active.Store(false)
-		h.loadBalancerUseCase.UpdateServerStatus(server)
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-		metrics.RequestsTotal.WithLabelValues("error").Inc()
+		proxyErr = err
 	}
 
 	proxy.ServeHTTP(w, r)
-	metrics.RequestsTotal.WithLabelValues("success").Inc()
+	return proxyErr
+}
+
+// releaseToken reports how a request went to the concurrency limiter. A 503
+// or a backend that could not be reached counts as dropped; requests the
+// client gave up on say nothing about the backends.
+func releaseToken(token *concurrency.Token, r *http.Request, latency time.Duration, status int) {
+	switch {
+	case r.Context().Err() != nil:
+		token.Ignore()
+	case latency > 0:
+		token.Release(latency, status == http.StatusServiceUnavailable)
+	case status == http.StatusServiceUnavailable:
+		token.Release(0, true)
+	default:
+		token.Ignore()
+	}
+}
+
+// transportFor returns the transport for requests to server.
+func (h *HTTPHandler) transportFor(server *domain.Server) http.RoundTripper {
+	rt := h.transport
+	if server.Transport != nil {
+		rt = server.Transport
+	}
+	if h.wrap != nil {
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		rt = h.wrap(rt)
+	}
+	return rt
+}
+
+// remoteIP returns the host part of addr, or addr if it has no port.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// retryable reports whether r can be sent to another backend after err.
+// Bodies are streamed and cannot be replayed, and a cancelled client is not
+// retried. Requests that are not idempotent are only retried when the
+// backend could not be dialed, so it cannot have received them.
+func retryable(r *http.Request, err error) bool {
+	if r.Context().Err() != nil || (r.Body != nil && r.Body != http.NoBody) {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.n += int64(n)
+	return n, err
 }
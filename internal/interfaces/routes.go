@@ -0,0 +1,74 @@
+package interfaces
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+)
+
+const DefaultRouteName = "default"
+
+// Route sends requests matching Host and PathPrefix to Pool. An empty Host
+// matches any host and an empty PathPrefix matches any path. If ClientAuth is
+// set, only clients with a verified certificate that passes it are admitted.
+// Priority applies when the pool limits concurrency and the request does not
+// carry one.
+type Route struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	Pool       *usecases.LoadBalancerUseCase
+	ClientAuth *certs.Allowlist
+	Priority   concurrency.Priority
+}
+
+type routeTable struct {
+	routes   []Route
+	fallback Route
+}
+
+// SetRoutes atomically replaces the routing table. Requests that match no
+// route, as well as the /servers admin endpoint, use defaultPool.
+func (h *HTTPHandler) SetRoutes(routes []Route, defaultPool *usecases.LoadBalancerUseCase) {
+	h.routes.Store(&routeTable{
+		routes:   append([]Route(nil), routes...),
+		fallback: Route{Name: DefaultRouteName, Pool: defaultPool},
+	})
+}
+
+// match returns the route with the longest matching path prefix, preferring
+// routes that name the request host over catch-all ones.
+func (t *routeTable) match(r *http.Request) Route {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	best, bestScore := t.fallback, -1
+	for _, route := range t.routes {
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		score := len(route.PathPrefix)
+		if route.Host != "" {
+			score += 1 << 16
+		}
+		if score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	return best
+}
+
+// RouteName returns the name of the route r is sent to, DefaultRouteName if
+// it matches none.
+func (h *HTTPHandler) RouteName(r *http.Request) string {
+	return h.routes.Load().match(r).Name
+}
@@ -0,0 +1,60 @@
+package interfaces
+
+import (
+	"strings"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/sni"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+)
+
+// SNIRoute sends TLS connections for one of ServerNames to Pool. A name is
+// either exact or a wildcard such as "*.example.com", which matches exactly
+// one label. If ALPN is set, the client must also offer one of its protocols.
+type SNIRoute struct {
+	ServerNames []string
+	ALPN        []string
+	Pool        *usecases.LoadBalancerUseCase
+}
+
+// matchSNI returns the pool of the first route matching hello exactly, else
+// of the first matching it by wildcard, else nil.
+func matchSNI(routes []SNIRoute, hello *sni.ClientHello) *usecases.LoadBalancerUseCase {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil
+	}
+
+	var wildcard *usecases.LoadBalancerUseCase
+	for _, r := range routes {
+		if !offersALPN(r.ALPN, hello.ALPN) {
+			continue
+		}
+		for _, n := range r.ServerNames {
+			n = strings.ToLower(n)
+			if n == name {
+				return r.Pool
+			}
+			if wildcard == nil && strings.HasPrefix(n, "*.") {
+				label, ok := strings.CutSuffix(name, n[1:])
+				if ok && label != "" && !strings.Contains(label, ".") {
+					wildcard = r.Pool
+				}
+			}
+		}
+	}
+	return wildcard
+}
+
+func offersALPN(wanted, offered []string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		for _, o := range offered {
+			if w == o {
+				return true
+			}
+		}
+	}
+	return false
+}
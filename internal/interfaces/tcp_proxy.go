@@ -0,0 +1,372 @@
+package interfaces
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/sni"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultConnectTimeout = 5 * time.Second
+	clientHelloTimeout    = 10 * time.Second
+)
+
+// TCPProxy forwards TCP connections to the servers of a pool and copies bytes
+// in both directions until both sides are done.
+type TCPProxy struct {
+	name           string
+	pool           atomic.Pointer[usecases.LoadBalancerUseCase]
+	sniRoutes      atomic.Pointer[[]SNIRoute]
+	logger         *zap.Logger
+	metrics        *metrics.Metrics
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	halfClose      bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type TCPProxyOption func(*TCPProxy)
+
+// WithConnectTimeout bounds how long dialing a backend may take. The default
+// is 5s.
+func WithConnectTimeout(d time.Duration) TCPProxyOption {
+	return func(p *TCPProxy) {
+		p.connectTimeout = d
+	}
+}
+
+// WithIdleTimeout closes connections on which no bytes were transferred in
+// either direction for d. Zero, the default, disables the timeout.
+func WithIdleTimeout(d time.Duration) TCPProxyOption {
+	return func(p *TCPProxy) {
+		p.idleTimeout = d
+	}
+}
+
+// WithHalfClose controls what happens when one side finishes sending. If
+// enabled, the default, the write half of the other side is closed and data
+// keeps flowing in the opposite direction. Otherwise both connections are
+// closed at once.
+func WithHalfClose(enabled bool) TCPProxyOption {
+	return func(p *TCPProxy) {
+		p.halfClose = enabled
+	}
+}
+
+func WithTCPMetrics(m *metrics.Metrics) TCPProxyOption {
+	return func(p *TCPProxy) {
+		p.metrics = m
+	}
+}
+
+// NewTCPProxy returns a proxy for the listener called name that balances
+// connections over pool.
+func NewTCPProxy(name string, pool *usecases.LoadBalancerUseCase, logger *zap.Logger, opts ...TCPProxyOption) *TCPProxy {
+	p := &TCPProxy{
+		name:           name,
+		logger:         logger,
+		connectTimeout: defaultConnectTimeout,
+		halfClose:      true,
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[net.Conn]struct{}),
+	}
+	p.pool.Store(pool)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// SetPool switches new connections to pool. Established connections keep
+// their backend.
+func (p *TCPProxy) SetPool(pool *usecases.LoadBalancerUseCase) {
+	p.pool.Store(pool)
+}
+
+// SetSNIRoutes routes TLS connections by server name. Connections are passed
+// through without terminating TLS. Routes are matched in order, but an exact
+// server name match always wins over a wildcard one.
+func (p *TCPProxy) SetSNIRoutes(routes []SNIRoute) {
+	p.sniRoutes.Store(&routes)
+}
+
+// Serve accepts connections on ln until ln is closed or Shutdown is called.
+// Other accept errors, such as running out of file descriptors, are retried
+// with backoff.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	if !p.trackListener(ln, true) {
+		return net.ErrClosed
+	}
+	defer p.trackListener(ln, false)
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			p.logger.Warn("Accept failed, retrying", zap.String("listener", p.name), zap.Duration("backoff", backoff), zap.Error(err))
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !p.trackConn(conn, true) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer p.trackConn(conn, false)
+			p.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn proxies conn to a backend of the pool and closes it when done.
+// With SNI routes set, the pool is chosen from the TLS ClientHello, and
+// connections without a matching server name use the default pool.
+func (p *TCPProxy) ServeConn(conn net.Conn) {
+	pool := p.pool.Load()
+	if routes := p.sniRoutes.Load(); routes != nil && len(*routes) > 0 {
+		conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		hello, replay, err := sni.Peek(conn)
+		conn.SetReadDeadline(time.Time{})
+		conn = replay
+		if err != nil {
+			p.logger.Debug("No TLS ClientHello, using default pool", zap.String("listener", p.name), zap.Error(err))
+		} else if routed := matchSNI(*routes, hello); routed != nil {
+			pool = routed
+		}
+	}
+	p.serveConn(conn, pool)
+}
+
+func (p *TCPProxy) serveConn(conn net.Conn, pool *usecases.LoadBalancerUseCase) {
+	defer conn.Close()
+
+	server, backend, err := p.dial(pool, remoteIP(conn.RemoteAddr().String()))
+	if err != nil {
+		p.logger.Error("No server available", zap.String("listener", p.name), zap.String("pool", pool.Name()), zap.Error(err))
+		return
+	}
+	defer backend.Close()
+
+	poolName, addr := pool.Name(), server.URL.Host
+	p.metrics.SetActiveConnections(poolName, addr, atomic.LoadInt64(&server.Connections))
+	defer func() {
+		p.metrics.SetActiveConnections(poolName, addr, pool.ReleaseServer(server))
+	}()
+
+	if version := pool.ProxyProtocol(); version != 0 {
+		if err := proxyprotocol.WriteHeader(backend, version, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			p.logger.Error("Failed to send PROXY protocol header", zap.String("listener", p.name), zap.String("backend", addr), zap.Error(err))
+			return
+		}
+	}
+	p.metrics.IncTCPConnections(p.name, poolName, addr)
+
+	up, down := p.splice(conn, backend)
+	p.metrics.AddTCPBytes(p.name, poolName, addr, "upstream", up)
+	p.metrics.AddTCPBytes(p.name, poolName, addr, "downstream", down)
+	p.logger.Debug("TCP connection closed",
+		zap.String("listener", p.name),
+		zap.String("client", conn.RemoteAddr().String()),
+		zap.String("backend", addr),
+		zap.Int64("bytes_upstream", up),
+		zap.Int64("bytes_downstream", down),
+	)
+}
+
+// dial connects to the next server of pool, moving on to another server up
+// to the pool's retry limit when a backend cannot be reached. The server is
+// acquired from pool, waiting in its queue if every server is at its cap,
+// and must be released with ReleaseServer.
+func (p *TCPProxy) dial(pool *usecases.LoadBalancerUseCase, clientIP string) (*domain.Server, net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.connectTimeout}
+	ctx := domain.WithHashKey(context.Background(), clientIP)
+	for attempt := 0; ; attempt++ {
+		server, err := pool.AcquireServer(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := dialer.Dial("tcp", server.URL.Host)
+		if err == nil {
+			return server, conn, nil
+		}
+		pool.ReleaseServer(server)
+
+		p.logger.Error("Proxy error", zap.String("listener", p.name), zap.String("backend", server.URL.Host), zap.Error(err))
+		server.Active.Store(false)
+		pool.UpdateServerStatus(server)
+		if attempt >= pool.MaxRetries() {
+			return nil, nil, err
+		}
+	}
+}
+
+// splice copies client to backend and backend to client until both
+// directions are finished, and returns the byte counts of each direction.
+func (p *TCPProxy) splice(client, backend net.Conn) (up, down int64) {
+	src, dst := client, backend
+	if p.idleTimeout > 0 {
+		idle := &idleTracker{timeout: p.idleTimeout}
+		idle.touch()
+		src = &idleConn{Conn: client, idle: idle}
+		dst = &idleConn{Conn: backend, idle: idle}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		down = p.copy(src, dst)
+	}()
+	up = p.copy(dst, src)
+	wg.Wait()
+	return up, down
+}
+
+// copy copies from src to dst. When src is finished, the write half of dst is
+// closed so the peer sees EOF, or with half-close disabled or after an error,
+// both connections are closed to end the other direction too.
+func (p *TCPProxy) copy(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err == nil && p.halfClose {
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+			return n
+		}
+	}
+	src.Close()
+	dst.Close()
+	return n
+}
+
+// Shutdown stops accepting connections and waits for the established ones
+// to finish. When ctx is done first, the remaining connections are closed.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	for ln := range p.listeners {
+		ln.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (p *TCPProxy) trackListener(ln net.Listener, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		if p.closed {
+			return false
+		}
+		p.listeners[ln] = struct{}{}
+	} else {
+		delete(p.listeners, ln)
+	}
+	return true
+}
+
+func (p *TCPProxy) trackConn(conn net.Conn, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		if p.closed {
+			return false
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+	} else {
+		delete(p.conns, conn)
+		p.wg.Done()
+	}
+	return true
+}
+
+// idleTracker records the last time bytes moved in either direction of a
+// proxied connection.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+func (t *idleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *idleTracker) expired() bool {
+	return time.Since(time.Unix(0, t.last.Load())) >= t.timeout
+}
+
+// idleConn is a connection whose reads time out only when the whole proxied
+// connection has been idle, not just this direction.
+type idleConn struct {
+	net.Conn
+	idle *idleTracker
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.idle.touch()
+		}
+		var ne net.Error
+		if n == 0 && errors.As(err, &ne) && ne.Timeout() && !c.idle.expired() {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,257 @@
+package interfaces
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFlowIdleTimeout = 30 * time.Second
+	maxDatagramSize        = 64 * 1024
+)
+
+// UDPProxy forwards datagrams to the servers of a pool. Each client address
+// is a flow that sticks to the server chosen for its first datagram, and
+// replies are sent back to the client from the proxy's own socket. Flows
+// without traffic in either direction expire after the idle timeout.
+type UDPProxy struct {
+	name        string
+	pool        atomic.Pointer[usecases.LoadBalancerUseCase]
+	logger      *zap.Logger
+	metrics     *metrics.Metrics
+	idleTimeout atomic.Int64
+
+	mu     sync.Mutex
+	pc     net.PacketConn
+	flows  map[string]*udpFlow
+	closed bool
+}
+
+type udpFlow struct {
+	client  net.Addr
+	pool    string
+	useCase *usecases.LoadBalancerUseCase
+	server  *domain.Server
+	conn    net.Conn
+	last    atomic.Int64
+	once    sync.Once
+}
+
+func (f *udpFlow) touch() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+type UDPProxyOption func(*UDPProxy)
+
+// WithFlowIdleTimeout sets how long a flow is kept without traffic. The
+// default is 30s.
+func WithFlowIdleTimeout(d time.Duration) UDPProxyOption {
+	return func(p *UDPProxy) {
+		p.SetIdleTimeout(d)
+	}
+}
+
+func WithUDPMetrics(m *metrics.Metrics) UDPProxyOption {
+	return func(p *UDPProxy) {
+		p.metrics = m
+	}
+}
+
+// NewUDPProxy returns a proxy for the listener called name that balances
+// flows over pool.
+func NewUDPProxy(name string, pool *usecases.LoadBalancerUseCase, logger *zap.Logger, opts ...UDPProxyOption) *UDPProxy {
+	p := &UDPProxy{name: name, logger: logger, flows: make(map[string]*udpFlow)}
+	p.pool.Store(pool)
+	p.SetIdleTimeout(defaultFlowIdleTimeout)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// SetPool switches new flows to pool. Existing flows keep their server.
+func (p *UDPProxy) SetPool(pool *usecases.LoadBalancerUseCase) {
+	p.pool.Store(pool)
+}
+
+// SetIdleTimeout changes the idle timeout of all flows.
+func (p *UDPProxy) SetIdleTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultFlowIdleTimeout
+	}
+	p.idleTimeout.Store(int64(d))
+}
+
+// Serve reads datagrams from pc until pc is closed or Shutdown is called.
+func (p *UDPProxy) Serve(pc net.PacketConn) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.pc = pc
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.expireFlows(done)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		flow, err := p.flow(addr)
+		if err != nil {
+			p.logger.Error("No server available", zap.String("listener", p.name), zap.Error(err))
+			continue
+		}
+		flow.touch()
+		if _, err := flow.conn.Write(buf[:n]); err != nil {
+			p.logger.Debug("UDP write failed", zap.String("listener", p.name), zap.String("backend", flow.server.URL.Host), zap.Error(err))
+			continue
+		}
+		p.metrics.ObserveUDPPacket(p.name, flow.pool, flow.server.URL.Host, "upstream", n)
+	}
+}
+
+// flow returns the flow of client, creating it on the first datagram. It is
+// only called from Serve, so flows of one client are never created twice.
+func (p *UDPProxy) flow(client net.Addr) (*udpFlow, error) {
+	key := client.String()
+	p.mu.Lock()
+	f, ok := p.flows[key]
+	p.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+
+	pool := p.pool.Load()
+	ctx := domain.WithHashKey(context.Background(), remoteIP(key))
+	// Waiting in the queue would hold up the datagrams of all clients, so a
+	// new flow is dropped when every server is at its cap.
+	server, err := pool.TryAcquireServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", server.URL.Host)
+	if err != nil {
+		pool.ReleaseServer(server)
+		return nil, err
+	}
+
+	f = &udpFlow{client: client, pool: pool.Name(), useCase: pool, server: server, conn: conn}
+	f.touch()
+	p.mu.Lock()
+	p.flows[key] = f
+	p.metrics.SetUDPActiveFlows(p.name, len(p.flows))
+	p.mu.Unlock()
+	p.metrics.IncUDPFlows(p.name, f.pool, server.URL.Host)
+	p.metrics.SetActiveConnections(f.pool, server.URL.Host, atomic.LoadInt64(&server.Connections))
+	go p.relay(f)
+	return f, nil
+}
+
+// relay sends the replies of the flow's server back to its client.
+func (p *UDPProxy) relay(f *udpFlow) {
+	defer p.removeFlow(f)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := f.conn.Read(buf)
+		if err != nil {
+			// A connected UDP socket reports ICMP port unreachable as a
+			// refused connection: take the server out until its next
+			// health check.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				p.logger.Error("Proxy error", zap.String("listener", p.name), zap.String("backend", f.server.URL.Host), zap.Error(err))
+				f.server.Active.Store(false)
+				f.useCase.UpdateServerStatus(f.server)
+			}
+			return
+		}
+		f.touch()
+		p.mu.Lock()
+		pc := p.pc
+		p.mu.Unlock()
+		if _, err := pc.WriteTo(buf[:n], f.client); err != nil {
+			p.logger.Debug("UDP reply failed", zap.String("listener", p.name), zap.String("client", f.client.String()), zap.Error(err))
+			continue
+		}
+		p.metrics.ObserveUDPPacket(p.name, f.pool, f.server.URL.Host, "downstream", n)
+	}
+}
+
+func (p *UDPProxy) removeFlow(f *udpFlow) {
+	f.once.Do(func() {
+		f.conn.Close()
+		p.mu.Lock()
+		if p.flows[f.client.String()] == f {
+			delete(p.flows, f.client.String())
+		}
+		p.metrics.SetUDPActiveFlows(p.name, len(p.flows))
+		p.mu.Unlock()
+		p.metrics.SetActiveConnections(f.pool, f.server.URL.Host, f.useCase.ReleaseServer(f.server))
+	})
+}
+
+func (p *UDPProxy) expireFlows(done <-chan struct{}) {
+	for {
+		timeout := time.Duration(p.idleTimeout.Load())
+		select {
+		case <-done:
+			return
+		case <-time.After(max(timeout/4, 10*time.Millisecond)):
+		}
+
+		var expired []*udpFlow
+		p.mu.Lock()
+		for _, f := range p.flows {
+			if time.Since(time.Unix(0, f.last.Load())) >= timeout {
+				expired = append(expired, f)
+			}
+		}
+		p.mu.Unlock()
+		for _, f := range expired {
+			p.removeFlow(f)
+		}
+	}
+}
+
+// Shutdown closes the socket and all flows. There is no connection state to
+// drain, so it does not wait.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	if p.pc != nil {
+		p.pc.Close()
+	}
+	flows := make([]*udpFlow, 0, len(p.flows))
+	for _, f := range p.flows {
+		flows = append(flows, f)
+	}
+	p.mu.Unlock()
+
+	for _, f := range flows {
+		p.removeFlow(f)
+	}
+	return nil
+}
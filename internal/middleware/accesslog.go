@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/accesslog"
+	"go.uber.org/zap"
+)
+
+type AccessLogger struct {
+	logger *accesslog.Logger
+	errLog *zap.Logger
+}
+
+func NewAccessLogger(logger *accesslog.Logger, errLog *zap.Logger) *AccessLogger {
+	return &AccessLogger{logger: logger, errLog: errLog}
+}
+
+func (al *AccessLogger) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accesslog.Entry{
+			Time:      time.Now(),
+			RequestID: r.Header.Get("X-Request-ID"),
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+		if user, _, ok := r.BasicAuth(); ok {
+			entry.User = user
+		}
+		if r.TLS != nil {
+			entry.TLSVersion = tls.VersionName(r.TLS.Version)
+			entry.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+			entry.TLSServerName = r.TLS.ServerName
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rw := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rw, r.WithContext(accesslog.WithEntry(r.Context(), entry)))
+
+		entry.Status = rw.Status()
+		entry.BytesIn = body.n
+		entry.BytesOut = rw.bytes
+		entry.Duration = time.Since(entry.Time)
+		if err := al.logger.Log(entry); err != nil {
+			al.errLog.Warn("Failed to write access log", zap.Error(err))
+		}
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseRecorder captures the status code and body size written by the
+// wrapped handler. Unwrap lets http.ResponseController reach Flush and Hijack
+// on the underlying writer, which the reverse proxy needs for streaming and
+// protocol upgrades.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 && (status >= http.StatusOK || status == http.StatusSwitchingProtocols) {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *responseRecorder) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *responseRecorder) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
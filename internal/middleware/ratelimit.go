@@ -1,50 +1,304 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
-	"sync"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
 )
 
+const globalPolicy = "global"
+
+// DefaultRateLimitEntries bounds the keys of the default in-memory store.
+const DefaultRateLimitEntries = 100000
+
+// DefaultAPIKeyHeader carries the API key for policies keyed by api_key.
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// RateLimitPolicy lets requests that share a key through at Rate per second
+// with bursts of Burst. Key is "ip" (or empty), "header" (the value of
+// Header), "api_key" (Header, DefaultAPIKeyHeader if empty, or the api_key
+// query parameter), "jwt_claim" (Claim of the bearer token) or "route".
+// Requests without a value for the key are limited by client IP. Overrides
+// set other limits for individual key values.
+type RateLimitPolicy struct {
+	Name      string
+	Rate      float64
+	Burst     int
+	Key       string
+	Header    string
+	Claim     string
+	Overrides map[string]RateLimit
+}
+
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter enforces the rate limit policy of the route a request is
+// routed to, or the global policy. Policies can be replaced while requests
+// are served. The state of each key is kept in the store by policy name, so
+// it survives a reload, and changed limits apply to it from then on.
+//
+// Responses to limited requests carry the RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy headers of the
+// IETF draft, and rejections a Retry-After.
 type RateLimiter struct {
-	limiters map[string]*rate.Limiter
-	mu       sync.Mutex
-	limit    rate.Limit
-	burst    int
+	route     func(*http.Request) string
+	metrics   *metrics.Metrics
+	store     ratelimit.Store
+	policies  atomic.Pointer[policySet]
+	rejection atomic.Pointer[ratelimit.Rejection]
+}
+
+type policySet struct {
+	global  *policy
+	byRoute map[string]*policy
+}
+
+type policy struct {
+	RateLimitPolicy
+	key func(r *http.Request, route string) string
+}
+
+type RateLimiterOption func(*RateLimiter)
+
+func WithRateLimitMetrics(m *metrics.Metrics) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.metrics = m
+	}
+}
+
+// WithRouteMatcher sets the function that returns the name of the route a
+// request is routed to. Without it, only the global policy applies.
+func WithRouteMatcher(route func(*http.Request) string) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.route = route
+	}
+}
+
+// WithRateLimitStore sets where the state of keys is kept, by default an
+// in-memory store of DefaultRateLimitEntries keys.
+func WithRateLimitStore(store ratelimit.Store) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.store = store
+	}
+}
+
+// NewRateLimiter returns a rate limiter without policies, which lets every
+// request through until SetPolicies is called.
+func NewRateLimiter(opts ...RateLimiterOption) *RateLimiter {
+	rl := &RateLimiter{}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	if rl.store == nil {
+		rl.store = ratelimit.NewMemoryStore(DefaultRateLimitEntries)
+	}
+	rl.policies.Store(&policySet{})
+	rejection, _ := ratelimit.NewRejection("text", "")
+	rl.rejection.Store(rejection)
+	return rl
+}
+
+// SetRejection replaces the response to rejected requests, by default the
+// status text.
+func (rl *RateLimiter) SetRejection(r *ratelimit.Rejection) {
+	rl.rejection.Store(r)
+}
+
+// SetPolicies replaces the global policy, which may be nil, and the policies
+// of routes by route name. Routes with the same policy share its state.
+func (rl *RateLimiter) SetPolicies(global *RateLimitPolicy, routes map[string]RateLimitPolicy) error {
+	set := &policySet{byRoute: make(map[string]*policy)}
+	get := func(spec RateLimitPolicy) (*policy, error) {
+		if p := set.find(spec); p != nil {
+			return p, nil
+		}
+		return newPolicy(spec)
+	}
+	if global != nil {
+		g := *global
+		if g.Name == "" {
+			g.Name = globalPolicy
+		}
+		p, err := get(g)
+		if err != nil {
+			return err
+		}
+		set.global = p
+	}
+	for route, spec := range routes {
+		p, err := get(spec)
+		if err != nil {
+			return err
+		}
+		set.byRoute[route] = p
+	}
+	rl.policies.Store(set)
+	return nil
 }
 
-func NewRateLimiter(rps int, burst int) *RateLimiter {
-	return &RateLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		limit:    rate.Limit(rps),
-		burst:    burst,
+// find returns the policy of set with the same settings as spec.
+func (set *policySet) find(spec RateLimitPolicy) *policy {
+	for _, p := range set.all() {
+		if reflect.DeepEqual(p.RateLimitPolicy, spec) {
+			return p
+		}
 	}
+	return nil
 }
 
-func (rl *RateLimiter) getLimiter(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+func (set *policySet) all() []*policy {
+	all := make([]*policy, 0, len(set.byRoute)+1)
+	if set.global != nil {
+		all = append(all, set.global)
+	}
+	for _, p := range set.byRoute {
+		all = append(all, p)
+	}
+	return all
+}
 
-	limiter, exists := rl.limiters[ip]
-	if !exists {
-		limiter = rate.NewLimiter(rl.limit, rl.burst)
-		rl.limiters[ip] = limiter
+func newPolicy(spec RateLimitPolicy) (*policy, error) {
+	p := &policy{RateLimitPolicy: spec}
+	switch spec.Key {
+	case "", "ip":
+		p.key = func(r *http.Request, _ string) string { return clientIP(r) }
+	case "header":
+		p.key = func(r *http.Request, _ string) string { return r.Header.Get(spec.Header) }
+	case "api_key":
+		header := spec.Header
+		if header == "" {
+			header = DefaultAPIKeyHeader
+		}
+		p.key = func(r *http.Request, _ string) string {
+			if key := r.Header.Get(header); key != "" {
+				return key
+			}
+			return r.URL.Query().Get("api_key")
+		}
+	case "jwt_claim":
+		p.key = func(r *http.Request, _ string) string { return jwtClaim(r, spec.Claim) }
+	case "route":
+		p.key = func(_ *http.Request, route string) string { return route }
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", spec.Key)
 	}
+	return p, nil
+}
 
-	return limiter
+// take decides r against the limit for its key.
+func (p *policy) take(store ratelimit.Store, r *http.Request, route string) (ratelimit.Result, error) {
+	key := p.key(r, route)
+	limit := ratelimit.Limit{Rate: p.Rate, Burst: p.Burst}
+	if o, ok := p.Overrides[key]; ok && key != "" {
+		limit = ratelimit.Limit(o)
+	}
+	if key == "" {
+		// Keep clients without a key apart from a key that happens to
+		// look like an address.
+		key = "ip:" + clientIP(r)
+	}
+	return store.Allow(r.Context(), p.Name+"\x00"+key, limit)
+}
+
+// jwtClaim returns a top-level claim of the bearer token. The signature is
+// not verified: the claim only selects a bucket.
+func jwtClaim(r *http.Request, claim string) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var claims map[string]interface{}
+	if err := dec.Decode(&claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
 }
 
 func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		limiter := rl.getLimiter(ip)
+		set := rl.policies.Load()
+		var route string
+		if rl.route != nil {
+			route = rl.route(r)
+		}
+		p, ok := set.byRoute[route]
+		if !ok {
+			p = set.global
+		}
 
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		res, err := p.take(rl.store, r, route)
+		if err != nil {
+			// Without a decision, let the request through.
+			next.ServeHTTP(w, r)
+			return
+		}
+		setRateLimitHeaders(w.Header(), res)
+		if !res.Allowed {
+			rl.metrics.IncRateLimitRejected(p.Name, route)
+			retryAfter := max(1, seconds(res.RetryAfter))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			rl.rejection.Load().Write(w, ratelimit.RejectionData{
+				Policy:     p.Name,
+				Route:      route,
+				Limit:      res.Limit.Burst,
+				RetryAfter: retryAfter,
+				Reset:      seconds(res.ResetAfter),
+			})
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// setRateLimitHeaders describes res in the headers of draft-ietf-httpapi-
+// ratelimit-headers. The quota is the burst, replenished over the window in
+// which the rate adds a full burst.
+func setRateLimitHeaders(h http.Header, res ratelimit.Result) {
+	window := max(1, int(math.Ceil(float64(res.Limit.Burst)/res.Limit.Rate)))
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(max(0, res.Remaining)))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.ResetAfter)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", res.Limit.Burst, window))
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
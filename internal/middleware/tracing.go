@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/sdfpt05/go_load_balancer/v2"
+
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func NewTracer(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{tracer: tp.Tracer(tracerName), propagator: propagator}
+}
+
+// Trace extracts the incoming trace context and wraps the request in a server
+// span. The trace headers are removed from the request so that the upstream
+// transport injects its own client span as the parent instead.
+func (t *Tracer) Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ServerAddress(r.Host),
+				semconv.ClientAddress(clientIP(r)),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		fields := t.propagator.Fields()
+		for _, field := range fields {
+			r.Header.Del(field)
+		}
+		if slices.Contains(fields, "x-b3-traceid") {
+			// B3 lists only the headers it injects, but extracts the single
+			// header first, so a client's would win over the injected ones.
+			r.Header.Del("b3")
+			r.Header.Del("x-b3-parentspanid")
+		}
+
+		rw := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		status := rw.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
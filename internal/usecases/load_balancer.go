@@ -2,36 +2,175 @@ package usecases
 
 import (
 	"context"
+	"maps"
+	"sync"
 	"time"
 
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
 )
 
+const DefaultPoolName = "default"
+
 type LoadBalancerUseCase struct {
-	lb            domain.LoadBalancer
+	name           string
 	circuitBreaker *circuitbreaker.CircuitBreaker
+	metrics        *metrics.Metrics
+
+	mu            sync.RWMutex
+	lb            domain.LoadBalancer
+	maxRetries    int
+	proxyProtocol int
+	limiter       *concurrency.Limiter
+
+	queue serverQueue
+}
+
+type Option func(*LoadBalancerUseCase)
+
+// WithName sets the pool name used in logs and metric labels.
+func WithName(name string) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.name = name
+	}
+}
+
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.metrics = m
+	}
+}
+
+// WithMaxRetries sets how many times a request is retried on another backend
+// when the selected one cannot be reached.
+func WithMaxRetries(n int) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.maxRetries = n
+	}
 }
 
-func NewLoadBalancerUseCase(lb domain.LoadBalancer, cb *circuitbreaker.CircuitBreaker) *LoadBalancerUseCase {
-	return &LoadBalancerUseCase{
-		lb:            lb,
+// WithProxyProtocol makes connections to the pool's servers start with a
+// PROXY protocol header of the given version, 1 or 2. 0 disables it.
+func WithProxyProtocol(version int) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.proxyProtocol = version
+	}
+}
+
+// WithConcurrencyLimiter limits the HTTP requests in flight to the pool.
+func WithConcurrencyLimiter(l *concurrency.Limiter) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.limiter = l
+	}
+}
+
+func NewLoadBalancerUseCase(lb domain.LoadBalancer, cb *circuitbreaker.CircuitBreaker, opts ...Option) *LoadBalancerUseCase {
+	uc := &LoadBalancerUseCase{
+		name:           DefaultPoolName,
+		lb:             lb,
 		circuitBreaker: cb,
 	}
+	for _, opt := range opts {
+		opt(uc)
+	}
+	return uc
 }
 
+func (uc *LoadBalancerUseCase) Name() string {
+	return uc.name
+}
+
+func (uc *LoadBalancerUseCase) MaxRetries() int {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.maxRetries
+}
+
+func (uc *LoadBalancerUseCase) SetMaxRetries(n int) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.maxRetries = n
+}
+
+func (uc *LoadBalancerUseCase) ProxyProtocol() int {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.proxyProtocol
+}
+
+func (uc *LoadBalancerUseCase) SetProxyProtocol(version int) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.proxyProtocol = version
+}
+
+// ConcurrencyLimiter returns the limiter of the pool, or nil if its requests
+// are not limited.
+func (uc *LoadBalancerUseCase) ConcurrencyLimiter() *concurrency.Limiter {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.limiter
+}
+
+// SetConcurrencyLimiter replaces the limiter. Requests admitted by the
+// previous one are released to it.
+func (uc *LoadBalancerUseCase) SetConcurrencyLimiter(l *concurrency.Limiter) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.limiter = l
+}
+
+func (uc *LoadBalancerUseCase) LoadBalancer() domain.LoadBalancer {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.lb
+}
+
+// SetLoadBalancer atomically replaces the balancing algorithm. Requests that
+// already picked a server are not affected.
+func (uc *LoadBalancerUseCase) SetLoadBalancer(lb domain.LoadBalancer) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.lb = lb
+}
+
+// GetNextServer picks a server for the next request. A nil circuit breaker
+// disables the breaker for this pool. Finding every server at its connection
+// cap counts as neither a success nor a failure for the breaker, as those
+// servers are busy but were not reached.
 func (uc *LoadBalancerUseCase) GetNextServer(ctx context.Context) (*domain.Server, error) {
+	lb := uc.LoadBalancer()
+	if uc.circuitBreaker == nil {
+		return lb.NextServer(ctx)
+	}
+
 	var server *domain.Server
-	err := uc.circuitBreaker.Execute(func() error {
+	pick := func() error {
 		var err error
-		server, err = uc.lb.NextServer(ctx)
+		server, err = lb.NextServer(ctx)
+		if err != nil && uc.atCapacity() {
+			return circuitbreaker.Neutral(err)
+		}
 		return err
-	})
-	return server, err
+	}
+	err := uc.circuitBreaker.Execute(pick)
+	if err == nil && server == nil {
+		// The open breaker timed out and went half-open without picking;
+		// this request is its trial.
+		err = uc.circuitBreaker.Execute(pick)
+	}
+	uc.metrics.SetBreakerState(uc.name, int(uc.circuitBreaker.State()))
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
 func (uc *LoadBalancerUseCase) UpdateServerStatus(server *domain.Server) {
-	uc.lb.UpdateServer(server)
+	uc.LoadBalancer().UpdateServer(server)
 }
 
 func (uc *LoadBalancerUseCase) StartHealthCheck(ctx context.Context, interval time.Duration) {
@@ -43,19 +182,74 @@ func (uc *LoadBalancerUseCase) StartHealthCheck(ctx context.Context, interval ti
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			uc.lb.HealthCheck(ctx)
+			lb := uc.LoadBalancer()
+			checkCtx := ctx
+			if version := uc.ProxyProtocol(); version != 0 {
+				// Backends that require the header reject checks without.
+				checkCtx = proxyprotocol.WithLocalHeader(ctx, version)
+			}
+			lb.HealthCheck(checkCtx)
+			for _, server := range lb.GetServers() {
+				uc.metrics.ObserveHealthCheck(uc.name, server.URL.Host, server.Active.Load())
+			}
 		}
 	}
 }
 
 func (uc *LoadBalancerUseCase) AddServer(server *domain.Server) error {
-	return uc.lb.AddServer(server)
+	return uc.LoadBalancer().AddServer(server)
 }
 
 func (uc *LoadBalancerUseCase) RemoveServer(url string) error {
-	return uc.lb.RemoveServer(url)
+	return uc.LoadBalancer().RemoveServer(url)
 }
 
 func (uc *LoadBalancerUseCase) GetServers() []*domain.Server {
-	return uc.lb.GetServers()
+	return uc.LoadBalancer().GetServers()
+}
+
+// SyncServers makes servers the servers of the pool, with the least change:
+// servers already in the pool with the same URL are kept with their state
+// and connections, and take the attributes of the new ones if they changed.
+// Others are added or removed. It returns the URLs added and removed.
+func (uc *LoadBalancerUseCase) SyncServers(servers []*domain.Server) (added, removed []string) {
+	current := make(map[string]*domain.Server)
+	for _, s := range uc.GetServers() {
+		current[s.URL.String()] = s
+	}
+	kept := make(map[string]bool)
+	hosts := make(map[string]bool)
+	var fresh []*domain.Server
+	for _, s := range servers {
+		u := s.URL.String()
+		hosts[s.URL.Host] = true
+		existing, ok := current[u]
+		switch {
+		case !ok:
+			fresh = append(fresh, s)
+		case !kept[u] && !sameAttributes(existing, s):
+			uc.LoadBalancer().UpdateServer(s)
+		}
+		kept[u] = ok
+	}
+	for u, s := range current {
+		if !kept[u] {
+			uc.RemoveServer(u)
+			removed = append(removed, u)
+			if !hosts[s.URL.Host] {
+				uc.metrics.RemoveBackend(uc.name, s.URL.Host)
+			}
+		}
+	}
+	for _, s := range fresh {
+		if uc.AddServer(s) == nil {
+			added = append(added, s.URL.String())
+		}
+	}
+	return added, removed
+}
+
+func sameAttributes(a, b *domain.Server) bool {
+	return a.HealthCheckPath == b.HealthCheckPath && a.Weight == b.Weight && a.Zone == b.Zone &&
+		a.Priority == b.Priority && a.MaxConnections == b.MaxConnections && maps.Equal(a.Tags, b.Tags)
 }
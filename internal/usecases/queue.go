@@ -0,0 +1,203 @@
+package usecases
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+)
+
+var (
+	// ErrQueueFull is returned when every backend is at its connection cap
+	// and the queue holds as many requests as it may.
+	ErrQueueFull = errors.New("all backends at capacity and the queue is full")
+	// ErrQueueTimeout is returned when no backend got below its cap in
+	// time.
+	ErrQueueTimeout = errors.New("timed out waiting for a backend below its connection cap")
+
+	errAtCapacity = errors.New("all backends at capacity")
+)
+
+// serverQueue holds requests waiting for a backend below its connection cap,
+// first come first served. A released connection wakes the first waiter,
+// which then competes for a backend like a new request.
+type serverQueue struct {
+	mu      sync.Mutex
+	size    int
+	timeout time.Duration
+	waiters list.List // of *queueWaiter
+}
+
+type queueWaiter struct {
+	elem *list.Element
+	wake chan struct{}
+}
+
+// WithQueue lets up to size requests wait up to timeout for a backend when
+// every available one is at its MaxConnections. A size of 0 fails them
+// right away.
+func WithQueue(size int, timeout time.Duration) Option {
+	return func(uc *LoadBalancerUseCase) {
+		uc.queue.size = size
+		uc.queue.timeout = timeout
+	}
+}
+
+// SetQueue changes the queue limits. Requests already waiting keep their
+// timeout.
+func (uc *LoadBalancerUseCase) SetQueue(size int, timeout time.Duration) {
+	uc.queue.mu.Lock()
+	defer uc.queue.mu.Unlock()
+	uc.queue.size = size
+	uc.queue.timeout = timeout
+}
+
+// AcquireServer picks a server and counts the request against its
+// MaxConnections. When every server that is up is at its cap, the request
+// waits in the queue. The server must be handed back with ReleaseServer.
+func (uc *LoadBalancerUseCase) AcquireServer(ctx context.Context) (*domain.Server, error) {
+	server, err := uc.tryAcquire(ctx)
+	if server != nil || !uc.atCapacity() {
+		return server, err
+	}
+
+	start := time.Now()
+	w, timeout, queueErr := uc.queue.join()
+	switch {
+	case queueErr != nil:
+		uc.metrics.ObserveQueueWait(uc.name, "full", 0)
+		return nil, queueErr
+	case w == nil:
+		return nil, err
+	}
+	uc.metrics.SetQueueDepth(uc.name, uc.queue.len())
+	defer func() {
+		uc.queue.leave(w)
+		uc.metrics.SetQueueDepth(uc.name, uc.queue.len())
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// Tried after joining, so that a release in between is not missed.
+		server, err := uc.tryAcquire(ctx)
+		if server != nil {
+			uc.metrics.ObserveQueueWait(uc.name, "admitted", time.Since(start))
+			return server, nil
+		}
+		if !uc.atCapacity() {
+			return nil, err
+		}
+		select {
+		case <-w.wake:
+			uc.queue.rejoin(w)
+		case <-timer.C:
+			uc.metrics.ObserveQueueWait(uc.name, "timeout", time.Since(start))
+			return nil, ErrQueueTimeout
+		case <-ctx.Done():
+			uc.metrics.ObserveQueueWait(uc.name, "cancelled", time.Since(start))
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// TryAcquireServer is AcquireServer without the queue, for callers that
+// cannot wait, such as the UDP proxy, which creates flows as datagrams are
+// read.
+func (uc *LoadBalancerUseCase) TryAcquireServer(ctx context.Context) (*domain.Server, error) {
+	return uc.tryAcquire(ctx)
+}
+
+// ReleaseServer ends a request counted by AcquireServer and wakes the first
+// queued request.
+func (uc *LoadBalancerUseCase) ReleaseServer(server *domain.Server) int64 {
+	n := server.Release()
+	uc.queue.wakeFirst()
+	return n
+}
+
+// tryAcquire picks a server without waiting. A server picked while below
+// its cap may fill up before the request is counted; the pick is then
+// retried, as the algorithm skips it from now on.
+func (uc *LoadBalancerUseCase) tryAcquire(ctx context.Context) (*domain.Server, error) {
+	for range len(uc.GetServers()) + 1 {
+		server, err := uc.GetNextServer(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if server.Acquire() {
+			return server, nil
+		}
+	}
+	return nil, errAtCapacity
+}
+
+// atCapacity reports whether a server that is up is at its connection cap,
+// so waiting for it makes sense.
+func (uc *LoadBalancerUseCase) atCapacity() bool {
+	for _, s := range uc.GetServers() {
+		if s.AtCapacity() {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds a waiter to the queue, or returns none if there is no queue.
+func (q *serverQueue) join() (*queueWaiter, time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size == 0 {
+		return nil, 0, nil
+	}
+	if q.waiters.Len() >= q.size {
+		return nil, 0, ErrQueueFull
+	}
+	w := &queueWaiter{wake: make(chan struct{}, 1)}
+	w.elem = q.waiters.PushBack(w)
+	return w, q.timeout, nil
+}
+
+// rejoin puts a woken waiter that found no server back in first place.
+func (q *serverQueue) rejoin(w *queueWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.elem = q.waiters.PushFront(w)
+}
+
+// leave removes w from the queue. A wake up that w received but did not use
+// is passed on.
+func (q *serverQueue) leave(w *queueWaiter) {
+	q.mu.Lock()
+	if w.elem != nil {
+		q.waiters.Remove(w.elem)
+		w.elem = nil
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+	select {
+	case <-w.wake:
+		q.wakeFirst()
+	default:
+	}
+}
+
+func (q *serverQueue) wakeFirst() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if front := q.waiters.Front(); front != nil {
+		w := q.waiters.Remove(front).(*queueWaiter)
+		w.elem = nil
+		w.wake <- struct{}{}
+	}
+}
+
+func (q *serverQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
@@ -3,44 +3,487 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	RequestsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests",
-		},
-		[]string{"status"},
-	)
-
-	RequestDuration = prometheus.NewHistogram(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "Duration of HTTP requests in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-	)
-
-	ActiveConnections = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "active_connections",
-			Help: "Number of active connections per backend server",
-		},
-		[]string{"server"},
-	)
-)
+// Metrics holds the load balancer collectors. All methods are safe to call on
+// a nil *Metrics, which records nothing.
+type Metrics struct {
+	RequestsTotal     *prometheus.CounterVec
+	RequestDuration   *prometheus.HistogramVec
+	UpstreamLatency   *prometheus.HistogramVec
+	RetriesTotal      *prometheus.CounterVec
+	RequestBytes      *prometheus.CounterVec
+	ResponseBytes     *prometheus.CounterVec
+	ActiveConnections *prometheus.GaugeVec
+	HealthChecksTotal *prometheus.CounterVec
+	BackendUp         *prometheus.GaugeVec
+	BreakerState      *prometheus.GaugeVec
+	RateLimitRejected *prometheus.CounterVec
+	RateLimitErrors   *prometheus.CounterVec
+	ConcurrencyLimit  *prometheus.GaugeVec
+	ConcurrencyQueued *prometheus.GaugeVec
+	ConcurrencyShed   *prometheus.CounterVec
+	QueueDepth        *prometheus.GaugeVec
+	QueueWait         *prometheus.HistogramVec
+	TCPConnections    *prometheus.CounterVec
+	TCPBytes          *prometheus.CounterVec
+	UDPFlows          *prometheus.CounterVec
+	UDPActiveFlows    *prometheus.GaugeVec
+	UDPPackets        *prometheus.CounterVec
+	UDPBytes          *prometheus.CounterVec
+	CertificateExpiry *prometheus.GaugeVec
+}
+
+// New creates the collectors and registers them on reg. Each registry can only
+// hold one set, so tests should pass their own prometheus.NewRegistry().
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		RequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_total",
+				Help: "Total number of HTTP requests",
+			},
+			[]string{"route", "pool", "backend", "method", "code"},
+		),
+		RequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "Duration of HTTP requests in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route", "pool", "method"},
+		),
+		UpstreamLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "upstream_latency_seconds",
+				Help:    "Time until the backend returned response headers in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"pool", "backend"},
+		),
+		RetriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "upstream_retries_total",
+				Help: "Total number of requests retried on another backend",
+			},
+			[]string{"route", "pool"},
+		),
+		RequestBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_request_bytes_total",
+				Help: "Total number of request body bytes sent to backends",
+			},
+			[]string{"route", "pool", "backend"},
+		),
+		ResponseBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_response_bytes_total",
+				Help: "Total number of response body bytes received from backends",
+			},
+			[]string{"route", "pool", "backend"},
+		),
+		ActiveConnections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "active_connections",
+				Help: "Number of active connections per backend server",
+			},
+			[]string{"pool", "backend"},
+		),
+		HealthChecksTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "health_checks_total",
+				Help: "Total number of backend health checks by result",
+			},
+			[]string{"pool", "backend", "result"},
+		),
+		BackendUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "backend_up",
+				Help: "Whether the backend passed its last health check (1) or not (0)",
+			},
+			[]string{"pool", "backend"},
+		),
+		BreakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "circuit_breaker_state",
+				Help: "Circuit breaker state per pool: 0 closed, 1 half-open, 2 open",
+			},
+			[]string{"pool"},
+		),
+		RateLimitRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rate_limit_rejections_total",
+				Help: "Total number of requests rejected by the rate limiter",
+			},
+			[]string{"policy", "route"},
+		),
+		RateLimitErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rate_limit_store_errors_total",
+				Help: "Total number of rate limit decisions that failed in the shared store",
+			},
+			[]string{"store"},
+		),
+		ConcurrencyLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "concurrency_limit",
+				Help: "Current adaptive concurrency limit per pool",
+			},
+			[]string{"pool"},
+		),
+		ConcurrencyQueued: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "concurrency_queued_requests",
+				Help: "Requests waiting for the concurrency limit per pool",
+			},
+			[]string{"pool"},
+		),
+		ConcurrencyShed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "concurrency_shed_total",
+				Help: "Total number of requests shed by the concurrency limiter",
+			},
+			[]string{"pool", "priority", "reason"},
+		),
+		QueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "backend_queue_depth",
+				Help: "Requests waiting for a backend below its connection cap per pool",
+			},
+			[]string{"pool"},
+		),
+		QueueWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "backend_queue_wait_seconds",
+				Help:    "Time requests waited for a backend below its connection cap in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"pool", "result"},
+		),
+		TCPConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "tcp_connections_total",
+				Help: "Total number of TCP connections proxied to backends",
+			},
+			[]string{"listener", "pool", "backend"},
+		),
+		TCPBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "tcp_bytes_total",
+				Help: "Total number of bytes proxied over TCP, by direction: sent to (upstream) or received from (downstream) backends",
+			},
+			[]string{"listener", "pool", "backend", "direction"},
+		),
+		UDPFlows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "udp_flows_total",
+				Help: "Total number of UDP flows created",
+			},
+			[]string{"listener", "pool", "backend"},
+		),
+		UDPActiveFlows: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "udp_active_flows",
+				Help: "Number of UDP flows in the flow table",
+			},
+			[]string{"listener"},
+		),
+		UDPPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "udp_packets_total",
+				Help: "Total number of UDP datagrams proxied, by direction",
+			},
+			[]string{"listener", "pool", "backend", "direction"},
+		),
+		UDPBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "udp_bytes_total",
+				Help: "Total number of UDP payload bytes proxied, by direction",
+			},
+			[]string{"listener", "pool", "backend", "direction"},
+		),
+		CertificateExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "tls_certificate_expiry_timestamp_seconds",
+				Help: "Expiry time of each served TLS certificate as a Unix timestamp",
+			},
+			[]string{"cert_file", "subject"},
+		),
+	}
+
+	collectors := []prometheus.Collector{
+		m.RequestsTotal,
+		m.RequestDuration,
+		m.UpstreamLatency,
+		m.RetriesTotal,
+		m.RequestBytes,
+		m.ResponseBytes,
+		m.ActiveConnections,
+		m.HealthChecksTotal,
+		m.BackendUp,
+		m.BreakerState,
+		m.RateLimitRejected,
+		m.RateLimitErrors,
+		m.ConcurrencyLimit,
+		m.ConcurrencyQueued,
+		m.ConcurrencyShed,
+		m.QueueDepth,
+		m.QueueWait,
+		m.TCPConnections,
+		m.TCPBytes,
+		m.UDPFlows,
+		m.UDPActiveFlows,
+		m.UDPPackets,
+		m.UDPBytes,
+		m.CertificateExpiry,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Request describes a finished request for ObserveRequest.
+type Request struct {
+	Route    string
+	Pool     string
+	Backend  string
+	Method   string
+	Status   int
+	Duration time.Duration
+	BytesIn  int64
+	BytesOut int64
+}
+
+func (m *Metrics) ObserveRequest(r Request) {
+	if m == nil {
+		return
+	}
+	m.RequestsTotal.WithLabelValues(r.Route, r.Pool, r.Backend, r.Method, StatusClass(r.Status)).Inc()
+	m.RequestDuration.WithLabelValues(r.Route, r.Pool, r.Method).Observe(r.Duration.Seconds())
+	if r.Backend != "" {
+		m.RequestBytes.WithLabelValues(r.Route, r.Pool, r.Backend).Add(float64(r.BytesIn))
+		m.ResponseBytes.WithLabelValues(r.Route, r.Pool, r.Backend).Add(float64(r.BytesOut))
+	}
+}
+
+func (m *Metrics) ObserveUpstreamLatency(pool, backend string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.UpstreamLatency.WithLabelValues(pool, backend).Observe(d.Seconds())
+}
+
+func (m *Metrics) IncRetries(route, pool string) {
+	if m == nil {
+		return
+	}
+	m.RetriesTotal.WithLabelValues(route, pool).Inc()
+}
+
+func (m *Metrics) SetActiveConnections(pool, backend string, n int64) {
+	if m == nil {
+		return
+	}
+	m.ActiveConnections.WithLabelValues(pool, backend).Set(float64(n))
+}
+
+func (m *Metrics) ObserveHealthCheck(pool, backend string, healthy bool) {
+	if m == nil {
+		return
+	}
+	result, up := "failure", 0.0
+	if healthy {
+		result, up = "success", 1.0
+	}
+	m.HealthChecksTotal.WithLabelValues(pool, backend, result).Inc()
+	m.BackendUp.WithLabelValues(pool, backend).Set(up)
+}
+
+func (m *Metrics) SetBreakerState(pool string, state int) {
+	if m == nil {
+		return
+	}
+	m.BreakerState.WithLabelValues(pool).Set(float64(state))
+}
+
+func (m *Metrics) IncRateLimitRejected(policy, route string) {
+	if m == nil {
+		return
+	}
+	m.RateLimitRejected.WithLabelValues(policy, route).Inc()
+}
+
+func (m *Metrics) IncRateLimitErrors(store string) {
+	if m == nil {
+		return
+	}
+	m.RateLimitErrors.WithLabelValues(store).Inc()
+}
+
+func (m *Metrics) SetConcurrency(pool string, limit, queued int) {
+	if m == nil {
+		return
+	}
+	m.ConcurrencyLimit.WithLabelValues(pool).Set(float64(limit))
+	m.ConcurrencyQueued.WithLabelValues(pool).Set(float64(queued))
+}
+
+func (m *Metrics) SetQueueDepth(pool string, n int) {
+	if m == nil {
+		return
+	}
+	m.QueueDepth.WithLabelValues(pool).Set(float64(n))
+}
+
+// ObserveQueueWait records how long a request waited and whether it got a
+// backend ("admitted"), gave up ("timeout", "cancelled") or found the queue
+// full ("full").
+func (m *Metrics) ObserveQueueWait(pool, result string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.QueueWait.WithLabelValues(pool, result).Observe(d.Seconds())
+}
+
+func (m *Metrics) IncConcurrencyShed(pool, priority, reason string) {
+	if m == nil {
+		return
+	}
+	m.ConcurrencyShed.WithLabelValues(pool, priority, reason).Inc()
+}
+
+func (m *Metrics) IncTCPConnections(listener, pool, backend string) {
+	if m == nil {
+		return
+	}
+	m.TCPConnections.WithLabelValues(listener, pool, backend).Inc()
+}
+
+// AddTCPBytes records n bytes proxied in direction "upstream" (client to
+// backend) or "downstream" (backend to client).
+func (m *Metrics) AddTCPBytes(listener, pool, backend, direction string, n int64) {
+	if m == nil {
+		return
+	}
+	m.TCPBytes.WithLabelValues(listener, pool, backend, direction).Add(float64(n))
+}
+
+func (m *Metrics) IncUDPFlows(listener, pool, backend string) {
+	if m == nil {
+		return
+	}
+	m.UDPFlows.WithLabelValues(listener, pool, backend).Inc()
+}
+
+func (m *Metrics) SetUDPActiveFlows(listener string, n int) {
+	if m == nil {
+		return
+	}
+	m.UDPActiveFlows.WithLabelValues(listener).Set(float64(n))
+}
 
-func Setup(metricsPort int) {
-	prometheus.MustRegister(RequestsTotal)
-	prometheus.MustRegister(RequestDuration)
-	prometheus.MustRegister(ActiveConnections)
+// ObserveUDPPacket records one datagram of n bytes in direction "upstream"
+// or "downstream".
+func (m *Metrics) ObserveUDPPacket(listener, pool, backend, direction string, n int) {
+	if m == nil {
+		return
+	}
+	m.UDPPackets.WithLabelValues(listener, pool, backend, direction).Inc()
+	m.UDPBytes.WithLabelValues(listener, pool, backend, direction).Add(float64(n))
+}
+
+func (m *Metrics) SetCertificateExpiry(certFile, subject string, notAfter time.Time) {
+	if m == nil {
+		return
+	}
+	m.CertificateExpiry.WithLabelValues(certFile, subject).Set(float64(notAfter.Unix()))
+}
+
+// ResetCertificateExpiry forgets all certificates, e.g. before the new set
+// of a reload is recorded.
+func (m *Metrics) ResetCertificateExpiry() {
+	if m == nil {
+		return
+	}
+	m.CertificateExpiry.Reset()
+}
+
+// RemoveBackend deletes the series of a backend that left pool, so that
+// backends coming and going through discovery do not accumulate series.
+func (m *Metrics) RemoveBackend(pool, backend string) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"pool": pool, "backend": backend}
+	for _, v := range m.backendVecs() {
+		v.DeletePartialMatch(labels)
+	}
+}
+
+// RemovePool deletes all series of a removed pool, including those of its
+// backends.
+func (m *Metrics) RemovePool(pool string) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"pool": pool}
+	for _, v := range m.backendVecs() {
+		v.DeletePartialMatch(labels)
+	}
+	for _, v := range []*prometheus.MetricVec{
+		m.RequestDuration.MetricVec,
+		m.RetriesTotal.MetricVec,
+		m.BreakerState.MetricVec,
+		m.ConcurrencyLimit.MetricVec,
+		m.ConcurrencyQueued.MetricVec,
+		m.ConcurrencyShed.MetricVec,
+		m.QueueDepth.MetricVec,
+		m.QueueWait.MetricVec,
+	} {
+		v.DeletePartialMatch(labels)
+	}
+}
+
+// backendVecs returns the vectors labelled by pool and backend.
+func (m *Metrics) backendVecs() []*prometheus.MetricVec {
+	return []*prometheus.MetricVec{
+		m.RequestsTotal.MetricVec,
+		m.UpstreamLatency.MetricVec,
+		m.RequestBytes.MetricVec,
+		m.ResponseBytes.MetricVec,
+		m.ActiveConnections.MetricVec,
+		m.HealthChecksTotal.MetricVec,
+		m.BackendUp.MetricVec,
+		m.TCPConnections.MetricVec,
+		m.TCPBytes.MetricVec,
+		m.UDPFlows.MetricVec,
+		m.UDPPackets.MetricVec,
+		m.UDPBytes.MetricVec,
+	}
+}
+
+// StatusClass returns the status code class used as the "code" label, e.g. "2xx".
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
 
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		http.ListenAndServe(fmt.Sprintf(":%d", metricsPort), nil)
-	}()
+// NewServer returns an HTTP server exposing the metrics in g on /metrics.
+func NewServer(metricsPort int, g prometheus.Gatherer) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", metricsPort),
+		Handler: mux,
+	}
 }
@@ -0,0 +1,498 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is a minimal RFC 8555 CA. It validates HTTP-01 challenges by
+// fetching the token from httpAddr and TLS-ALPN-01 challenges by a handshake
+// with tlsAddr, then signs certificates with ca. Request signatures are not
+// verified.
+type fakeACME struct {
+	t          *testing.T
+	srv        *httptest.Server
+	ca         *testCA
+	challenges []string
+	// shortFirst makes the first certificate expire within an hour so it
+	// is renewed right away.
+	shortFirst bool
+
+	mu         sync.Mutex
+	httpAddr   string
+	tlsAddr    string
+	thumbprint string
+	orders     []*fakeOrder
+}
+
+type fakeOrder struct {
+	domain string
+	token  string
+	status string // pending, ready, valid or invalid
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T, challenges ...string) *fakeACME {
+	f := &fakeACME{t: t, ca: newTestCA(t), challenges: challenges}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", f.directory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /account", f.newAccount)
+	mux.HandleFunc("POST /order", f.newOrder)
+	mux.HandleFunc("POST /order/{id}", f.getOrder)
+	mux.HandleFunc("POST /authz/{id}", f.getAuthz)
+	mux.HandleFunc("POST /challenge/{id}/{type}", f.accept)
+	mux.HandleFunc("POST /finalize/{id}", f.finalize)
+	mux.HandleFunc("POST /cert/{id}", f.getCert)
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// caFile writes the certificate of the directory server for ACMEOptions.
+func (f *fakeACME) caFile(dir string) string {
+	file := filepath.Join(dir, "directory-ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		f.t.Fatalf("Unexpected error: %v", err)
+	}
+	return file
+}
+
+func (f *fakeACME) orderCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.orders)
+}
+
+func (f *fakeACME) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   f.srv.URL + "/nonce",
+		"newAccount": f.srv.URL + "/account",
+		"newOrder":   f.srv.URL + "/order",
+		"revokeCert": f.srv.URL + "/revoke",
+		"keyChange":  f.srv.URL + "/key-change",
+	})
+}
+
+// readJWS decodes the payload of a signed request into v and returns the
+// JWK of the protected header, which is only sent on account creation.
+func readJWS(r *http.Request, v any) (jwk json.RawMessage) {
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	var protected struct {
+		JWK json.RawMessage `json:"jwk"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(jws.Protected); err == nil {
+		json.Unmarshal(data, &protected)
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(jws.Payload); err == nil && len(data) > 0 && v != nil {
+		json.Unmarshal(data, v)
+	}
+	return protected.JWK
+}
+
+func (f *fakeACME) newAccount(w http.ResponseWriter, r *http.Request) {
+	var jwk struct{ Crv, X, Y string }
+	json.Unmarshal(readJWS(r, nil), &jwk)
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	thumbprint, err := acme.JWKThumbprint(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.thumbprint = thumbprint
+	f.mu.Unlock()
+	w.Header().Set("Location", f.srv.URL+"/account/1")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+}
+
+func (f *fakeACME) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Value string }
+	}
+	readJWS(r, &req)
+	f.mu.Lock()
+	id := len(f.orders)
+	f.orders = append(f.orders, &fakeOrder{domain: req.Identifiers[0].Value, token: fmt.Sprintf("token-%d", id), status: "pending"})
+	f.mu.Unlock()
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.srv.URL, id))
+	w.WriteHeader(http.StatusCreated)
+	f.writeOrder(w, id)
+}
+
+func (f *fakeACME) order(r *http.Request) (int, *fakeOrder) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return id, f.orders[id]
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, id int) {
+	f.mu.Lock()
+	o := *f.orders[id]
+	f.mu.Unlock()
+	resp := map[string]any{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", f.srv.URL, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", f.srv.URL, id),
+	}
+	if o.cert != nil {
+		resp["certificate"] = fmt.Sprintf("%s/cert/%d", f.srv.URL, id)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeACME) getOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := f.order(r)
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.srv.URL, id))
+	f.writeOrder(w, id)
+}
+
+// authzStatus maps the order status to that of its single authorization.
+func authzStatus(order string) string {
+	switch order {
+	case "pending", "invalid":
+		return order
+	}
+	return "valid"
+}
+
+func (f *fakeACME) getAuthz(w http.ResponseWriter, r *http.Request) {
+	id, o := f.order(r)
+	f.mu.Lock()
+	status, domain, token := authzStatus(o.status), o.domain, o.token
+	f.mu.Unlock()
+	var challenges []map[string]string
+	for _, typ := range f.challenges {
+		challenges = append(challenges, map[string]string{
+			"type":   typ,
+			"url":    fmt.Sprintf("%s/challenge/%d/%s", f.srv.URL, id, typ),
+			"token":  token,
+			"status": status,
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": domain},
+		"challenges": challenges,
+	})
+}
+
+func (f *fakeACME) accept(w http.ResponseWriter, r *http.Request) {
+	id, o := f.order(r)
+	f.mu.Lock()
+	domain, keyAuth := o.domain, o.token+"."+f.thumbprint
+	f.mu.Unlock()
+
+	typ := r.PathValue("type")
+	err := f.validate(typ, domain, keyAuth)
+	status := "ready"
+	if err != nil {
+		f.t.Logf("%s validation of %s failed: %v", typ, domain, err)
+		status = "invalid"
+	}
+	f.mu.Lock()
+	o.status = status
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   typ,
+		"url":    fmt.Sprintf("%s/challenge/%d/%s", f.srv.URL, id, typ),
+		"token":  o.token,
+		"status": authzStatus(status),
+	})
+}
+
+func (f *fakeACME) validate(typ, domain, keyAuth string) error {
+	f.mu.Lock()
+	httpAddr, tlsAddr := f.httpAddr, f.tlsAddr
+	f.mu.Unlock()
+
+	token, _, _ := bytes.Cut([]byte(keyAuth), []byte("."))
+	switch typ {
+	case "http-01":
+		req, _ := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/.well-known/acme-challenge/"+string(token), nil)
+		req.Host = domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("unexpected key authorization %q", body)
+		}
+		return nil
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{
+			ServerName:         domain,
+			NextProtos:         []string{certs.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != certs.ALPNProto {
+			return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+		}
+		leaf := state.PeerCertificates[0]
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return err
+		}
+		want := sha256.Sum256([]byte(keyAuth))
+		for _, ext := range leaf.Extensions {
+			var got []byte
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+				if _, err := asn1.Unmarshal(ext.Value, &got); err == nil && bytes.Equal(got, want[:]) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no matching acmeIdentifier extension")
+	}
+	return fmt.Errorf("unsupported challenge %s", typ)
+}
+
+func (f *fakeACME) finalize(w http.ResponseWriter, r *http.Request) {
+	var req struct{ CSR string }
+	readJWS(r, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, o := f.order(r)
+
+	f.mu.Lock()
+	lifetime := 90 * 24 * time.Hour
+	if f.shortFirst && id == 0 {
+		lifetime = time.Hour
+	}
+	f.mu.Unlock()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca.cert, csr.PublicKey, f.ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	o.status, o.cert = "valid", cert
+	f.mu.Unlock()
+	f.writeOrder(w, id)
+}
+
+func (f *fakeACME) getCert(w http.ResponseWriter, r *http.Request) {
+	_, o := f.order(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.cert})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.ca.cert.Raw})
+}
+
+// startACMEFrontend serves issuer on a TLS and a plain HTTP listener, as the
+// balancer does, and points the CA at them.
+func startACMEFrontend(t *testing.T, ca *fakeACME, issuer *certs.ACME) string {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(issuer.HTTPHandler(http.NotFoundHandler()))
+	t.Cleanup(plain.Close)
+	lb := httptest.NewUnstartedServer(ok)
+	lb.TLS = &tls.Config{
+		GetCertificate: issuer.GetCertificate,
+		NextProtos:     []string{"http/1.1", certs.ALPNProto},
+	}
+	lb.StartTLS()
+	t.Cleanup(lb.Close)
+
+	ca.mu.Lock()
+	ca.httpAddr, ca.tlsAddr = plain.Listener.Addr().String(), lb.Listener.Addr().String()
+	ca.mu.Unlock()
+	return lb.Listener.Addr().String()
+}
+
+func TestACMEHTTP01AndRenewal(t *testing.T) {
+	t.Parallel()
+
+	ca := newFakeACME(t, "http-01")
+	ca.shortFirst = true
+	dir := t.TempDir()
+	issuer, err := certs.NewACME(certs.ACMEOptions{
+		DirectoryURL: ca.srv.URL + "/directory",
+		CAFile:       ca.caFile(dir),
+		Domains:      []string{"lb.example.com"},
+		CacheDir:     filepath.Join(dir, "cache"),
+		RenewBefore:  720 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	addr := startACMEFrontend(t, ca, issuer)
+
+	if err := issuer.Obtain(); err != nil {
+		t.Fatalf("Expected certificate to be obtained, got %v", err)
+	}
+	for _, file := range []string{"acme_account+key", "lb.example.com"} {
+		if _, err := os.Stat(filepath.Join(dir, "cache", file)); err != nil {
+			t.Errorf("Expected %s in the cache: %v", file, err)
+		}
+	}
+
+	// The first certificate expires within the renewal window, so it is
+	// replaced in the background.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		cert := acmeServedCert(t, addr, "lb.example.com", ca.ca)
+		if cert.NotAfter.After(time.Now().Add(24 * time.Hour)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected certificate to be renewed, still expires at %v", cert.NotAfter)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := ca.orderCount(); n < 2 {
+		t.Errorf("Expected a second order for the renewal, got %d", n)
+	}
+}
+
+func TestACMETLSALPN01AndCache(t *testing.T) {
+	t.Parallel()
+
+	ca := newFakeACME(t, "tls-alpn-01")
+	dir := t.TempDir()
+	opts := certs.ACMEOptions{
+		DirectoryURL: ca.srv.URL + "/directory",
+		CAFile:       ca.caFile(dir),
+		Domains:      []string{"api.example.com", "www.example.com"},
+		CacheDir:     filepath.Join(dir, "cache"),
+		RenewBefore:  720 * time.Hour,
+	}
+	issuer, err := certs.NewACME(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	addr := startACMEFrontend(t, ca, issuer)
+	if err := issuer.Obtain(); err != nil {
+		t.Fatalf("Expected certificates to be obtained, got %v", err)
+	}
+	if cert := acmeServedCert(t, addr, "www.example.com", ca.ca); cert.DNSNames[0] != "www.example.com" {
+		t.Errorf("Expected certificate for www.example.com, got %v", cert.DNSNames)
+	}
+
+	// After a restart, the certificates come from the cache.
+	orders := ca.orderCount()
+	restarted, err := certs.NewACME(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	addr = startACMEFrontend(t, ca, restarted)
+	if err := restarted.Obtain(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := ca.orderCount(); n != orders {
+		t.Errorf("Expected no new orders after restart, got %d more", n-orders)
+	}
+	if cert := acmeServedCert(t, addr, "api.example.com", ca.ca); cert.DNSNames[0] != "api.example.com" {
+		t.Errorf("Expected certificate for api.example.com, got %v", cert.DNSNames)
+	}
+}
+
+func TestACMEStop(t *testing.T) {
+	t.Parallel()
+
+	ca := newFakeACME(t, "http-01")
+	ca.shortFirst = true
+	dir := t.TempDir()
+	issuer, err := certs.NewACME(certs.ACMEOptions{
+		DirectoryURL: ca.srv.URL + "/directory",
+		CAFile:       ca.caFile(dir),
+		Domains:      []string{"lb.example.com"},
+		CacheDir:     filepath.Join(dir, "cache"),
+		RenewBefore:  720 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	startACMEFrontend(t, ca, issuer)
+	if err := issuer.Obtain(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The certificate is due for renewal, which a stopped issuer must not
+	// write to the cache it shares with its replacement.
+	issuer.Stop()
+	time.Sleep(time.Second)
+	data, err := os.ReadFile(filepath.Join(dir, "cache", "lb.example.com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	block, rest := pem.Decode(data)
+	for block != nil && block.Type != "CERTIFICATE" {
+		block, rest = pem.Decode(rest)
+	}
+	if block == nil {
+		t.Fatal("Expected a certificate in the cache")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cert.NotAfter.After(time.Now().Add(24 * time.Hour)) {
+		t.Errorf("Expected the certificate not to be renewed after Stop, expires at %v", cert.NotAfter)
+	}
+}
+
+// acmeServedCert returns the certificate served for serverName, verified
+// against the fake CA.
+func acmeServedCert(t *testing.T, addr, serverName string, ca *testCA) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: ca.pool()})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
@@ -0,0 +1,202 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+// writeCert writes a self-signed certificate for names and its key to dir as
+// <file>.crt and <file>.key. The first name is the subject common name.
+func writeCert(t *testing.T, dir, file string, notAfter time.Time, names ...string) certs.Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pair := certs.Pair{CertFile: filepath.Join(dir, file+".crt"), KeyFile: filepath.Join(dir, file+".key")}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return pair
+}
+
+// servedCert returns the common name of the certificate served to a client
+// asking for serverName.
+func servedCert(t *testing.T, addr, serverName string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertStoreSelectsBySNIAndReloads(t *testing.T) {
+	t.Parallel()
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir := t.TempDir()
+	expiry := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	pairs := []certs.Pair{
+		writeCert(t, dir, "default", expiry, "default.example.com"),
+		writeCert(t, dir, "api", expiry, "api.example.com"),
+		writeCert(t, dir, "wildcard", expiry, "*.example.com"),
+	}
+	store := certs.NewStore(certs.WithMetrics(m))
+	if err := store.Load(pairs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: store.GetCertificate})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().String()
+
+	for serverName, want := range map[string]string{
+		"api.example.com":  "api.example.com",
+		"API.example.com.": "api.example.com",
+		"www.example.com":  "*.example.com",
+		"a.b.example.com":  "default.example.com",
+		"other.org":        "default.example.com",
+	} {
+		if got := servedCert(t, addr, serverName); got != want {
+			t.Errorf("%s: expected certificate %s, got %s", serverName, want, got)
+		}
+	}
+
+	got := testutil.ToFloat64(m.CertificateExpiry.WithLabelValues(pairs[1].CertFile, "api.example.com"))
+	if int64(got) != expiry.Unix() {
+		t.Errorf("Expected expiry %d, got %v", expiry.Unix(), got)
+	}
+
+	// A renewed certificate is served after a reload, and a broken one keeps
+	// the current certificates.
+	writeCert(t, dir, "api", expiry, "api.example.com", "renewed.example.com")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := servedCert(t, addr, "renewed.example.com"); got != "api.example.com" {
+		t.Errorf("Expected renewed certificate, got %s", got)
+	}
+	if err := os.WriteFile(pairs[1].KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatal("Expected reload of a broken key to fail")
+	}
+	if got := servedCert(t, addr, "renewed.example.com"); got != "api.example.com" {
+		t.Errorf("Expected certificate to be kept after failed reload, got %s", got)
+	}
+}
+
+func TestTicketKeysRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	store := certs.NewStore()
+	if err := store.Load([]certs.Pair{writeCert(t, dir, "default", time.Now().Add(time.Hour), "localhost")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keys, err := certs.NewTicketKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := &tls.Config{GetCertificate: store.GetCertificate, MaxVersion: tls.VersionTLS12}
+	keys.Apply(cfg)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	client := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	resumed := func() bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	resumed()
+	// A ticket issued before one rotation still resumes, and is replaced by
+	// one under the new key; after two rotations the old key is gone.
+	keys.Rotate()
+	if !resumed() {
+		t.Error("Expected session to resume after one rotation")
+	}
+	keys.Rotate()
+	keys.Rotate()
+	if resumed() {
+		t.Error("Expected session not to resume after its key was dropped")
+	}
+}
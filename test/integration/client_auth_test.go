@@ -0,0 +1,211 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/certs"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"go.uber.org/zap"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate signed by ca for the given common name, DNS
+// names and URIs, usable for client and server authentication.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames []string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Test"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificateRoutes(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"subject":     r.Header.Get("X-Client-Cert-Subject"),
+			"sans":        r.Header.Get("X-Client-Cert-SANs"),
+			"fingerprint": r.Header.Get("X-Client-Cert-Fingerprint"),
+		})
+	}))
+	defer backend.Close()
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil)
+
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop())
+	handler.SetRoutes([]interfaces.Route{{
+		Name:       "internal",
+		PathPrefix: "/internal/",
+		Pool:       pool,
+		ClientAuth: &certs.Allowlist{SANs: []string{"spiffe://example.org/billing"}},
+	}}, pool)
+	handler.SetClientCertHeaders(interfaces.ClientCertHeaders{
+		Subject:     "X-Client-Cert-Subject",
+		SANs:        "X-Client-Cert-SANs",
+		Fingerprint: "X-Client-Cert-Fingerprint",
+	})
+
+	ca := newTestCA(t)
+	lb := httptest.NewUnstartedServer(handler)
+	lb.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "lb.test", []string{"lb.test"})},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool(),
+	}
+	lb.StartTLS()
+	defer lb.Close()
+
+	get := func(path string, cert *tls.Certificate) (int, map[string]string) {
+		t.Helper()
+		cfg := &tls.Config{RootCAs: ca.pool(), ServerName: "lb.test"}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		req, _ := http.NewRequest(http.MethodGet, lb.URL+path, nil)
+		req.Header.Set("X-Client-Cert-Subject", "CN=forged")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		var identity map[string]string
+		json.NewDecoder(resp.Body).Decode(&identity)
+		return resp.StatusCode, identity
+	}
+
+	billing := ca.issue(t, "billing", []string{"billing.internal"}, "spiffe://example.org/billing")
+	other := ca.issue(t, "other", []string{"other.internal"}, "spiffe://example.org/other")
+
+	if code, identity := get("/public", nil); code != http.StatusOK || identity["subject"] != "" {
+		t.Errorf("Expected public route without identity, got %d %v", code, identity)
+	}
+	if code, _ := get("/internal/x", nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a certificate, got %d", code)
+	}
+	if code, _ := get("/internal/x", &other); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a certificate outside the allowlist, got %d", code)
+	}
+
+	code, identity := get("/internal/x", &billing)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 for an allowed certificate, got %d", code)
+	}
+	id := certs.IdentityOf(mustParseCert(t, billing))
+	if identity["subject"] != "CN=billing,O=Test" {
+		t.Errorf("Unexpected subject header %q", identity["subject"])
+	}
+	if identity["sans"] != "DNS:billing.internal,URI:spiffe://example.org/billing" {
+		t.Errorf("Unexpected SANs header %q", identity["sans"])
+	}
+	if identity["fingerprint"] != id.Fingerprint {
+		t.Errorf("Expected fingerprint %s, got %q", id.Fingerprint, identity["fingerprint"])
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	cert := mustParseCert(t, ca.issue(t, "svc", []string{"svc.prod.internal"}))
+	tests := []struct {
+		allowlist certs.Allowlist
+		allowed   bool
+	}{
+		{certs.Allowlist{}, true},
+		{certs.Allowlist{CommonNames: []string{"svc"}}, true},
+		{certs.Allowlist{SANs: []string{"*.prod.internal"}}, true},
+		{certs.Allowlist{SANs: []string{"*.internal"}}, false},
+		{certs.Allowlist{SANs: []string{"svc.dev.internal"}, CommonNames: []string{"other"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.allowlist.Check(cert) == nil; got != tt.allowed {
+			t.Errorf("%+v: expected allowed=%v, got %v", tt.allowlist, tt.allowed, got)
+		}
+	}
+}
+
+func mustParseCert(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return parsed
+}
@@ -0,0 +1,105 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func TestConcurrencyLimitShedsByPriority(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limiter, err := concurrency.New(concurrency.Options{
+		InitialLimit:   1,
+		MaxLimit:       1,
+		QueueSize:      1,
+		QueueTimeout:   time.Minute,
+		PriorityHeader: "X-Priority",
+	}, concurrency.WithMetrics(m, "api"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithName("api"), usecases.WithConcurrencyLimiter(limiter))
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop())
+	handler.SetRoutes([]interfaces.Route{{Name: "batch", PathPrefix: "/batch/", Pool: pool, Priority: concurrency.Sheddable}}, pool)
+
+	var wg sync.WaitGroup
+	codes := make(map[string]int)
+	var mu sync.Mutex
+	send := func(name, path, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if priority != "" {
+				req.Header.Set("X-Priority", priority)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			mu.Lock()
+			codes[name] = rec.Code
+			mu.Unlock()
+		}()
+	}
+	waitQueued := func(n int) {
+		for limiter.Queued() != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send("first", "/", "")
+	for atomic.LoadInt64(&server.Connections) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	send("batch", "/batch/job", "")
+	waitQueued(1)
+	// A sheddable route gives way to a request of normal priority.
+	send("normal", "/", "")
+	for testutil.ToFloat64(m.ConcurrencyShed.WithLabelValues("api", "sheddable", "evicted")) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	waitQueued(1)
+	// The header overrides the route, and the queue is full of requests
+	// that are not lower.
+	send("header", "/batch/job", "normal")
+	for testutil.ToFloat64(m.ConcurrencyShed.WithLabelValues("api", "normal", "limit")) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	want := map[string]int{"first": http.StatusOK, "batch": http.StatusServiceUnavailable, "normal": http.StatusOK, "header": http.StatusServiceUnavailable}
+	for name, code := range want {
+		if codes[name] != code {
+			t.Errorf("Expected %d for %s, got %d", code, name, codes[name])
+		}
+	}
+}
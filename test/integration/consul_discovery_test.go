@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+)
+
+// fakeConsul imitates the health endpoint of the Consul agent, including
+// blocking queries.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	entries  []map[string]interface{}
+	failing  bool
+	changed  chan struct{}
+	requests []*http.Request
+}
+
+func startFakeConsul(t *testing.T) (*fakeConsul, string) {
+	t.Helper()
+	f := &fakeConsul{index: 10, changed: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func consulInstance(address string, port int, status string, meta map[string]string, tags ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"Node": map[string]interface{}{"Node": "node-" + address, "Address": address},
+		"Service": map[string]interface{}{
+			"Service": "api",
+			"Address": "",
+			"Port":    port,
+			"Tags":    tags,
+			"Meta":    meta,
+			"Weights": map[string]int{"Passing": 1, "Warning": 1},
+		},
+		"Checks": []map[string]string{{"Status": "passing"}, {"Status": status}},
+	}
+}
+
+func (f *fakeConsul) set(entries ...map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) fail(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/api" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index == f.index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	if f.failing {
+		http.Error(w, "No cluster leader", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	json.NewEncoder(w).Encode(f.entries)
+}
+
+func (f *fakeConsul) lastRequest() *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeConsul(t)
+	fake.set(
+		consulInstance("10.0.0.1", 8080, "passing", map[string]string{"zone": "eu-west-1a", "weight": "3", "version": "v2"}, "canary", "team=search"),
+		consulInstance("10.0.0.2", 8080, "warning", nil),
+		consulInstance("10.0.0.3", 8080, "critical", nil),
+	)
+	provider, err := discovery.NewConsulProvider(discovery.ConsulOptions{
+		Address:       addr,
+		Service:       "api",
+		Tag:           "production",
+		Token:         "secret",
+		WaitTime:      time.Minute,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updates := runProvider(t, provider)
+
+	u := nextUpdate(t, updates)
+	if want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}; u.Err != nil || !slices.Equal(serverURLs(u), want) {
+		t.Fatalf("Expected the passing and warning instances %v, got %v (%v)", want, serverURLs(u), u.Err)
+	}
+	for _, s := range u.Servers {
+		if s.URL.Host != "10.0.0.1:8080" {
+			continue
+		}
+		if s.Zone != "eu-west-1a" || s.Weight != 3 || s.Tags["version"] != "v2" || s.Tags["team"] != "search" {
+			t.Errorf("Unexpected attributes: zone %q, weight %d, tags %v", s.Zone, s.Weight, s.Tags)
+		}
+		if _, ok := s.Tags["canary"]; !ok {
+			t.Errorf("Expected the canary tag, got %v", s.Tags)
+		}
+	}
+	r := fake.lastRequest()
+	if r.Header.Get("X-Consul-Token") != "secret" || r.URL.Query().Get("tag") != "production" {
+		t.Errorf("Expected the token and tag to be sent, got %q and %q", r.Header.Get("X-Consul-Token"), r.URL.Query().Get("tag"))
+	}
+
+	// The provider waits in a blocking query and sees the change right away.
+	waitFor(t, func() bool { return fake.lastRequest().URL.Query().Get("index") == "11" })
+	fake.set(consulInstance("10.0.0.4", 8080, "passing", nil))
+	u = nextUpdate(t, updates)
+	if want := []string{"http://10.0.0.4:8080"}; u.Err != nil || !slices.Equal(serverURLs(u), want) {
+		t.Errorf("Expected %v after the change, got %v (%v)", want, serverURLs(u), u.Err)
+	}
+
+	fake.fail(true)
+	fake.set(consulInstance("10.0.0.5", 8080, "passing", nil))
+	if u := nextUpdate(t, updates); u.Err == nil {
+		t.Errorf("Expected an error while Consul fails, got %v", serverURLs(u))
+	}
+	fake.fail(false)
+	for u = nextUpdate(t, updates); u.Err != nil; u = nextUpdate(t, updates) {
+	}
+	if want := []string{"http://10.0.0.5:8080"}; !slices.Equal(serverURLs(u), want) {
+		t.Errorf("Expected %v after Consul recovered, got %v", want, serverURLs(u))
+	}
+
+	// Without usable instances the servers are kept.
+	fake.set(consulInstance("10.0.0.5", 8080, "critical", nil))
+	if u := nextUpdate(t, updates); u.Err == nil {
+		t.Errorf("Expected an error without usable instances, got %v", serverURLs(u))
+	}
+}
+
+func TestConsulDiscoverySkipsInvalidInstances(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeConsul(t)
+	fake.set(
+		consulInstance("10.0.0.1", 8080, "passing", map[string]string{"weight": "abc"}),
+		consulInstance("10.0.0.2", 8080, "passing", nil),
+		consulInstance("10.0.0.3", 8080, "passing", map[string]string{"zone": "a"}),
+		consulInstance("10.0.0.3", 8080, "passing", map[string]string{"zone": "b"}),
+	)
+	provider, err := discovery.NewConsulProvider(discovery.ConsulOptions{Address: addr, Service: "api", RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updates := runProvider(t, provider)
+
+	// The bad instance does not keep the others out, and instances at the
+	// same address are used once.
+	u := nextUpdate(t, updates)
+	if want := []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080"}; u.Err != nil || !slices.Equal(serverURLs(u), want) {
+		t.Fatalf("Expected %v, got %v (%v)", want, serverURLs(u), u.Err)
+	}
+	if len(u.Skipped) != 1 {
+		t.Errorf("Expected the invalid instance to be reported, got %v", u.Skipped)
+	}
+	if zone := u.Servers[1].Zone; zone != "a" {
+		t.Errorf("Expected the first instance at an address to be used, got zone %q", zone)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,193 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+)
+
+// fakeDNS serves the records it holds, or answers SERVFAIL while failing.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[uint16][]dns.RR
+	extra   []dns.RR
+	failing bool
+}
+
+func startFakeDNS(t *testing.T) (*fakeDNS, string) {
+	t.Helper()
+	f := &fakeDNS{records: make(map[uint16][]dns.RR)}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: f}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return f, pc.LocalAddr().String()
+}
+
+func (f *fakeDNS) set(qtype uint16, extra []dns.RR, records ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[qtype] = nil
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			panic(err)
+		}
+		f.records[qtype] = append(f.records[qtype], rr)
+	}
+	f.extra = extra
+}
+
+func (f *fakeDNS) fail(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if f.failing {
+		m.Rcode = dns.RcodeServerFailure
+	} else {
+		m.Answer = f.records[r.Question[0].Qtype]
+		m.Extra = f.extra
+	}
+	w.WriteMsg(m)
+}
+
+func runDNSProvider(t *testing.T, opts discovery.DNSOptions) <-chan discovery.Update {
+	t.Helper()
+	provider, err := discovery.NewDNSProvider(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return runProvider(t, provider)
+}
+
+func runProvider(t *testing.T, provider discovery.Provider) <-chan discovery.Update {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	updates := make(chan discovery.Update)
+	go provider.Run(ctx, updates)
+	return updates
+}
+
+func nextUpdate(t *testing.T, updates <-chan discovery.Update) discovery.Update {
+	t.Helper()
+	select {
+	case u := <-updates:
+		return u
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an update")
+		return discovery.Update{}
+	}
+}
+
+func serverURLs(u discovery.Update) []string {
+	var urls []string
+	for _, s := range u.Servers {
+		urls = append(urls, s.URL.String())
+	}
+	slices.Sort(urls)
+	return urls
+}
+
+func TestDNSDiscoveryA(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeDNS(t)
+	fake.set(dns.TypeA, nil, "api.test. 1 IN A 10.0.0.1", "api.test. 60 IN A 10.0.0.2")
+	updates := runDNSProvider(t, discovery.DNSOptions{
+		Name:        "api.test",
+		Port:        8080,
+		Resolver:    addr,
+		MinInterval: 10 * time.Millisecond,
+		MaxInterval: 20 * time.Millisecond,
+	})
+
+	u := nextUpdate(t, updates)
+	if want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}; u.Err != nil || !slices.Equal(serverURLs(u), want) {
+		t.Fatalf("Expected %v, got %v (%v)", want, serverURLs(u), u.Err)
+	}
+
+	fake.fail(true)
+	if u := nextUpdate(t, updates); u.Err == nil {
+		t.Errorf("Expected an error while the resolver fails, got %v", serverURLs(u))
+	}
+	fake.fail(false)
+	fake.set(dns.TypeA, nil, "api.test. 1 IN A 10.0.0.3")
+	for u = nextUpdate(t, updates); u.Err != nil; u = nextUpdate(t, updates) {
+	}
+	if want := []string{"http://10.0.0.3:8080"}; !slices.Equal(serverURLs(u), want) {
+		t.Errorf("Expected %v after the records changed, got %v", want, serverURLs(u))
+	}
+
+	// An answer without records keeps the servers too.
+	fake.set(dns.TypeA, nil)
+	if u := nextUpdate(t, updates); u.Err == nil {
+		t.Errorf("Expected an error for an empty answer, got %v", serverURLs(u))
+	}
+}
+
+func TestDNSDiscoveryRespectsTTL(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeDNS(t)
+	fake.set(dns.TypeA, nil, "api.test. 1 IN A 10.0.0.1")
+	updates := runDNSProvider(t, discovery.DNSOptions{Name: "api.test", Port: 80, Resolver: addr, MinInterval: 10 * time.Millisecond})
+
+	nextUpdate(t, updates)
+	start := time.Now()
+	nextUpdate(t, updates)
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected the records to be resolved again after their TTL of 1s, got %s", elapsed)
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeDNS(t)
+	extra := []dns.RR{}
+	for _, r := range []string{"a.api.test. 60 IN A 10.0.0.1", "b.api.test. 60 IN A 10.0.0.2"} {
+		rr, _ := dns.NewRR(r)
+		extra = append(extra, rr)
+	}
+	fake.set(dns.TypeSRV, extra,
+		"_http._tcp.api.test. 60 IN SRV 0 30 8080 a.api.test.",
+		"_http._tcp.api.test. 60 IN SRV 1 0 9090 b.api.test.",
+	)
+	updates := runDNSProvider(t, discovery.DNSOptions{Name: "_http._tcp.api.test", Type: "SRV", Resolver: addr})
+
+	u := nextUpdate(t, updates)
+	if u.Err != nil || len(u.Servers) != 2 {
+		t.Fatalf("Expected 2 servers, got %v (%v)", serverURLs(u), u.Err)
+	}
+	for _, s := range u.Servers {
+		switch s.URL.String() {
+		case "http://10.0.0.1:8080":
+			if s.Priority != 0 || s.Weight != 30 {
+				t.Errorf("Expected priority 0 and weight 30 for %s, got %d and %d", s.URL, s.Priority, s.Weight)
+			}
+		case "http://10.0.0.2:9090":
+			if s.Priority != 1 || s.Weight != 1 {
+				t.Errorf("Expected priority 1 and weight 1 for %s, got %d and %d", s.URL, s.Priority, s.Weight)
+			}
+		default:
+			t.Errorf("Unexpected server %s", s.URL)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package integration
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+)
+
+// fakeAPIServer imitates the EndpointSlice list and watch endpoints of the
+// Kubernetes API. Events sent on events are streamed to the current watch.
+type fakeAPIServer struct {
+	mu     sync.Mutex
+	slices []map[string]interface{}
+	lists  int
+	auth   string
+	events chan map[string]interface{}
+}
+
+func startFakeAPIServer(t *testing.T) (*fakeAPIServer, string) {
+	t.Helper()
+	f := &fakeAPIServer{events: make(chan map[string]interface{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" || q.Get("labelSelector") != "kubernetes.io/service-name=api" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	f.auth = r.Header.Get("Authorization")
+	if q.Get("watch") != "true" {
+		f.lists++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": "100"},
+			"items":    f.slices,
+		})
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-f.events:
+			enc.Encode(event)
+			w.(http.Flusher).Flush()
+			if event["type"] == "ERROR" {
+				return // as the API server ends a watch after an error
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeAPIServer) listCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+type fakeEndpoint struct {
+	ip, zone, hint             string
+	ready, serving, terminated bool
+}
+
+func endpointSlice(name, version string, endpoints ...fakeEndpoint) map[string]interface{} {
+	var eps []map[string]interface{}
+	for _, e := range endpoints {
+		ep := map[string]interface{}{
+			"addresses":  []string{e.ip},
+			"conditions": map[string]bool{"ready": e.ready, "serving": e.serving, "terminating": e.terminated},
+			"zone":       e.zone,
+			"nodeName":   "node-" + e.zone,
+			"targetRef":  map[string]string{"kind": "Pod", "name": "pod-" + e.ip},
+		}
+		if e.hint != "" {
+			ep["hints"] = map[string]interface{}{"forZones": []map[string]string{{"name": e.hint}}}
+		}
+		eps = append(eps, ep)
+	}
+	return map[string]interface{}{
+		"metadata":    map[string]string{"name": name, "resourceVersion": version},
+		"addressType": "IPv4",
+		"endpoints":   eps,
+		"ports": []map[string]interface{}{
+			{"name": "metrics", "port": 9090, "protocol": "TCP"},
+			{"name": "http", "port": 8080, "protocol": "TCP"},
+		},
+	}
+}
+
+func priorities(u discovery.Update) map[string]int {
+	p := make(map[string]int)
+	for _, s := range u.Servers {
+		p[s.URL.Host] = s.Priority
+	}
+	return p
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	t.Parallel()
+
+	fake, addr := startFakeAPIServer(t)
+	fake.slices = []map[string]interface{}{endpointSlice("api-abc", "90",
+		fakeEndpoint{ip: "10.0.0.1", zone: "a", hint: "a", ready: true, serving: true},
+		fakeEndpoint{ip: "10.0.0.2", zone: "b", hint: "b", ready: true, serving: true},
+		fakeEndpoint{ip: "10.0.0.3", zone: "a", hint: "a", serving: true, terminated: true},
+		fakeEndpoint{ip: "10.0.0.4", zone: "a", hint: "a"},
+	)}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	provider, err := discovery.NewKubernetesProvider(discovery.KubernetesOptions{
+		APIServer:     addr,
+		TokenFile:     tokenFile,
+		Namespace:     "shop",
+		Service:       "api",
+		Port:          "http",
+		Zone:          "a",
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	updates := runProvider(t, provider)
+
+	u := nextUpdate(t, updates)
+	if u.Err != nil {
+		t.Fatalf("Unexpected error: %v", u.Err)
+	}
+	// The terminating endpoint is drained behind the ready ones, and the one
+	// in zone b is only used if none in zone a are available.
+	want := map[string]int{
+		"10.0.0.1:8080": discovery.PriorityReady,
+		"10.0.0.2:8080": discovery.PriorityOtherZone,
+		"10.0.0.3:8080": discovery.PriorityTerminating,
+	}
+	if got := priorities(u); !maps.Equal(got, want) {
+		t.Errorf("Expected priorities %v, got %v", want, got)
+	}
+	for _, s := range u.Servers {
+		if s.URL.Host == "10.0.0.1:8080" && (s.Zone != "a" || s.Tags["pod"] != "pod-10.0.0.1" || s.Tags["node"] != "node-a") {
+			t.Errorf("Unexpected attributes: zone %q, tags %v", s.Zone, s.Tags)
+		}
+	}
+	fake.mu.Lock()
+	auth := fake.auth
+	fake.mu.Unlock()
+	if auth != "Bearer secret" {
+		t.Errorf("Expected the service account token to be sent, got %q", auth)
+	}
+
+	// The terminating endpoint stops serving and a new pod becomes ready;
+	// without hints on every endpoint, zones are ignored.
+	fake.events <- map[string]interface{}{"type": "MODIFIED", "object": endpointSlice("api-abc", "101",
+		fakeEndpoint{ip: "10.0.0.1", zone: "a", hint: "a", ready: true, serving: true},
+		fakeEndpoint{ip: "10.0.0.2", zone: "b", hint: "b", ready: true, serving: true},
+		fakeEndpoint{ip: "10.0.0.3", zone: "a", terminated: true},
+		fakeEndpoint{ip: "10.0.0.5", zone: "b", ready: true, serving: true},
+	)}
+	want = map[string]int{"10.0.0.1:8080": 0, "10.0.0.2:8080": 0, "10.0.0.5:8080": 0}
+	if u := nextUpdate(t, updates); u.Err != nil || !maps.Equal(priorities(u), want) {
+		t.Errorf("Expected priorities %v after the change, got %v (%v)", want, priorities(u), u.Err)
+	}
+
+	// An expired resource version makes the provider list the slices again.
+	fake.mu.Lock()
+	fake.slices = []map[string]interface{}{endpointSlice("api-def", "150",
+		fakeEndpoint{ip: "10.0.0.6", zone: "a", ready: true, serving: true},
+	)}
+	fake.mu.Unlock()
+	fake.events <- map[string]interface{}{"type": "ERROR", "object": map[string]interface{}{
+		"kind": "Status", "code": 410, "reason": "Expired", "message": "too old resource version",
+	}}
+	want = map[string]int{"10.0.0.6:8080": 0}
+	if u := nextUpdate(t, updates); u.Err != nil || !maps.Equal(priorities(u), want) {
+		t.Errorf("Expected %v after listing again, got %v (%v)", want, priorities(u), u.Err)
+	}
+	if n := fake.listCount(); n != 2 {
+		t.Errorf("Expected 2 lists, got %d", n)
+	}
+
+	// Deleting the last slice, as when scaling to zero, leaves no servers.
+	fake.events <- map[string]interface{}{"type": "DELETED", "object": endpointSlice("api-def", "151")}
+	if u := nextUpdate(t, updates); u.Err != nil || len(u.Servers) != 0 {
+		t.Errorf("Expected no servers without endpoints, got %v (%v)", priorities(u), u.Err)
+	}
+}
@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+func newMetricsHandler(t *testing.T, backendURLs ...string) (*interfaces.HTTPHandler, *metrics.Metrics) {
+	t.Helper()
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	servers := make([]*domain.Server, len(backendURLs))
+	for i, u := range backendURLs {
+		if servers[i], err = domain.NewServer(u); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	useCase := usecases.NewLoadBalancerUseCase(
+		loadbalancers.NewRoundRobin(servers),
+		circuitbreaker.NewCircuitBreaker(5, 10*time.Second),
+		usecases.WithName("api"),
+		usecases.WithMetrics(m),
+		usecases.WithMaxRetries(1),
+	)
+	handler := interfaces.NewHTTPHandler(useCase, zap.NewNop(), interfaces.WithMetrics(m))
+	return handler, m
+}
+
+func TestMetricsRetryOnUnreachableBackend(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	// Round robin starts at the second server, so the dead one is tried first.
+	handler, m := newMetricsHandler(t, backend.URL, dead.URL)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", rec.Code)
+	}
+
+	backendHost := mustParseURL(backend.URL).Host
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("default", "api", backendHost, "GET", "2xx")); got != 1 {
+		t.Errorf("Expected 1 successful request, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.RetriesTotal.WithLabelValues("default", "api")); got != 1 {
+		t.Errorf("Expected 1 retry, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.ResponseBytes.WithLabelValues("default", "api", backendHost)); got != 5 {
+		t.Errorf("Expected 5 response bytes, got %v", got)
+	}
+}
+
+func TestMetricsRetryOnlyUndeliveredPosts(t *testing.T) {
+	t.Parallel()
+
+	var posts atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+	}))
+	defer backend.Close()
+	// The request reaches this backend, which drops the connection.
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer dropping.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	handler, m := newMetricsHandler(t, backend.URL, dropping.URL)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || posts.Load() != 0 {
+		t.Errorf("Expected a POST the backend received not to be retried, got status %d and %d retried", rec.Code, posts.Load())
+	}
+
+	handler, m = newMetricsHandler(t, backend.URL, dead.URL)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusOK || posts.Load() != 1 {
+		t.Errorf("Expected a POST to be retried when the backend cannot be dialed, got status %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(m.RetriesTotal.WithLabelValues("default", "api")); got != 1 {
+		t.Errorf("Expected 1 retry, got %v", got)
+	}
+}
+
+func TestMetricsFailedRequestIsNotCountedAsSuccess(t *testing.T) {
+	t.Parallel()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	handler, m := newMetricsHandler(t, dead.URL)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", rec.Code)
+	}
+
+	deadHost := mustParseURL(dead.URL).Host
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("default", "api", deadHost, "GET", "5xx")); got != 1 {
+		t.Errorf("Expected 1 failed request, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("default", "api", deadHost, "GET", "2xx")); got != 0 {
+		t.Errorf("Expected no successful request, got %v", got)
+	}
+}
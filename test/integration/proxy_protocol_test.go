@@ -0,0 +1,285 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/proxyprotocol"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"go.uber.org/zap"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"trusted", []string{"127.0.0.0/8"}, "203.0.113.7"},
+		{"untrusted", []string{"10.0.0.1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := proxyprotocol.ParseTrusted(tt.trusted)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			remote := make(chan string, 1)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remote <- r.RemoteAddr
+			}))
+			srv.Listener = proxyprotocol.NewListener(srv.Listener, trusted)
+			srv.Start()
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}
+			if err := proxyprotocol.WriteHeader(conn, 1, src, conn.RemoteAddr()); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+
+			if tt.want == "" {
+				// The header fails the first read, which the server answers
+				// with 400 at most: the handler never sees the request.
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusBadRequest {
+						t.Errorf("Expected header from untrusted source to be rejected, got %s", resp.Status)
+					}
+				}
+				select {
+				case addr := <-remote:
+					t.Errorf("Expected no request, got one from %s", addr)
+				default:
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if got := remoteIPOf(t, <-remote); got != tt.want {
+				t.Errorf("Expected RemoteAddr %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTCPPool(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []int{1, 2} {
+		headers := make(chan *proxyproto.Header, 1)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			h, err := proxyproto.Read(bufio.NewReader(conn))
+			if err != nil {
+				h = nil
+			}
+			headers <- h
+		}()
+
+		server, err := domain.NewServer("tcp://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+			usecases.WithProxyProtocol(version),
+		)
+		proxy := interfaces.NewTCPProxy("pp", pool, zap.NewNop())
+		client, proxied := net.Pipe()
+		go proxy.ServeConn(&fakeAddrConn{Conn: proxied})
+		defer client.Close()
+
+		select {
+		case h := <-headers:
+			if h == nil {
+				t.Fatalf("v%d: backend did not receive a valid header", version)
+			}
+			if int(h.Version) != version {
+				t.Errorf("Expected version %d, got %d", version, h.Version)
+			}
+			if got := h.SourceAddr.String(); got != "198.51.100.1:5555" {
+				t.Errorf("Expected source 198.51.100.1:5555, got %s", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d: backend received nothing", version)
+		}
+	}
+}
+
+func TestProxyProtocolHTTPPool(t *testing.T) {
+	t.Parallel()
+
+	headers := make(chan *proxyproto.Header, 2)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.Listener = &proxyproto.Listener{
+		Listener: backend.Listener,
+		Policy: func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateActive {
+			if pc, ok := c.(*proxyproto.Conn); ok {
+				headers <- pc.ProxyHeader()
+			}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithProxyProtocol(2),
+	)
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop(), interfaces.WithTransport(proxyprotocol.NewTransport()))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+	}
+	// Each request opens its own connection with its own header.
+	for i := 0; i < 2; i++ {
+		select {
+		case h := <-headers:
+			if h == nil {
+				t.Fatal("Expected a PROXY protocol header")
+			}
+			if got := h.SourceAddr.String(); got != "192.0.2.10:1234" {
+				t.Errorf("Expected source 192.0.2.10:1234, got %s", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 connections, got %d", i)
+		}
+	}
+}
+
+func TestProxyProtocolHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	headers := make(chan *proxyproto.Header, 16)
+	required := func(ln net.Listener) net.Listener {
+		return &proxyproto.Listener{
+			Listener: ln,
+			Policy: func(net.Addr) (proxyproto.Policy, error) {
+				return proxyproto.REQUIRE, nil
+			},
+		}
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.Listener = required(backend.Listener)
+	backend.Start()
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tcpBackend := required(ln)
+	defer tcpBackend.Close()
+	go func() {
+		for {
+			conn, err := tcpBackend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1))
+			headers <- conn.(*proxyproto.Conn).ProxyHeader()
+			conn.Close()
+		}
+	}()
+
+	httpServer, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	httpServer.Transport = proxyprotocol.NewTransport()
+	httpServer.Active.Store(false)
+	tcpServer, err := domain.NewServer("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tcpServer.DialContext = proxyprotocol.DialContext
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{httpServer, tcpServer}), nil,
+		usecases.WithProxyProtocol(2),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.StartHealthCheck(ctx, 10*time.Millisecond)
+
+	// Backends that require the header accept the checks, which announce
+	// connections of the balancer itself.
+	waitFor(t, httpServer.Active.Load)
+	select {
+	case h := <-headers:
+		if h == nil || h.Command != proxyproto.LOCAL {
+			t.Errorf("Expected a LOCAL header, got %+v", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the TCP check to connect")
+	}
+}
+
+// fakeAddrConn gives a pipe connection TCP addresses.
+type fakeAddrConn struct {
+	net.Conn
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5555}
+}
+
+func (c *fakeAddrConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+}
+
+func remoteIPOf(t *testing.T, addr string) string {
+	t.Helper()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return host
+}
@@ -0,0 +1,61 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"go.uber.org/zap"
+)
+
+func TestMaxConnectionsQueuesRequests(t *testing.T) {
+	t.Parallel()
+
+	var inFlight, peak atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.MaxConnections = 2
+
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithQueue(10, 5*time.Second))
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop())
+
+	codes := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected request %d to wait for the backend, got %d", i, code)
+		}
+	}
+	if got := peak.Load(); got > 2 {
+		t.Errorf("Expected at most 2 requests at the backend at once, got %d", got)
+	}
+}
@@ -0,0 +1,227 @@
+package integration
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// newRateLimitedHandler routes /api/ to the api route and everything else to
+// the default route, both served by backend.
+func newRateLimitedHandler(t *testing.T, opts ...middleware.RateLimiterOption) (http.Handler, *middleware.RateLimiter) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil)
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop())
+	handler.SetRoutes([]interfaces.Route{{Name: "api", PathPrefix: "/api/", Pool: pool}}, pool)
+
+	rl := middleware.NewRateLimiter(append(opts, middleware.WithRouteMatcher(handler.RouteName))...)
+	return rl.RateLimit(handler), rl
+}
+
+func rateLimitedStatus(h http.Handler, path, remoteAddr string, header ...string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// admitted sends n requests and returns how many were not rejected.
+func admitted(n int, send func() int) int {
+	ok := 0
+	for i := 0; i < n; i++ {
+		if send() != http.StatusTooManyRequests {
+			ok++
+		}
+	}
+	return ok
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	t.Parallel()
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	h, rl := newRateLimitedHandler(t, middleware.WithRateLimitMetrics(m))
+	err = rl.SetPolicies(
+		&middleware.RateLimitPolicy{Rate: 0.001, Burst: 2},
+		map[string]middleware.RateLimitPolicy{"api": {
+			Name:      "per-key",
+			Rate:      0.001,
+			Burst:     1,
+			Key:       "api_key",
+			Overrides: map[string]middleware.RateLimit{"partner": {Rate: 0.001, Burst: 3}},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The global policy limits each client IP, whatever its port.
+	if n := admitted(3, func() int { return rateLimitedStatus(h, "/", "10.0.0.1:1000") }); n != 2 {
+		t.Errorf("Expected 2 requests admitted by the global policy, got %d", n)
+	}
+	if code := rateLimitedStatus(h, "/", "10.0.0.1:1001"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected a new port of the same client to be limited, got %d", code)
+	}
+	if code := rateLimitedStatus(h, "/", "10.0.0.2:1000"); code != http.StatusOK {
+		t.Errorf("Expected another client to be admitted, got %d", code)
+	}
+
+	// The route policy takes the place of the global one and limits each
+	// API key, with an override for the partner key.
+	for key, want := range map[string]int{"k1": 1, "k2": 1, "partner": 3} {
+		key := key
+		n := admitted(5, func() int { return rateLimitedStatus(h, "/api/x", "10.0.0.1:1000", "X-API-Key", key) })
+		if n != want {
+			t.Errorf("Expected %d requests admitted for key %s, got %d", want, key, n)
+		}
+	}
+	if code := rateLimitedStatus(h, "/api/x?api_key=k3", "10.0.0.1:1000"); code != http.StatusOK {
+		t.Errorf("Expected the query parameter key to be admitted, got %d", code)
+	}
+	// Without a key, the client IP is used.
+	if n := admitted(2, func() int { return rateLimitedStatus(h, "/api/x", "10.0.0.1:1000") }); n != 1 {
+		t.Errorf("Expected 1 request without a key admitted, got %d", n)
+	}
+
+	if got := testutil.ToFloat64(m.RateLimitRejected.WithLabelValues("per-key", "api")); got != 4+4+2+1 {
+		t.Errorf("Expected 11 rejections for per-key, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.RateLimitRejected.WithLabelValues("global", "default")); got != 2 {
+		t.Errorf("Expected 2 rejections for global, got %v", got)
+	}
+}
+
+func TestRateLimitKeysAndReload(t *testing.T) {
+	t.Parallel()
+
+	h, rl := newRateLimitedHandler(t)
+	claims := func(payload string) string {
+		return "Bearer x." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	jwt := middleware.RateLimitPolicy{Name: "tenant", Rate: 0.001, Burst: 1, Key: "jwt_claim", Claim: "tenant"}
+	route := middleware.RateLimitPolicy{Name: "route", Rate: 0.001, Burst: 1, Key: "route"}
+	if err := rl.SetPolicies(&route, map[string]middleware.RateLimitPolicy{"api": jwt}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Tokens of one tenant share a bucket across clients.
+	acme := claims(`{"sub":"a","tenant":"acme"}`)
+	if code := rateLimitedStatus(h, "/api/x", "10.0.0.1:1", "Authorization", acme); code != http.StatusOK {
+		t.Errorf("Expected first acme request to be admitted, got %d", code)
+	}
+	if code := rateLimitedStatus(h, "/api/x", "10.0.0.2:1", "Authorization", claims(`{"sub":"b","tenant":"acme"}`)); code != http.StatusTooManyRequests {
+		t.Errorf("Expected second acme request to be limited, got %d", code)
+	}
+	if code := rateLimitedStatus(h, "/api/x", "10.0.0.1:1", "Authorization", claims(`{"tenant":42}`)); code != http.StatusOK {
+		t.Errorf("Expected another tenant to be admitted, got %d", code)
+	}
+	// The route key limits all clients of the route together.
+	rateLimitedStatus(h, "/", "10.0.0.1:1")
+	if code := rateLimitedStatus(h, "/", "10.0.0.3:1"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected route bucket to be shared, got %d", code)
+	}
+
+	// State survives a reload, and changed limits apply to it.
+	raised := jwt
+	raised.Burst = 2
+	if err := rl.SetPolicies(&route, map[string]middleware.RateLimitPolicy{"api": raised}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code := rateLimitedStatus(h, "/", "10.0.0.4:1"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected route bucket to survive the reload, got %d", code)
+	}
+	if code := rateLimitedStatus(h, "/api/x", "10.0.0.1:1", "Authorization", acme); code != http.StatusOK {
+		t.Errorf("Expected raised burst to admit another request, got %d", code)
+	}
+
+	if err := rl.SetPolicies(&middleware.RateLimitPolicy{Key: "cookie"}, nil); err == nil {
+		t.Error("Expected unknown key to be rejected")
+	}
+	if err := rl.SetPolicies(nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code := rateLimitedStatus(h, "/", "10.0.0.4:1"); code != http.StatusOK {
+		t.Errorf("Expected no limit without policies, got %d", code)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	h, rl := newRateLimitedHandler(t)
+	if err := rl.SetPolicies(&middleware.RateLimitPolicy{Name: "steady", Rate: 1, Burst: 2}, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rejection, err := ratelimit.NewRejection("json", `{"policy":{{json .Policy}},"retry_after":{{.RetryAfter}}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rl.SetRejection(rejection)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i, want := range []struct{ remaining, reset string }{{"1", "1"}, {"0", "2"}} {
+		rec := send()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be admitted, got %d", i, rec.Code)
+		}
+		got := rec.Header()
+		if got.Get("RateLimit-Limit") != "2" || got.Get("RateLimit-Policy") != "2;w=2" {
+			t.Errorf("Unexpected limit headers %q and %q", got.Get("RateLimit-Limit"), got.Get("RateLimit-Policy"))
+		}
+		if got.Get("RateLimit-Remaining") != want.remaining || got.Get("RateLimit-Reset") != want.reset {
+			t.Errorf("Expected remaining %s and reset %s after request %d, got %s and %s", want.remaining, want.reset, i,
+				got.Get("RateLimit-Remaining"), got.Get("RateLimit-Reset"))
+		}
+		if got.Get("Retry-After") != "" {
+			t.Errorf("Expected no Retry-After on admitted requests, got %q", got.Get("Retry-After"))
+		}
+	}
+
+	rec := send()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+	if got := rec.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected nothing remaining, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected JSON rejection, got %q", got)
+	}
+	if got := rec.Body.String(); got != `{"policy":"steady","retry_after":1}` {
+		t.Errorf("Unexpected rejection body %s", got)
+	}
+}
@@ -0,0 +1,114 @@
+package integration
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+// newRedisLimited returns a handler limited to a burst of 2 per client IP,
+// with its state in the server at addr.
+func newRedisLimited(t *testing.T, addr, onError string, opts ...ratelimit.RedisOption) http.Handler {
+	t.Helper()
+	store, err := ratelimit.NewRedisStore(ratelimit.RedisOptions{
+		Addr:          addr,
+		PoolSize:      4,
+		Timeout:       time.Second,
+		KeyPrefix:     "lb:",
+		OnError:       onError,
+		RetryInterval: 100 * time.Millisecond,
+	}, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	h, rl := newRateLimitedHandler(t, middleware.WithRateLimitStore(store))
+	if err := rl.SetPolicies(&middleware.RateLimitPolicy{Rate: 0.001, Burst: 2}, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return h
+}
+
+func TestRedisRateLimitShared(t *testing.T) {
+	t.Parallel()
+
+	mr := miniredis.RunT(t)
+	a := newRedisLimited(t, mr.Addr(), ratelimit.OnErrorLocal)
+	b := newRedisLimited(t, mr.Addr(), ratelimit.OnErrorLocal)
+
+	// Both instances take from the same burst.
+	if code := rateLimitedStatus(a, "/", "10.0.0.1:1"); code != http.StatusOK {
+		t.Errorf("Expected first request to be admitted, got %d", code)
+	}
+	if code := rateLimitedStatus(b, "/", "10.0.0.1:1"); code != http.StatusOK {
+		t.Errorf("Expected second request to be admitted, got %d", code)
+	}
+	if n := admitted(2, func() int { return rateLimitedStatus(a, "/", "10.0.0.1:1") }); n != 0 {
+		t.Errorf("Expected the shared burst to be used up, got %d admitted", n)
+	}
+	if code := rateLimitedStatus(b, "/", "10.0.0.2:1"); code != http.StatusOK {
+		t.Errorf("Expected another client to be admitted, got %d", code)
+	}
+
+	keys := mr.Keys()
+	if len(keys) != 2 || !strings.HasPrefix(keys[0], "lb:global") {
+		t.Fatalf("Expected 2 prefixed keys, got %q", keys)
+	}
+	if ttl := mr.TTL(keys[0]); ttl <= 0 {
+		t.Errorf("Expected keys to expire when idle, got TTL %v", ttl)
+	}
+}
+
+func TestRedisRateLimitUnreachable(t *testing.T) {
+	t.Parallel()
+
+	mr := miniredis.RunT(t)
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	local := newRedisLimited(t, mr.Addr(), ratelimit.OnErrorLocal, ratelimit.WithMetrics(m))
+	allow := newRedisLimited(t, mr.Addr(), ratelimit.OnErrorAllow)
+	deny := newRedisLimited(t, mr.Addr(), ratelimit.OnErrorDeny)
+	rateLimitedStatus(local, "/", "10.0.0.1:1")
+	rateLimitedStatus(allow, "/", "10.0.0.4:1")
+	rateLimitedStatus(deny, "/", "10.0.0.5:1")
+	mr.Close()
+
+	// The local fallback starts without state and limits on its own.
+	if n := admitted(4, func() int { return rateLimitedStatus(local, "/", "10.0.0.1:1") }); n != 2 {
+		t.Errorf("Expected the local fallback to admit 2, got %d", n)
+	}
+	if n := admitted(4, func() int { return rateLimitedStatus(allow, "/", "10.0.0.1:1") }); n != 4 {
+		t.Errorf("Expected fail-open to admit all, got %d", n)
+	}
+	if n := admitted(4, func() int { return rateLimitedStatus(deny, "/", "10.0.0.2:1") }); n != 0 {
+		t.Errorf("Expected fail-closed to reject all, got %d", n)
+	}
+	// The server is left alone until the retry interval has passed.
+	if got := testutil.ToFloat64(m.RateLimitErrors.WithLabelValues("redis")); got != 1 {
+		t.Errorf("Expected 1 store error, got %v", got)
+	}
+
+	// Once the server is back, its state is used again.
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if code := rateLimitedStatus(local, "/", "10.0.0.3:1"); code != http.StatusOK {
+		t.Errorf("Expected a request to be admitted after recovery, got %d", code)
+	}
+	// The server saw one request of 10.0.0.1 before the outage, while the
+	// fallback has used up its burst.
+	if n := admitted(2, func() int { return rateLimitedStatus(local, "/", "10.0.0.1:1") }); n != 1 {
+		t.Errorf("Expected the state kept by the server to apply, got %d admitted", n)
+	}
+}
@@ -0,0 +1,74 @@
+package integration
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"go.uber.org/zap"
+)
+
+func newTLSPool(t *testing.T, name string) *usecases.LoadBalancerUseCase {
+	t.Helper()
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(backend.Close)
+
+	server, err := domain.NewServer("tcp://" + backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil, usecases.WithName(name))
+}
+
+func TestTCPProxySNIRouting(t *testing.T) {
+	t.Parallel()
+
+	api, wildcard, fallback := newTLSPool(t, "api"), newTLSPool(t, "wildcard"), newTLSPool(t, "fallback")
+	proxy := interfaces.NewTCPProxy("tls", fallback, zap.NewNop())
+	proxy.SetSNIRoutes([]interfaces.SNIRoute{
+		{ServerNames: []string{"*.example.com"}, Pool: wildcard},
+		{ServerNames: []string{"api.example.com"}, Pool: api},
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go proxy.Serve(ln)
+	defer ln.Close()
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"api.example.com", "api"},
+		{"www.example.com", "wildcard"},
+		{"a.b.example.com", "fallback"},
+		{"", "fallback"},
+	}
+	for _, tt := range tests {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true},
+		}}
+		// With an IP address in the URL and no ServerName, no SNI is sent.
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.serverName, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.TrimSpace(string(body)); got != tt.expected {
+			t.Errorf("%q: expected pool %s, got %s", tt.serverName, tt.expected, got)
+		}
+	}
+}
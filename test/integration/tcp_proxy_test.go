@@ -0,0 +1,266 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// startEchoServer echoes everything it reads and closes its write half once
+// the client has finished sending.
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return ln
+}
+
+func startTCPProxy(t *testing.T, m *metrics.Metrics, backends []string, opts ...interfaces.TCPProxyOption) (*interfaces.TCPProxy, string) {
+	t.Helper()
+	servers := make([]*domain.Server, len(backends))
+	for i, addr := range backends {
+		server, err := domain.NewServer("tcp://" + addr)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		servers[i] = server
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin(servers), nil,
+		usecases.WithName("echo"),
+		usecases.WithMetrics(m),
+		usecases.WithMaxRetries(1),
+	)
+	opts = append(opts, interfaces.WithTCPMetrics(m))
+	proxy := interfaces.NewTCPProxy("echo", pool, zap.NewNop(), opts...)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go proxy.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		proxy.Shutdown(ctx)
+	})
+	return proxy, ln.Addr().String()
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	t.Parallel()
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	echo := startEchoServer(t)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dead.Close()
+
+	// Round robin starts at the second server, so the dead one is tried first.
+	_, addr := startTCPProxy(t, m, []string{echo.Addr().String(), dead.Addr().String()})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The echo server only answers in full after seeing EOF, which requires
+	// the proxy to forward the half-close.
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("Expected echo of ping, got %q", reply)
+	}
+
+	backend := echo.Addr().String()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.TCPBytes.WithLabelValues("echo", "echo", backend, "downstream")) != 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(m.TCPBytes.WithLabelValues("echo", "echo", backend, "upstream")); got != 4 {
+		t.Errorf("Expected 4 upstream bytes, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.TCPConnections.WithLabelValues("echo", "echo", backend)); got != 1 {
+		t.Errorf("Expected 1 connection, got %v", got)
+	}
+}
+
+func TestTCPProxyIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	_, addr := startTCPProxy(t, nil, []string{echo.Addr().String()}, interfaces.WithIdleTimeout(100*time.Millisecond))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Traffic keeps the connection open past the idle timeout.
+	buf := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Connection closed while active: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF after idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Idle connection closed after %v", elapsed)
+	}
+}
+
+func TestTCPProxyQueuesAtMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	server, err := domain.NewServer("tcp://" + startEchoServer(t).Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.MaxConnections = 1
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithName("echo"),
+		usecases.WithMetrics(m),
+		usecases.WithQueue(1, 5*time.Second),
+	)
+	proxy := interfaces.NewTCPProxy("echo", pool, zap.NewNop())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go proxy.Serve(ln)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		proxy.Shutdown(ctx)
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "ping")
+		return conn
+	}
+	first := dial()
+	defer first.Close()
+	if _, err := io.ReadFull(first, make([]byte, 4)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The second connection waits for the first one to close.
+	second := dial()
+	defer second.Close()
+	waitFor(t, func() bool { return testutil.ToFloat64(m.QueueDepth.WithLabelValues("echo")) == 1 })
+	if got := atomic.LoadInt64(&server.Connections); got != 1 {
+		t.Errorf("Expected 1 connection to the backend, got %d", got)
+	}
+	first.Close()
+	if _, err := io.ReadFull(second, make([]byte, 4)); err != nil {
+		t.Errorf("Expected the queued connection to be served: %v", err)
+	}
+}
+
+// exhaustedListener fails its first accepts as if out of file descriptors.
+type exhaustedListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *exhaustedListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestTCPProxyRetriesAcceptErrors(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	server, err := domain.NewServer("tcp://" + echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil)
+	proxy := interfaces.NewTCPProxy("echo", pool, zap.NewNop())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exhausted := &exhaustedListener{Listener: ln}
+	exhausted.failures.Store(3)
+	go proxy.Serve(exhausted)
+	defer proxy.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if reply, err := io.ReadAll(conn); err != nil || string(reply) != "ping" {
+		t.Errorf("Expected the proxy to keep accepting after accept errors, got %q (%v)", reply, err)
+	}
+}
@@ -0,0 +1,102 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/tracing"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+
+	var backendTraceparent, backendB3TraceID, backendB3 string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("traceparent")
+		backendB3TraceID = r.Header.Get("X-B3-TraceId")
+		backendB3 = r.Header.Get("b3")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	propagator, err := tracing.NewPropagator(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	useCase := usecases.NewLoadBalancerUseCase(
+		loadbalancers.NewRoundRobin([]*domain.Server{server}),
+		circuitbreaker.NewCircuitBreaker(5, 10*time.Second),
+	)
+	handler := interfaces.NewHTTPHandler(useCase, zap.NewNop(),
+		interfaces.WithTransport(tracing.NewTransport(http.DefaultTransport, tp, propagator)))
+	lb := httptest.NewServer(middleware.NewTracer(tp, propagator).Trace(handler))
+	defer lb.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, lb.URL+"/orders", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	req.Header.Set("b3", traceID+"-"+parentSpanID+"-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	var serverSpan, clientSpan tracetest.SpanStub
+	for _, span := range spans {
+		switch span.SpanKind {
+		case trace.SpanKindServer:
+			serverSpan = span
+		case trace.SpanKindClient:
+			clientSpan = span
+		}
+	}
+
+	if serverSpan.SpanContext.TraceID().String() != traceID {
+		t.Errorf("Expected server span in trace %s, got %s", traceID, serverSpan.SpanContext.TraceID())
+	}
+	if serverSpan.Parent.SpanID().String() != parentSpanID {
+		t.Errorf("Expected server span parent %s, got %s", parentSpanID, serverSpan.Parent.SpanID())
+	}
+	if clientSpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("Expected client span to be a child of the server span")
+	}
+
+	expected := "00-" + traceID + "-" + clientSpan.SpanContext.SpanID().String() + "-01"
+	if backendTraceparent != expected {
+		t.Errorf("Expected backend traceparent %s, got %s", expected, backendTraceparent)
+	}
+	if backendB3TraceID != traceID {
+		t.Errorf("Expected backend B3 trace id %s, got %s", traceID, backendB3TraceID)
+	}
+	if backendB3 != "" {
+		t.Errorf("Expected the client's b3 header to be removed, got %s", backendB3)
+	}
+}
@@ -0,0 +1,167 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// startUDPEchoServer replies to every datagram with its own address followed
+// by the payload, so tests can tell backends apart.
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte(pc.LocalAddr().String()+" "), buf[:n]...), addr)
+		}
+	}()
+	return pc
+}
+
+func TestUDPProxyFlows(t *testing.T) {
+	t.Parallel()
+
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backends := []net.PacketConn{startUDPEchoServer(t), startUDPEchoServer(t)}
+	servers := make([]*domain.Server, len(backends))
+	for i, b := range backends {
+		if servers[i], err = domain.NewServer("udp://" + b.LocalAddr().String()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin(servers), nil, usecases.WithName("dns"))
+	proxy := interfaces.NewUDPProxy("dns", pool, zap.NewNop(),
+		interfaces.WithFlowIdleTimeout(100*time.Millisecond),
+		interfaces.WithUDPMetrics(m),
+	)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go proxy.Serve(pc)
+	defer proxy.Shutdown(context.Background())
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(payload string) string {
+		t.Helper()
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	// Datagrams of one flow stick to the same backend.
+	first := exchange("a")
+	if second := exchange("b"); second[:len(second)-1] != first[:len(first)-1] {
+		t.Errorf("Expected the flow to stick to one backend, got %q and %q", first, second)
+	}
+	backend := first[:len(first)-2]
+	if got := testutil.ToFloat64(m.UDPPackets.WithLabelValues("dns", "dns", backend, "downstream")); got != 2 {
+		t.Errorf("Expected 2 downstream packets, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.UDPActiveFlows.WithLabelValues("dns")); got != 1 {
+		t.Errorf("Expected 1 active flow, got %v", got)
+	}
+
+	// After the idle timeout the flow is gone and the next datagram starts a
+	// new one on the next backend.
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(m.UDPActiveFlows.WithLabelValues("dns")) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if third := exchange("c"); third[:len(third)-2] == backend {
+		t.Errorf("Expected a new flow on another backend, got %q", third)
+	}
+	if got := testutil.ToFloat64(m.UDPFlows.WithLabelValues("dns", "dns", backend)); got != 1 {
+		t.Errorf("Expected 1 flow to %s, got %v", backend, got)
+	}
+}
+
+func TestUDPProxyMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	server, err := domain.NewServer("udp://" + startUDPEchoServer(t).LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.MaxConnections = 1
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithQueue(10, time.Minute))
+	proxy := interfaces.NewUDPProxy("dns", pool, zap.NewNop(), interfaces.WithFlowIdleTimeout(200*time.Millisecond))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go proxy.Serve(pc)
+	defer proxy.Shutdown(context.Background())
+
+	exchange := func(client net.Conn, wait time.Duration) error {
+		client.SetDeadline(time.Now().Add(wait))
+		if _, err := client.Write([]byte("a")); err != nil {
+			return err
+		}
+		_, err := client.Read(make([]byte, 1500))
+		return err
+	}
+	var clients []net.Conn
+	for range 2 {
+		client, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	if err := exchange(clients[0], 5*time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The second flow is dropped rather than queued while the first one
+	// holds the only connection, and gets through once it expired.
+	if err := exchange(clients[1], 50*time.Millisecond); err == nil {
+		t.Error("Expected the flow beyond the cap to be dropped")
+	}
+	if got := atomic.LoadInt64(&server.Connections); got != 1 {
+		t.Errorf("Expected 1 connection, got %d", got)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&server.Connections) == 0 })
+	if err := exchange(clients[1], 5*time.Second); err != nil {
+		t.Errorf("Expected the flow to be created once the first one expired: %v", err)
+	}
+}
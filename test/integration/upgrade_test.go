@@ -0,0 +1,118 @@
+package integration
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/tracing"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+// startUpgradeBackend switches to an echo protocol on Upgrade: echo.
+func startUpgradeBackend(t *testing.T) *domain.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	t.Cleanup(backend.Close)
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return server
+}
+
+// checkUpgrade upgrades a connection through the balancer at addr and
+// expects its messages to be echoed.
+func checkUpgrade(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %v", resp.Status)
+	}
+
+	io.WriteString(conn, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ping" {
+		t.Errorf("Expected the message to be echoed, got %q (%v)", line, err)
+	}
+}
+
+func TestUpgradedConnectionsAreTunnelled(t *testing.T) {
+	server := startUpgradeBackend(t)
+	useCase := usecases.NewLoadBalancerUseCase(
+		loadbalancers.NewRoundRobin([]*domain.Server{server}),
+		circuitbreaker.NewCircuitBreaker(5, 10*time.Second),
+	)
+	lb := httptest.NewServer(interfaces.NewHTTPHandler(useCase, zap.NewNop()))
+	defer lb.Close()
+
+	checkUpgrade(t, lb.Listener.Addr().String())
+	if !server.Active.Load() {
+		t.Error("Expected the backend to stay active")
+	}
+}
+
+func TestUpgradedConnectionsAreTunnelledWithTracing(t *testing.T) {
+	server := startUpgradeBackend(t)
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	propagator, err := tracing.NewPropagator(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	useCase := usecases.NewLoadBalancerUseCase(
+		loadbalancers.NewRoundRobin([]*domain.Server{server}),
+		circuitbreaker.NewCircuitBreaker(5, 10*time.Second),
+	)
+	handler := interfaces.NewHTTPHandler(useCase, zap.NewNop(),
+		interfaces.WithTransport(tracing.NewTransport(http.DefaultTransport, tp, propagator)))
+	lb := httptest.NewServer(handler)
+	defer lb.Close()
+
+	checkUpgrade(t, lb.Listener.Addr().String())
+	if spans := exporter.GetSpans(); len(spans) != 1 {
+		t.Errorf("Expected the client span to end with the upgrade, got %d spans", len(spans))
+	}
+}
@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/upstream"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/interfaces"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"go.uber.org/zap"
+)
+
+// writePEM writes cert and its key to dir as <name>.crt and <name>.key.
+func writePEM(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	certFile, keyFile := writePEM(t, dir, "lb", ca.issue(t, "lb", nil))
+
+	clients := make(chan string, 10)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	// The certificate is only valid for backend.internal, not the
+	// 127.0.0.1 the backend is addressed by.
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "backend", []string{"backend.internal"})},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	server, err := domain.NewServer(backend.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Without the CA and name override, the backend cannot be verified.
+	if err := server.HealthCheck(); err == nil {
+		t.Fatal("Expected health check with default TLS settings to fail")
+	}
+
+	transport, err := upstream.NewTransport(upstream.TLSOptions{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "backend.internal",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.Transport = transport
+	if err := server.HealthCheck(); err != nil {
+		t.Fatalf("Expected health check to pass, got %v", err)
+	}
+	if cn := <-clients; cn != "lb" {
+		t.Errorf("Expected health check to present the lb certificate, got %q", cn)
+	}
+
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil)
+	handler := interfaces.NewHTTPHandler(pool, zap.NewNop())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if cn := <-clients; cn != "lb" {
+		t.Errorf("Expected request to present the lb certificate, got %q", cn)
+	}
+
+	// A failed update keeps the working settings.
+	if err := transport.Update(upstream.TLSOptions{CAFile: filepath.Join(dir, "missing.crt")}); err == nil {
+		t.Fatal("Expected update with a missing CA file to fail")
+	}
+	if err := server.HealthCheck(); err != nil {
+		t.Errorf("Expected health check to pass after failed update, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/accesslog"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/middleware"
+	"go.uber.org/zap"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := accesslog.NewLogger(accesslog.JSONFormatter{}, &buf, nil)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := accesslog.FromContext(r.Context())
+		entry.Pool = "api"
+		entry.UpstreamAddr = "10.0.0.1:8080"
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("payload"))
+	req.RemoteAddr = "192.0.2.1:51234"
+	rec := httptest.NewRecorder()
+	middleware.NewAccessLogger(logger, zap.NewNop()).AccessLog(handler).ServeHTTP(rec, req)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Invalid JSON access log %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"client_ip":     "192.0.2.1",
+		"method":        "POST",
+		"uri":           "/items",
+		"status":        float64(201),
+		"bytes_out":     float64(5),
+		"pool":          "api",
+		"upstream_addr": "10.0.0.1:8080",
+	}
+	for key, want := range expected {
+		if record[key] != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, record[key])
+		}
+	}
+}
+
+func TestAccessLogCombinedFormat(t *testing.T) {
+	entry := &accesslog.Entry{
+		Time:      time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		ClientIP:  "192.0.2.1",
+		Method:    "GET",
+		URI:       "/index.html",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		BytesOut:  1024,
+		UserAgent: "curl/8.0",
+	}
+
+	line, err := accesslog.CombinedFormatter{}.Format(entry)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `192.0.2.1 - - [01/Mar/2024:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 1024 "-" "curl/8.0"` + "\n"
+	if string(line) != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := accesslog.NewLogger(accesslog.JSONFormatter{}, &buf, accesslog.Sampling{"2xx": 0})
+
+	logger.Log(&accesslog.Entry{Status: 200})
+	if buf.Len() != 0 {
+		t.Errorf("Expected 2xx entry to be sampled out, got %q", buf.String())
+	}
+
+	logger.Log(&accesslog.Entry{Status: 502})
+	if buf.Len() == 0 {
+		t.Error("Expected 5xx entry to be written")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := accesslog.NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	for name, want := range map[string]string{path: "third\n", path + ".1": "second\n", path + ".2": "first\n"} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := accesslog.NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rf.Close()
+
+	// A non-empty directory in the way of the backup makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := rf.Write([]byte("first\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := rf.Write([]byte("second\n")); err == nil {
+		t.Error("Expected the failed rotation to be reported")
+	}
+
+	// Writes go on appending, and rotation resumes once the rename succeeds.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := rf.Write([]byte("third\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{path: "third\n", path + ".1": "first\nsecond\n"} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package unit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+)
+
+func newTestServer(t *testing.T, rawURL string, weight, priority int) *domain.Server {
+	t.Helper()
+	server, err := domain.NewServer(rawURL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server.Weight = weight
+	server.Priority = priority
+	return server
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	heavy := newTestServer(t, "http://heavy.com", 3, 0)
+	light := newTestServer(t, "http://light.com", 1, 0)
+	rr := loadbalancers.NewRoundRobin([]*domain.Server{heavy, light})
+
+	counts := make(map[*domain.Server]int)
+	for i := 0; i < 8; i++ {
+		server, err := rr.NextServer(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		counts[server]++
+	}
+
+	if counts[heavy] != 6 || counts[light] != 2 {
+		t.Errorf("Expected a 6/2 split, got %d/%d", counts[heavy], counts[light])
+	}
+}
+
+func TestPriorityFailover(t *testing.T) {
+	primary := newTestServer(t, "http://primary.com", 1, 0)
+	backup := newTestServer(t, "http://backup.com", 1, 1)
+
+	for _, algorithm := range loadbalancers.Algorithms {
+		lb, err := loadbalancers.New(algorithm, []*domain.Server{backup, primary})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		primary.Active.Store(true)
+		if server, _ := lb.NextServer(context.Background()); server != primary {
+			t.Errorf("%s: expected primary server while it is healthy", algorithm)
+		}
+
+		primary.Active.Store(false)
+		if server, _ := lb.NextServer(context.Background()); server != backup {
+			t.Errorf("%s: expected backup server when primary is down", algorithm)
+		}
+	}
+}
+
+func TestMaxConnectionsSkipsFullServer(t *testing.T) {
+	full := newTestServer(t, "http://full.com", 1, 0)
+	full.MaxConnections = 1
+	full.Connections = 1
+	other := newTestServer(t, "http://other.com", 1, 0)
+	other.Connections = 5
+
+	lb := loadbalancers.NewLeastConnections([]*domain.Server{full, other})
+	if server, _ := lb.NextServer(context.Background()); server != other {
+		t.Errorf("Expected the server below its connection cap")
+	}
+}
@@ -0,0 +1,159 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/concurrency"
+)
+
+func newLimiter(t *testing.T, opts concurrency.Options) *concurrency.Limiter {
+	t.Helper()
+	l, err := concurrency.New(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return l
+}
+
+// acquireAll takes the whole limit.
+func acquireAll(t *testing.T, l *concurrency.Limiter) []*concurrency.Token {
+	t.Helper()
+	var tokens []*concurrency.Token
+	for n := l.Limit(); n > 0; n-- {
+		token, err := l.Acquire(context.Background(), concurrency.Normal)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := newLimiter(t, concurrency.Options{Algorithm: "aimd", InitialLimit: 10, MaxLimit: 100, LatencyThreshold: 100 * time.Millisecond})
+	tokens := acquireAll(t, l)
+
+	tokens[9].Release(10*time.Millisecond, false)
+	if got := l.Limit(); got != 11 {
+		t.Errorf("Expected the limit to grow to 11 while in use, got %d", got)
+	}
+	tokens[8].Release(10*time.Millisecond, true)
+	if got := l.Limit(); got != 9 {
+		t.Errorf("Expected a drop to back off to 9, got %d", got)
+	}
+	tokens[7].Release(200*time.Millisecond, false)
+	if got := l.Limit(); got != 8 {
+		t.Errorf("Expected a slow request to back off to 8, got %d", got)
+	}
+	// Requests admitted with little in flight do not grow the limit.
+	tokens[0].Release(10*time.Millisecond, false)
+	if got := l.Limit(); got != 8 {
+		t.Errorf("Expected the limit to stay at 8, got %d", got)
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	l := newLimiter(t, concurrency.Options{InitialLimit: 20, MaxLimit: 200})
+	round := func(rtt time.Duration) {
+		for _, token := range acquireAll(t, l) {
+			token.Release(rtt, false)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		round(10 * time.Millisecond)
+	}
+	grown := l.Limit()
+	if grown <= 20 {
+		t.Fatalf("Expected the limit to grow at steady latency, got %d", grown)
+	}
+	for i := 0; i < 3; i++ {
+		round(100 * time.Millisecond)
+	}
+	if got := l.Limit(); got >= grown/2 {
+		t.Errorf("Expected the limit to shrink from %d when latency rises, got %d", grown, got)
+	}
+}
+
+func TestConcurrencyQueuePriority(t *testing.T) {
+	l := newLimiter(t, concurrency.Options{InitialLimit: 1, MaxLimit: 1, QueueSize: 2, QueueTimeout: time.Minute})
+	held, err := l.Acquire(context.Background(), concurrency.Normal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	type result struct {
+		name  string
+		token *concurrency.Token
+		err   error
+	}
+	results := make(chan result, 4)
+	enqueue := func(name string, p concurrency.Priority, queued int) {
+		go func() {
+			token, err := l.Acquire(context.Background(), p)
+			results <- result{name, token, err}
+		}()
+		for l.Queued() != queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("old", concurrency.Normal, 1)
+	enqueue("new", concurrency.Normal, 2)
+
+	// A full queue sheds the oldest request of lower priority.
+	if _, err := l.Acquire(context.Background(), concurrency.Normal); !errors.Is(err, concurrency.ErrLimitExceeded) {
+		t.Fatalf("Expected a full queue to shed an equal priority, got %v", err)
+	}
+	go func() {
+		token, err := l.Acquire(context.Background(), concurrency.Critical)
+		results <- result{"critical", token, err}
+	}()
+	if r := <-results; r.name != "old" || !errors.Is(r.err, concurrency.ErrEvicted) {
+		t.Fatalf("Expected the oldest request to be evicted, got %s: %v", r.name, r.err)
+	}
+	for l.Queued() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The highest priority goes first, then the newest.
+	order := []string{"critical", "new"}
+	release := held
+	for _, want := range order {
+		release.Ignore()
+		r := <-results
+		if r.name != want || r.err != nil {
+			t.Fatalf("Expected %s to be admitted, got %s: %v", want, r.name, r.err)
+		}
+		release = r.token
+	}
+	release.Ignore()
+}
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	l := newLimiter(t, concurrency.Options{InitialLimit: 1, MaxLimit: 1, QueueSize: 1, QueueTimeout: 20 * time.Millisecond})
+	held, err := l.Acquire(context.Background(), concurrency.Normal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer held.Ignore()
+
+	start := time.Now()
+	if _, err := l.Acquire(context.Background(), concurrency.Critical); !errors.Is(err, concurrency.ErrQueueTimeout) {
+		t.Errorf("Expected a queue timeout, got %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Expected to wait for the queue timeout, waited %v", waited)
+	}
+	if l.Queued() != 0 {
+		t.Errorf("Expected the timed out request to leave the queue, %d queued", l.Queued())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, concurrency.Normal); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled request to give up, got %v", err)
+	}
+}
@@ -0,0 +1,621 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/config"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := config.Parse("test.yaml", []byte("backend_servers:\n  - \"http://localhost:8081\"\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.LoadBalancer.Algorithm != "round-robin" {
+		t.Errorf("Expected default algorithm round-robin, got %q", cfg.LoadBalancer.Algorithm)
+	}
+	if cfg.LoadBalancer.HealthCheckInterval != 10*time.Second {
+		t.Errorf("Expected default health check interval 10s, got %v", cfg.LoadBalancer.HealthCheckInterval)
+	}
+	if !cfg.FeatureToggles.EnableCircuitBreaker {
+		t.Error("Expected circuit breaker to be enabled by default")
+	}
+}
+
+func TestConfigRejectsUnknownKeys(t *testing.T) {
+	_, err := config.Parse("test.yaml", []byte("server:\n  listen: \":8080\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected unknown key error on line 2, got %v", err)
+	}
+}
+
+func TestConfigValidationReportsAllErrors(t *testing.T) {
+	data := `load_balancer:
+  algorithm: "fastest"
+  health_check_interval: 0s
+pools:
+  - name: "api"
+    backends:
+      - "localhost:9000"
+routes:
+  - name: "api"
+    pool: "missing"
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected *config.ValidationError, got %v", err)
+	}
+
+	expected := map[string]int{
+		"load_balancer.algorithm":             2,
+		"load_balancer.health_check_interval": 3,
+		"pools[0].backends[0]":                7,
+		"routes[0].pool":                      10,
+	}
+	if len(verr.Errors) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(verr.Errors), err)
+	}
+	for _, fe := range verr.Errors {
+		if line, ok := expected[fe.Path]; !ok || fe.Line != line {
+			t.Errorf("Unexpected error %s at line %d", fe.Error(), fe.Line)
+		}
+	}
+}
+
+func TestShippedConfigIsValid(t *testing.T) {
+	if _, err := config.Load("../../config/config.yaml"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func writeConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestConfigLayeredOverrides(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  listen_addr: \":8080\"\nload_balancer:\n  max_retries: 1\n")
+
+	secret := filepath.Join(t.TempDir(), "headers")
+	if err := os.WriteFile(secret, []byte("authorization=Bearer token\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := config.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-load_balancer.max_retries=3"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	environ := []string{
+		"LB_SERVER_LISTEN_ADDR=:9000",
+		"LB_LOAD_BALANCER_MAX_RETRIES=2",
+		"LB_BACKEND_SERVERS=http://a:80, http://b:80",
+		"LB_TRACING_HEADERS_FILE=" + secret,
+	}
+	cfg, err := config.LoadLayered(path, environ, overrides)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.Server.ListenAddr != ":9000" {
+		t.Errorf("Expected listen address from env, got %q", cfg.Server.ListenAddr)
+	}
+	if cfg.LoadBalancer.MaxRetries != 3 {
+		t.Errorf("Expected flag to take precedence over env, got %d", cfg.LoadBalancer.MaxRetries)
+	}
+	if len(cfg.BackendServers) != 2 || cfg.BackendServers[1].URL != "http://b:80" {
+		t.Errorf("Unexpected backend servers %v", cfg.BackendServers)
+	}
+	if got := cfg.Tracing.Headers["authorization"]; got != "Bearer token" {
+		t.Errorf("Expected header from _FILE variable, got %q", got)
+	}
+
+	sources := map[string]string{
+		"server.listen_addr":        "env LB_SERVER_LISTEN_ADDR",
+		"load_balancer.max_retries": "flag -load_balancer.max_retries",
+		"tracing.headers":           "env LB_TRACING_HEADERS_FILE",
+		"server.read_timeout":       config.SourceDefault,
+	}
+	for path, want := range sources {
+		if got := cfg.Source(path); got != want {
+			t.Errorf("Expected source of %s to be %q, got %q", path, want, got)
+		}
+	}
+
+	var out bytes.Buffer
+	cfg.Print(&out)
+	if strings.Contains(out.String(), "Bearer") {
+		t.Errorf("Expected secret to be redacted, got:\n%s", out.String())
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	path := writeConfigFile(t, `rate_limiting:
+  redis:
+    password: "hunter2"
+tracing:
+  headers:
+    authorization: "Bearer token"
+`)
+	cfg, err := config.LoadLayered(path, []string{"LB_SERVER_LISTEN_ADDR=:9000"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	cfg.Print(&out)
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "Bearer") {
+		t.Errorf("Expected secrets from the file to be redacted, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "server.listen_addr: :9000") {
+		t.Errorf("Expected other values to be printed, got:\n%s", out.String())
+	}
+}
+
+func TestConfigOverrideValidationNamesSource(t *testing.T) {
+	path := writeConfigFile(t, "backend_servers:\n  - \"http://localhost:8081\"\n")
+
+	_, err := config.LoadLayered(path, []string{"LB_LOAD_BALANCER_ALGORITHM=fastest"}, nil)
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 1 {
+		t.Fatalf("Expected one validation error, got %v", err)
+	}
+	if fe := verr.Errors[0]; fe.Source != "env LB_LOAD_BALANCER_ALGORITHM" || fe.Line != 0 {
+		t.Errorf("Expected error attributed to the environment, got %+v", fe)
+	}
+}
+
+func TestConfigBackendForms(t *testing.T) {
+	data := `pools:
+  - name: "api"
+    backends:
+      - "http://localhost:9000"
+      - url: "http://localhost:9001"
+        weight: 3
+        health_check_path: "/ready"
+        zone: "eu-west-1a"
+        priority: 1
+        max_connections: 100
+        tags:
+          version: "v2"
+`
+	cfg, err := config.Parse("test.yaml", []byte(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	backends := cfg.Pools[0].Backends
+	if backends[0].URL != "http://localhost:9000" || backends[0].Weight != 1 {
+		t.Errorf("Unexpected short form backend %+v", backends[0])
+	}
+	b := backends[1]
+	if b.Weight != 3 || b.HealthCheckPath != "/ready" || b.Zone != "eu-west-1a" ||
+		b.Priority != 1 || b.MaxConnections != 100 || b.Tags["version"] != "v2" {
+		t.Errorf("Unexpected backend %+v", b)
+	}
+}
+
+func TestConfigBackendValidation(t *testing.T) {
+	data := `backend_servers:
+  - url: "http://localhost:9000"
+    weight: 0
+  - url: "http://localhost:9001"
+    max_conns: 10
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+	if err == nil || !strings.Contains(err.Error(), "line 5: field max_conns not found") {
+		t.Fatalf("Expected unknown backend field error on line 5, got %v", err)
+	}
+
+	_, err = config.Parse("test.yaml", []byte(data[:strings.Index(data, "  - url: \"http://localhost:9001\"")]))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || verr.Errors[0].Path != "backend_servers[0].weight" || verr.Errors[0].Line != 3 {
+		t.Fatalf("Expected weight error on line 3, got %v", err)
+	}
+}
+
+func TestConfigListenerNeedsTCPBackends(t *testing.T) {
+	data := `pools:
+  - name: "postgres"
+    backends:
+      - "tcp://db1:5432"
+      - "http://db2:5432"
+listeners:
+  - name: "postgres"
+    protocol: "tcp"
+    listen_addr: ":5432"
+    pool: "postgres"
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 1 {
+		t.Fatalf("Expected one validation error, got %v", err)
+	}
+	if fe := verr.Errors[0]; fe.Path != "pools[0].backends[1]" || fe.Line != 5 {
+		t.Errorf("Unexpected error %s at line %d", fe.Error(), fe.Line)
+	}
+}
+
+func TestConfigProxyProtocolValidation(t *testing.T) {
+	data := `server:
+  proxy_protocol:
+    enabled: true
+pools:
+  - name: "dns"
+    proxy_protocol: "v3"
+    backends:
+      - "udp://ns1:53"
+listeners:
+  - name: "dns"
+    protocol: "udp"
+    listen_addr: ":53"
+    pool: "dns"
+    proxy_protocol:
+      enabled: true
+      trusted_sources: ["10.0.0.0/33"]
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	paths := make(map[string]bool)
+	for _, fe := range verr.Errors {
+		paths[fe.Path] = true
+	}
+	for _, want := range []string{
+		"server.proxy_protocol.trusted_sources",
+		"pools[0].proxy_protocol",
+		"listeners[0].proxy_protocol",
+		"listeners[0].proxy_protocol.trusted_sources[0]",
+	} {
+		if !paths[want] {
+			t.Errorf("Expected an error for %s, got %v", want, err)
+		}
+	}
+}
+
+func TestConfigTLSValidation(t *testing.T) {
+	data := `tls:
+  enabled: true
+  certificates:
+    - cert_file: "missing.crt"
+      key_file: "missing.key"
+  min_version: "1.4"
+  cipher_suites: ["TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_RSA_WITH_RC4_128_SHA"]
+  alpn: ["h2", "spdy/3"]
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	paths := make(map[string]bool)
+	for _, fe := range verr.Errors {
+		paths[fe.Path] = true
+	}
+	for _, want := range []string{
+		"tls.certificates[0].cert_file",
+		"tls.min_version",
+		"tls.cipher_suites",
+		"tls.alpn[1]",
+	} {
+		if !paths[want] {
+			t.Errorf("Expected an error for %s, got %v", want, err)
+		}
+	}
+	if paths["tls.cert_file"] {
+		t.Errorf("Expected cert_file to be optional with certificates, got %v", err)
+	}
+}
+
+func TestConfigACMEValidation(t *testing.T) {
+	data := `tls:
+  enabled: true
+  acme:
+    enabled: true
+    directory_url: "localhost:14000/dir"
+    domains: ["example.com", "*.example.com", "localhost"]
+    renew_before: 30m
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{"tls.acme.directory_url", "tls.acme.domains[1]", "tls.acme.domains[2]", "tls.acme.renew_before"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+}
+
+func TestConfigRateLimitingValidation(t *testing.T) {
+	data := `rate_limiting:
+  policies:
+    - name: "per-key"
+      rate: 0
+      burst: 0
+      key: "jwt_claim"
+      overrides:
+        - key: "partner"
+          rate: 10
+          burst: 20
+routes:
+  - name: "api"
+    path_prefix: "/api/"
+    pool: "default"
+    rate_limit: "per-client"
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{
+		"rate_limiting.policies[0].claim",
+		"rate_limiting.policies[0].rate",
+		"rate_limiting.policies[0].burst",
+		"routes[0].rate_limit",
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+
+	cfg, err := config.Parse("test.yaml", []byte("rate_limiting:\n  global: null\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.RateLimiting.Global != nil {
+		t.Errorf("Expected null to remove the global policy, got %+v", cfg.RateLimiting.Global)
+	}
+}
+
+func TestConfigRateLimitRedisValidation(t *testing.T) {
+	redis := `  redis:
+    address: "redis"
+    pool_size: 0
+    on_error: "retry"
+`
+	// The redis section is only checked when it is used.
+	if _, err := config.Parse("test.yaml", []byte("rate_limiting:\n"+redis)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err := config.Parse("test.yaml", []byte("rate_limiting:\n  store: \"redis\"\n"+redis))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{
+		"rate_limiting.redis.address",
+		"rate_limiting.redis.pool_size",
+		"rate_limiting.redis.on_error",
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+}
+
+func TestConfigRouteClientAuthNeedsTLS(t *testing.T) {
+	data := `routes:
+  - name: "admin"
+    path_prefix: "/admin/"
+    pool: "default"
+    client_auth:
+      allowed_common_names: ["ops"]
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 1 {
+		t.Fatalf("Expected one validation error, got %v", err)
+	}
+	if fe := verr.Errors[0]; fe.Path != "routes[0].client_auth" || fe.Line != 6 {
+		t.Errorf("Unexpected error %s at line %d", fe.Error(), fe.Line)
+	}
+}
+
+func TestConfigPoolsInheritUpstreamTLS(t *testing.T) {
+	data := `load_balancer:
+  upstream_tls:
+    server_name: "backend.internal"
+pools:
+  - name: "api"
+    backends: ["https://10.0.0.1"]
+  - name: "legacy"
+    backends: ["https://10.0.0.2"]
+    upstream_tls:
+      insecure_skip_verify: true
+`
+	cfg, err := config.Parse("test.yaml", []byte(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pools := make(map[string]config.PoolConfig)
+	for _, p := range cfg.PoolConfigs() {
+		pools[p.Name] = p
+	}
+	if tls := pools["api"].UpstreamTLS; tls == nil || tls.ServerName != "backend.internal" {
+		t.Errorf("Expected api to inherit upstream TLS, got %+v", tls)
+	}
+	if tls := pools["legacy"].UpstreamTLS; tls == nil || !tls.InsecureSkipVerify || tls.ServerName != "" {
+		t.Errorf("Expected legacy to use its own upstream TLS, got %+v", tls)
+	}
+}
+
+func TestConfigConcurrencyValidation(t *testing.T) {
+	data := `load_balancer:
+  concurrency:
+    algorithm: "aimd"
+    queue_size: 10
+pools:
+  - name: "api"
+    concurrency:
+      algorithm: "vegas"
+  - name: "batch"
+    concurrency:
+      min_limit: 10
+      max_limit: 5
+routes:
+  - name: "admin"
+    pool: "api"
+    priority: "urgent"
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{"pools[0].concurrency.algorithm", "pools[1].concurrency", "routes[0].priority"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+
+	cfg, err := config.Parse("test.yaml", []byte("load_balancer:\n  concurrency:\n    algorithm: \"aimd\"\npools:\n  - name: \"api\"\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, p := range cfg.PoolConfigs() {
+		if p.Concurrency == nil || p.Concurrency.Algorithm != "aimd" {
+			t.Errorf("Expected pool %s to inherit the concurrency limit, got %+v", p.Name, p.Concurrency)
+		}
+	}
+}
+
+func TestConfigQueueValidation(t *testing.T) {
+	data := `load_balancer:
+  queue:
+    size: 10
+    timeout: 2s
+pools:
+  - name: "api"
+    queue:
+      size: -1
+  - name: "batch"
+    queue:
+      size: 5
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{"pools[0].queue.size", "pools[1].queue.timeout"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+
+	cfg, err := config.Parse("test.yaml", []byte("load_balancer:\n  queue:\n    size: 10\n    timeout: 2s\npools:\n  - name: \"api\"\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, p := range cfg.PoolConfigs() {
+		if p.Queue == nil || p.Queue.Size != 10 || p.Queue.Timeout != 2*time.Second {
+			t.Errorf("Expected pool %s to inherit the queue, got %+v", p.Name, p.Queue)
+		}
+	}
+}
+
+func TestConfigDiscoveryValidation(t *testing.T) {
+	data := `pools:
+  - name: "files"
+    discovery:
+      provider: "file"
+      file:
+        path: "/etc/lb/targets.json"
+  - name: "both"
+    backends: ["http://localhost:9081"]
+    discovery:
+      provider: "file"
+      file:
+        path: "/etc/lb/targets.json"
+  - name: "unknown"
+    discovery:
+      provider: "zookeeper"
+  - name: "nopath"
+    discovery:
+      provider: "file"
+  - name: "srv"
+    discovery:
+      provider: "dns"
+      dns:
+        name: "_http._tcp.api.example.com"
+        type: "SRV"
+  - name: "noport"
+    discovery:
+      provider: "dns"
+      dns:
+        name: "api.example.com"
+        resolver: "10.0.0.53"
+  - name: "consul"
+    discovery:
+      provider: "consul"
+      consul:
+        address: "127.0.0.1:8500"
+  - name: "k8s"
+    discovery:
+      provider: "kubernetes"
+      kubernetes:
+        service: "api"
+        api_server: "https://kubernetes.default.svc"
+        ca_file: "/nonexistent/ca.crt"
+`
+	_, err := config.Parse("test.yaml", []byte(data))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	var paths []string
+	for _, fe := range verr.Errors {
+		paths = append(paths, fe.Path)
+	}
+	want := []string{"pools[1].backends", "pools[2].discovery.provider", "pools[3].discovery.file.path",
+		"pools[5].discovery.dns.port", "pools[5].discovery.dns.resolver",
+		"pools[6].discovery.consul.service", "pools[6].discovery.consul.address",
+		"pools[7].discovery.kubernetes.ca_file"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected errors for %v, got %v", want, err)
+	}
+}
@@ -0,0 +1,201 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/discovery"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+func TestParseTargets(t *testing.T) {
+	servers, err := discovery.ParseTargets([]byte(`[
+  {"targets": ["10.0.0.1:8080", "10.0.0.2:8080"], "labels": {"__weight__": "3", "__zone__": "eu-west-1a", "env": "prod"}},
+  {"targets": ["10.0.0.3:8443"], "labels": {"__scheme__": "https", "__health_check_path__": "/ready", "__priority__": "1", "__max_connections__": "50"}}
+]`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("Expected 3 servers, got %d", len(servers))
+	}
+	if s := servers[1]; s.URL.String() != "http://10.0.0.2:8080" || s.Weight != 3 || s.Zone != "eu-west-1a" || s.Tags["env"] != "prod" {
+		t.Errorf("Unexpected server %s: weight %d, zone %q, tags %v", s.URL, s.Weight, s.Zone, s.Tags)
+	}
+	if s := servers[2]; s.URL.String() != "https://10.0.0.3:8443" || s.HealthCheckPath != "/ready" || s.Priority != 1 || s.MaxConnections != 50 || s.Weight != 1 {
+		t.Errorf("Unexpected server %s: health check %q, priority %d, max connections %d, weight %d",
+			s.URL, s.HealthCheckPath, s.Priority, s.MaxConnections, s.Weight)
+	}
+
+	yamlServers, err := discovery.ParseTargets([]byte("- targets: [\"10.0.0.1:8080\"]\n"))
+	if err != nil || len(yamlServers) != 1 {
+		t.Errorf("Expected one server from YAML, got %d (%v)", len(yamlServers), err)
+	}
+	if servers, err := discovery.ParseTargets([]byte("[]")); err != nil || len(servers) != 0 {
+		t.Errorf("Expected an empty list to have no servers, got %d (%v)", len(servers), err)
+	}
+
+	for _, bad := range []string{
+		"",
+		`[{"targets": ["10.0.0.1:8080"]`,
+		`[{"targets": ["10.0.0.1"]}]`,
+		`[{"targets": ["10.0.0.1:8080"], "labels": {"__weight__": "0"}}]`,
+		`[{"targets": ["10.0.0.1:8080"], "labels": {"__scheme__": "ftp"}}]`,
+		`[{"targets": ["10.0.0.1:8080"], "labels": {"__unknown__": "x"}}]`,
+		`[{"targets": ["10.0.0.1:8080", "10.0.0.1:8080"]}]`,
+		`[{"targets": ["10.0.0.1:8080"], "port": 80}]`,
+	} {
+		if _, err := discovery.ParseTargets([]byte(bad)); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFileProviderKeepsLastGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	write := func(data string) {
+		t.Helper()
+		// Replace the file by renaming, as config management tools do.
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	write(`[{"targets": ["10.0.0.1:8080"]}]`)
+
+	provider, err := discovery.NewFileProvider(discovery.FileOptions{Path: path, Debounce: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan discovery.Update)
+	go provider.Run(ctx, updates)
+	next := func() discovery.Update {
+		t.Helper()
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an update")
+			return discovery.Update{}
+		}
+	}
+
+	if u := next(); u.Err != nil || len(u.Servers) != 1 {
+		t.Fatalf("Expected the initial server, got %d (%v)", len(u.Servers), u.Err)
+	}
+	write(`[{"targets": ["10.0.0.1:8080"`)
+	if u := next(); u.Err == nil {
+		t.Errorf("Expected an error for a malformed file, got %d servers", len(u.Servers))
+	}
+	write(`[{"targets": ["10.0.0.1:8080", "10.0.0.2:8080"]}]`)
+	if u := next(); u.Err != nil || len(u.Servers) != 2 {
+		t.Errorf("Expected 2 servers after the fix, got %d (%v)", len(u.Servers), u.Err)
+	}
+}
+
+func TestSyncServers(t *testing.T) {
+	kept := newTestServer(t, "http://kept.com", 1, 0)
+	changed := newTestServer(t, "http://changed.com", 1, 0)
+	changed.MaxConnections = 1
+	changed.Acquire()
+	gone := newTestServer(t, "http://gone.com", 1, 0)
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{kept, changed, gone}), nil)
+
+	update := newTestServer(t, "http://changed.com", 2, 1)
+	update.MaxConnections = 2
+	added, removed := pool.SyncServers([]*domain.Server{
+		newTestServer(t, "http://kept.com", 1, 0),
+		update,
+		newTestServer(t, "http://new.com", 1, 0),
+	})
+	if want := []string{"http://new.com"}; !slices.Equal(added, want) {
+		t.Errorf("Expected %v added, got %v", want, added)
+	}
+	if want := []string{"http://gone.com"}; !slices.Equal(removed, want) {
+		t.Errorf("Expected %v removed, got %v", want, removed)
+	}
+	servers := pool.GetServers()
+	if len(servers) != 3 || !slices.Contains(servers, kept) || !slices.Contains(servers, changed) {
+		t.Errorf("Expected 3 servers including the existing ones, got %v", servers)
+	}
+
+	// The changed server keeps the request in flight on it, which counts
+	// against its new cap.
+	if changed.Weight != 2 || changed.Priority != 1 || changed.Connections != 1 {
+		t.Errorf("Expected weight 2, priority 1 and 1 connection, got %d, %d and %d", changed.Weight, changed.Priority, changed.Connections)
+	}
+	if !changed.Acquire() || changed.Acquire() {
+		t.Error("Expected the new cap of 2 to apply to the existing connection")
+	}
+
+	if added, removed := pool.SyncServers(servers); len(added)+len(removed) != 0 {
+		t.Errorf("Expected no change, got %v added and %v removed", added, removed)
+	}
+}
+
+func TestSyncServersWhileServing(t *testing.T) {
+	server := newTestServer(t, "http://api.com", 1, 0)
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewLeastConnections([]*domain.Server{server}), nil)
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 1000 {
+			if s, err := pool.AcquireServer(ctx); err == nil {
+				pool.ReleaseServer(s)
+			}
+		}
+	}()
+	for i := range 100 {
+		update := newTestServer(t, "http://api.com", i%3+1, 0)
+		update.MaxConnections = i % 2
+		pool.SyncServers([]*domain.Server{update})
+	}
+	<-done
+	if servers := pool.GetServers(); len(servers) != 1 || servers[0] != server || server.Connections != 0 {
+		t.Errorf("Expected the server to be kept without connections, got %v", servers)
+	}
+}
+
+func TestSyncServersRemovesBackendMetrics(t *testing.T) {
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	kept := newTestServer(t, "http://kept.com", 1, 0)
+	gone := newTestServer(t, "http://gone.com", 1, 0)
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{kept, gone}), nil,
+		usecases.WithName("api"), usecases.WithMetrics(m))
+	for _, host := range []string{"kept.com", "gone.com"} {
+		m.SetActiveConnections("api", host, 1)
+		m.ObserveHealthCheck("api", host, true)
+	}
+
+	pool.SyncServers([]*domain.Server{newTestServer(t, "http://kept.com", 2, 0)})
+	if n := testutil.CollectAndCount(m.BackendUp); n != 1 {
+		t.Errorf("Expected the series of the removed backend to be deleted, got %d backend_up series", n)
+	}
+	if n := testutil.CollectAndCount(m.ActiveConnections); n != 1 {
+		t.Errorf("Expected 1 active_connections series, got %d", n)
+	}
+
+	m.RemovePool("api")
+	if n := testutil.CollectAndCount(m.HealthChecksTotal); n != 0 {
+		t.Errorf("Expected no series after removing the pool, got %d", n)
+	}
+}
@@ -0,0 +1,55 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+)
+
+func TestHashAlgorithmsAreSticky(t *testing.T) {
+	for _, algorithm := range []string{"ip-hash", "consistent-hash"} {
+		servers := []*domain.Server{
+			newTestServer(t, "http://a.com", 1, 0),
+			newTestServer(t, "http://b.com", 1, 0),
+			newTestServer(t, "http://c.com", 1, 0),
+		}
+		lb, err := loadbalancers.New(algorithm, servers)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		ctx := domain.WithHashKey(context.Background(), "10.0.0.1")
+		first, _ := lb.NextServer(ctx)
+		for i := 0; i < 5; i++ {
+			if server, _ := lb.NextServer(ctx); server != first {
+				t.Errorf("%s: expected the same server for the same key", algorithm)
+			}
+		}
+	}
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	servers := []*domain.Server{
+		newTestServer(t, "http://a.com", 1, 0),
+		newTestServer(t, "http://b.com", 1, 0),
+		newTestServer(t, "http://c.com", 1, 0),
+	}
+	lb := loadbalancers.NewConsistentHash(servers)
+
+	before := make(map[string]*domain.Server)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		before[key], _ = lb.NextServer(domain.WithHashKey(context.Background(), key))
+	}
+
+	servers[2].Active.Store(false)
+	for key, server := range before {
+		after, _ := lb.NextServer(domain.WithHashKey(context.Background(), key))
+		if server != servers[2] && after != server {
+			t.Fatalf("Key %s moved from %s to %s although its server is still up", key, server.URL, after.URL)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/circuitbreaker"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
+	"github.com/sdfpt05/go_load_balancer/v2/internal/usecases"
+	"github.com/sdfpt05/go_load_balancer/v2/pkg/metrics"
+)
+
+func TestPoolQueueWaitsForCapacity(t *testing.T) {
+	server := newTestServer(t, "http://capped.com", 1, 0)
+	server.MaxConnections = 1
+	m, err := metrics.New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), nil,
+		usecases.WithName("api"), usecases.WithMetrics(m), usecases.WithQueue(1, time.Minute))
+	ctx := context.Background()
+
+	held, err := pool.AcquireServer(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waited := make(chan error, 1)
+	go func() {
+		s, err := pool.AcquireServer(ctx)
+		if err == nil {
+			pool.ReleaseServer(s)
+		}
+		waited <- err
+	}()
+	for testutil.ToFloat64(m.QueueDepth.WithLabelValues("api")) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := pool.AcquireServer(ctx); !errors.Is(err, usecases.ErrQueueFull) {
+		t.Errorf("Expected a full queue, got %v", err)
+	}
+
+	pool.ReleaseServer(held)
+	if err := <-waited; err != nil {
+		t.Fatalf("Expected the queued request to get the server, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.QueueDepth.WithLabelValues("api")); got != 0 {
+		t.Errorf("Expected an empty queue, got depth %v", got)
+	}
+
+	pool.SetQueue(1, 10*time.Millisecond)
+	held, err = pool.AcquireServer(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer pool.ReleaseServer(held)
+	if _, err := pool.AcquireServer(ctx); !errors.Is(err, usecases.ErrQueueTimeout) {
+		t.Errorf("Expected a queue timeout, got %v", err)
+	}
+	if n := testutil.CollectAndCount(m.QueueWait); n != 3 {
+		t.Errorf("Expected waits observed as admitted, full and timeout, got %d series", n)
+	}
+
+	// Without a queue, requests fail as soon as every server is full.
+	pool.SetQueue(0, 0)
+	if _, err := pool.AcquireServer(ctx); !errors.Is(err, loadbalancers.ErrNoServersAvailable) {
+		t.Errorf("Expected no server available, got %v", err)
+	}
+}
+
+func TestPoolAtCapacityDoesNotTripBreaker(t *testing.T) {
+	server := newTestServer(t, "http://capped.com", 1, 0)
+	server.MaxConnections = 1
+	cb := circuitbreaker.NewCircuitBreaker(5, 10*time.Second)
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), cb,
+		usecases.WithQueue(1, time.Millisecond))
+	ctx := context.Background()
+
+	held, err := pool.AcquireServer(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for range 10 {
+		if _, err := pool.AcquireServer(ctx); !errors.Is(err, usecases.ErrQueueTimeout) {
+			t.Fatalf("Expected a queue timeout, got %v", err)
+		}
+	}
+	if state := cb.State(); state != circuitbreaker.StateClosed {
+		t.Errorf("Expected the breaker to stay closed, got state %d", state)
+	}
+
+	pool.ReleaseServer(held)
+	s, err := pool.AcquireServer(ctx)
+	if err != nil {
+		t.Fatalf("Expected the server once released, got %v", err)
+	}
+	pool.ReleaseServer(s)
+}
+
+func TestBreakerIgnoresServersAtCapacity(t *testing.T) {
+	server := newTestServer(t, "http://capped.com", 1, 0)
+	server.MaxConnections = 1
+	cb := circuitbreaker.NewCircuitBreaker(2, 50*time.Millisecond)
+	pool := usecases.NewLoadBalancerUseCase(loadbalancers.NewRoundRobin([]*domain.Server{server}), cb)
+	ctx := context.Background()
+	fail := func() {
+		server.Active.Store(false)
+		defer server.Active.Store(true)
+		if _, err := pool.GetNextServer(ctx); err == nil {
+			t.Fatal("Expected no server while it is down")
+		}
+	}
+	atCapacity := func() {
+		server.Acquire()
+		defer server.Release()
+		if _, err := pool.GetNextServer(ctx); !errors.Is(err, loadbalancers.ErrNoServersAvailable) {
+			t.Fatalf("Expected no server available, got %v", err)
+		}
+	}
+
+	// A server at its cap does not clear the failures before it.
+	fail()
+	atCapacity()
+	fail()
+	if state := cb.State(); state != circuitbreaker.StateOpen {
+		t.Fatalf("Expected the breaker to open after 2 failures, got state %d", state)
+	}
+
+	// Nor does it close the breaker once it is half-open.
+	time.Sleep(100 * time.Millisecond)
+	atCapacity()
+	if state := cb.State(); state != circuitbreaker.StateHalfOpen {
+		t.Errorf("Expected the breaker to stay half-open, got state %d", state)
+	}
+	if _, err := pool.GetNextServer(ctx); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if state := cb.State(); state != circuitbreaker.StateClosed {
+		t.Errorf("Expected a picked server to close the breaker, got state %d", state)
+	}
+}
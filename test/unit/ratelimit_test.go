@@ -0,0 +1,92 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/ratelimit"
+)
+
+func TestDecide(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 10, Burst: 3}
+	now := time.Unix(1000, 0)
+
+	var tat time.Time
+	var res ratelimit.Result
+	for i := 2; i >= 0; i-- {
+		tat, res = ratelimit.Decide(tat, limit, now)
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("Expected request admitted with %d remaining, got %+v", i, res)
+		}
+	}
+	if res.ResetAfter != 300*time.Millisecond {
+		t.Errorf("Expected reset after 300ms, got %v", res.ResetAfter)
+	}
+
+	tat, res = ratelimit.Decide(tat, limit, now)
+	if res.Allowed || res.RetryAfter != 100*time.Millisecond || res.Remaining != 0 {
+		t.Errorf("Expected rejection with retry after 100ms, got %+v", res)
+	}
+	// One interval later, one request is admitted again.
+	if _, res = ratelimit.Decide(tat, limit, now.Add(100*time.Millisecond)); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("Expected one request admitted after an interval, got %+v", res)
+	}
+	// After the reset, a key is as good as new.
+	if _, res = ratelimit.Decide(tat, limit, now.Add(time.Second)); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("Expected full burst after reset, got %+v", res)
+	}
+}
+
+func TestMemoryStoreBounded(t *testing.T) {
+	ctx := context.Background()
+	store := ratelimit.NewMemoryStore(64)
+	limit := ratelimit.Limit{Rate: 1, Burst: 1}
+	for i := 0; i < 10000; i++ {
+		store.Allow(ctx, fmt.Sprintf("client-%d", i), limit)
+	}
+	if n := store.Len(); n > 64 {
+		t.Errorf("Expected at most 64 entries, got %d", n)
+	}
+	// The most recent key is still limited.
+	if res, _ := store.Allow(ctx, "client-9999", limit); res.Allowed {
+		t.Error("Expected the most recent key to keep its state")
+	}
+}
+
+func TestMemoryStoreDropsIdleKeys(t *testing.T) {
+	ctx := context.Background()
+	store := ratelimit.NewMemoryStore(3200)
+	for i := 0; i < 1000; i++ {
+		store.Allow(ctx, fmt.Sprintf("short-%d", i), ratelimit.Limit{Rate: 1000, Burst: 1})
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		store.Allow(ctx, fmt.Sprintf("long-%d", i), ratelimit.Limit{Rate: 1, Burst: 1})
+	}
+	if n := store.Len(); n != 1000 {
+		t.Errorf("Expected only the 1000 keys with state to remain, got %d", n)
+	}
+}
+
+func TestNewRejection(t *testing.T) {
+	tests := []struct {
+		format, template string
+		valid            bool
+	}{
+		{"text", "", true},
+		{"json", "", true},
+		{"text", "slow down, retry in {{.RetryAfter}}s", true},
+		{"json", `{"route":{{json .Route}},"limit":{{.Limit}}}`, true},
+		{"json", `{"route":{{.Route}}}`, false},
+		{"text", "{{.Missing", false},
+		{"xml", "", false},
+	}
+	for _, tt := range tests {
+		_, err := ratelimit.NewRejection(tt.format, tt.template)
+		if (err == nil) != tt.valid {
+			t.Errorf("NewRejection(%q, %q): expected valid %v, got %v", tt.format, tt.template, tt.valid, err)
+		}
+	}
+}
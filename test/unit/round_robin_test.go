@@ -2,8 +2,11 @@ package unit
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/sdfpt05/go_load_balancer/v2/internal/domain"
 	"github.com/sdfpt05/go_load_balancer/v2/internal/infrastructure/loadbalancers"
@@ -37,3 +40,42 @@ func mustParseURL(rawURL string) *url.URL {
 	}
 	return u
 }
+
+func TestHealthCheckDoesNotBlockServerChanges(t *testing.T) {
+	checking, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(checking)
+		<-release
+	}))
+	defer backend.Close()
+	slow := newTestServer(t, backend.URL, 1, 0)
+	rr := loadbalancers.NewRoundRobin([]*domain.Server{slow})
+
+	done := make(chan struct{})
+	go func() {
+		rr.HealthCheck(context.Background())
+		close(done)
+	}()
+	<-checking
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	added := newTestServer(t, "http://added.com", 1, 0)
+	changed := make(chan error, 1)
+	go func() {
+		changed <- rr.AddServer(added)
+	}()
+	select {
+	case err := <-changed:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected servers to change during a slow health check")
+	}
+	if _, err := rr.NextServer(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}